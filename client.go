@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// default path of the control socket (relative to the hades directory).
+const defaultControlPath = "hades.sock"
+
+// controlClient returns an HTTP client connecting to the control socket at
+// path.
+func controlClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// controlRequest sends a request for target to the control socket at path
+// and writes the response body to out (returning the body as the error if
+// the request failed).
+func controlRequest(path, method, target string, body io.Reader, out io.Writer) error {
+	req, err := http.NewRequest(method, "http://hades"+target, body)
+	if err != nil {
+		return err
+	}
+	resp, err := controlClient(path).Do(req)
+	if err != nil {
+		return fmt.Errorf("can't connect to hades (is it running here?): %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s", bytes.TrimSpace(msg))
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// apply command: reconciles daemons with a config file
+func applyCommand(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	file := fs.String("f", "", "config file to apply (- for stdin)")
+	dryRun := fs.Bool("dry-run", false, "only print the plan")
+	control := fs.String("control", defaultControlPath, "control socket of the hades server")
+	fs.Parse(args)
+	if *file == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var data []byte
+	var err error
+	if *file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+	path := "/apply"
+	if *dryRun {
+		path += "?dry_run=1"
+	}
+	return controlRequest(*control, "POST", path, bytes.NewReader(data), os.Stdout)
+}
+
+// export command: writes the daemons as a config file
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	file := fs.String("o", "", "output file (stdout if empty)")
+	control := fs.String("control", defaultControlPath, "control socket of the hades server")
+	fs.Parse(args)
+	var buf bytes.Buffer
+	err := controlRequest(*control, "GET", "/export", nil, &buf)
+	if err != nil {
+		return err
+	}
+	if *file == "" {
+		_, err = buf.WriteTo(os.Stdout)
+		return err
+	}
+	return ioutil.WriteFile(*file, buf.Bytes(), 0644)
+}
+
+// import command: adds daemons from supervisord, Procfile or systemd files
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "file format: supervisord, procfile or systemd (detected if empty)")
+	dryRun := fs.Bool("dry-run", false, "only print what would be imported")
+	control := fs.String("control", defaultControlPath, "control socket of the hades server")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	for _, file := range fs.Args() {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		// absolute so paths relative to the file work on the server
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		q := url.Values{}
+		q.Set("format", *format)
+		q.Set("filename", abs)
+		if *dryRun {
+			q.Set("dry_run", "1")
+		}
+		err = controlRequest(*control, "POST", "/import?"+q.Encode(), bytes.NewReader(data), os.Stdout)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// Exit codes of hades ctl (for scripts).
+const (
+	exitFailure    = 1
+	exitUsage      = 2
+	exitNotRunning = 3
+	exitNotFound   = 4
+	exitConflict   = 5
+)
+
+// Output formats of hades ctl.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputQuiet = "quiet"
+)
+
+// how long hades ctl logs -f waits before reconnecting.
+const followRetry = time.Second
+
+// ctlUsage describes the hades ctl commands.
+const ctlUsage = `usage: hades ctl <command> [flags] [args]
+
+commands:
+  list                     list daemons (-selector, -q)
+  status <daemon>...       show daemons (exits 3 if one isn't running)
+  start <daemon>...        start daemons
+  stop <daemon>...         stop daemons
+  restart <daemon>...      restart daemons
+  logs [-f] <daemon>       print daemon output (-n, -stream, -instance)
+  add [flags] <cmd>...     add a daemon (-name, -dir, -label, -start)
+  rm <daemon>...           remove stopped daemons
+
+Daemons are named or numbered. Every command takes -o table|json|quiet and
+-control (the socket of the hades server, default hades.sock).
+
+exit codes: 0 ok, 1 error, 2 usage, 3 not running, 4 not found, 5 conflict
+(already started, not started or running)
+`
+
+// exitError is an error exiting hades with a specific code (silently if
+// err is nil).
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+// ctlOptions are the flags shared by every hades ctl command.
+type ctlOptions struct {
+	output  string
+	control string
+}
+
+// ctlFlags returns the flag set of a hades ctl command.
+func ctlFlags(name string) (*flag.FlagSet, *ctlOptions) {
+	fs := flag.NewFlagSet("ctl "+name, flag.ExitOnError)
+	o := &ctlOptions{}
+	fs.StringVar(&o.output, "o", outputTable, "output format: table, json or quiet")
+	fs.StringVar(&o.control, "control", defaultControlPath, "control socket of the hades server")
+	return fs, o
+}
+
+// parseCtlFlags parses the arguments of a hades ctl command, exiting with
+// a usage error if the output format is unknown or it gets fewer than
+// minArgs arguments.
+func parseCtlFlags(fs *flag.FlagSet, o *ctlOptions, args []string, minArgs int) {
+	fs.Parse(args)
+	switch o.output {
+	case outputTable, outputJSON, outputQuiet:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", o.output)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	if fs.NArg() < minArgs {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// ctl command: manages daemons of a running server
+func ctlCommand(args []string) error {
+	commands := map[string]func([]string) error{
+		"list":    ctlList,
+		"status":  ctlStatus,
+		"start":   ctlAction("start"),
+		"stop":    ctlAction("stop"),
+		"restart": ctlAction("restart"),
+		"logs":    ctlLogs,
+		"add":     ctlAdd,
+		"rm":      ctlRemove,
+	}
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, ctlUsage)
+		os.Exit(exitUsage)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		if args[0] != "-h" && args[0] != "help" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		}
+		fmt.Fprint(os.Stderr, ctlUsage)
+		os.Exit(exitUsage)
+	}
+	return cmd(args[1:])
+}
+
+// ctlRequest sends a JSON API request to the control socket at path
+// (encoding in as the body unless nil) and decodes the response into out
+// (unless nil).
+func ctlRequest(path, method, target string, in, out interface{}) error {
+	resp, err := ctlDo(path, method, target, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ctlDo sends a JSON API request to the control socket at path, returning
+// an exitError if it failed.
+func ctlDo(path, method, target string, in interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		enc, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(enc)
+	}
+	req, err := http.NewRequest(method, "http://hades/api/v1"+target, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := controlClient(path).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to hades (is it running here?): %s", err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var msg struct {
+		Error string `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&msg)
+	if err != nil || msg.Error == "" {
+		msg.Error = resp.Status
+	}
+	code := exitFailure
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		code = exitNotFound
+	case http.StatusConflict:
+		code = exitConflict
+	}
+	return nil, &exitError{code: code, err: errors.New(msg.Error)}
+}
+
+// refError prefixes err with daemon ref (keeping its exit code).
+func refError(ref string, err error) error {
+	if e, ok := err.(*exitError); ok {
+		return &exitError{code: e.code, err: fmt.Errorf("%s: %s", ref, e.err)}
+	}
+	return fmt.Errorf("%s: %s", ref, err)
+}
+
+// daemonPath returns the API path of daemon ref (name or id).
+func daemonPath(ref string) string {
+	return "/daemons/" + url.PathEscape(ref)
+}
+
+// printJSON writes v as indented JSON to stdout.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// daemonRef returns how a daemon is shown (its name, else its id).
+func daemonRef(d *hades.Daemon) string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return strconv.FormatUint(d.ID, 10)
+}
+
+// isRunning returns true if status means the daemon is up (or waiting for
+// its next scheduled run).
+func isRunning(status string) bool {
+	switch status {
+	case "running", "healthy", "unhealthy", "degraded", "scheduled":
+		return true
+	}
+	return false
+}
+
+// ctl list: prints daemons
+func ctlList(args []string) error {
+	fs, o := ctlFlags("list")
+	selector := fs.String("selector", "", "only daemons with labels like app=web,env!=dev")
+	search := fs.String("q", "", "only daemons whose name, description, command, directory or labels contain this")
+	parseCtlFlags(fs, o, args, 0)
+	q := url.Values{}
+	if *selector != "" {
+		q.Set("selector", *selector)
+	}
+	if *search != "" {
+		q.Set("q", *search)
+	}
+	var daemons []*hades.Daemon
+	err := ctlRequest(o.control, "GET", "/daemons?"+q.Encode(), nil, &daemons)
+	if err != nil {
+		return err
+	}
+	switch o.output {
+	case outputJSON:
+		return printJSON(daemons)
+	case outputQuiet:
+		for _, d := range daemons {
+			fmt.Println(d.ID)
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSTATUS\tINSTANCES\tCMD")
+	for _, d := range daemons {
+		instances := 1
+		if len(d.Instances) > 0 {
+			instances = len(d.Instances)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\n", d.ID, d.Name, d.Status, instances, d.Cmd)
+	}
+	return tw.Flush()
+}
+
+// ctl status: prints daemons in detail
+func ctlStatus(args []string) error {
+	fs, o := ctlFlags("status")
+	parseCtlFlags(fs, o, args, 1)
+	daemons := make([]*hades.Daemon, 0, fs.NArg())
+	for _, ref := range fs.Args() {
+		d := &hades.Daemon{}
+		err := ctlRequest(o.control, "GET", daemonPath(ref), nil, d)
+		if err != nil {
+			return refError(ref, err)
+		}
+		daemons = append(daemons, d)
+	}
+	switch o.output {
+	case outputJSON:
+		if len(daemons) == 1 {
+			printJSON(daemons[0])
+		} else {
+			printJSON(daemons)
+		}
+	case outputTable:
+		for i, d := range daemons {
+			if i > 0 {
+				fmt.Println()
+			}
+			printStatus(d)
+		}
+	}
+	for _, d := range daemons {
+		if isRunning(d.Status) {
+			continue
+		}
+		e := &exitError{code: exitNotRunning}
+		if o.output != outputQuiet {
+			e.err = fmt.Errorf("%s is %s", daemonRef(d), d.Status)
+		}
+		return e
+	}
+	return nil
+}
+
+// printStatus writes the details of d.
+func printStatus(d *hades.Daemon) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	field := func(name string, value interface{}) {
+		fmt.Fprintf(tw, "%s:\t%v\n", name, value)
+	}
+	field("ID", d.ID)
+	if d.Name != "" {
+		field("Name", d.Name)
+	}
+	if d.Description != "" {
+		field("Description", d.Description)
+	}
+	field("Cmd", d.Cmd)
+	if d.Dir != "" {
+		field("Dir", d.Dir)
+	}
+	if len(d.Labels) > 0 {
+		labels := make([]string, 0, len(d.Labels))
+		for k, v := range d.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		field("Labels", strings.Join(labels, ","))
+	}
+	field("Status", d.Status)
+	printInstance(field, &d.Instance)
+	if len(d.Instances) > 1 {
+		for i := range d.Instances {
+			in := &d.Instances[i]
+			field(fmt.Sprintf("Instance %d", i), in.Status)
+		}
+	}
+	tw.Flush()
+}
+
+// printInstance writes the process details of in.
+func printInstance(field func(string, interface{}), in *hades.Instance) {
+	if !in.Started.IsZero() && isRunning(in.Status) {
+		field("Since", in.Started.Format("2006-01-02 15:04:05"))
+	}
+	if in.Restarts > 0 {
+		field("Restarts", in.Restarts)
+	}
+	if in.ExitReason != "" {
+		field("Last exit", fmt.Sprintf("%d (%s)", in.ExitCode, in.ExitReason))
+	}
+}
+
+// ctlAction returns a hades ctl command running action on daemons.
+func ctlAction(action string) func([]string) error {
+	return func(args []string) error {
+		fs, o := ctlFlags(action)
+		parseCtlFlags(fs, o, args, 1)
+		daemons := make([]*hades.Daemon, 0, fs.NArg())
+		for _, ref := range fs.Args() {
+			d := &hades.Daemon{}
+			err := ctlRequest(o.control, "POST", daemonPath(ref)+"/"+action, nil, d)
+			if err != nil {
+				return refError(ref, err)
+			}
+			if o.output == outputTable {
+				fmt.Printf("%s: %s\n", daemonRef(d), d.Status)
+			}
+			daemons = append(daemons, d)
+		}
+		if o.output == outputJSON {
+			return printJSON(daemons)
+		}
+		return nil
+	}
+}
+
+// ctl logs: prints (and follows) daemon output
+func ctlLogs(args []string) error {
+	fs, o := ctlFlags("logs")
+	n := fs.Int("n", 100, "number of lines")
+	follow := fs.Bool("f", false, "follow new output")
+	stream := fs.String("stream", "", "only stdout or stderr")
+	instance := fs.Int("instance", 0, "instance of the daemon")
+	timestamps := fs.Bool("t", false, "show timestamps")
+	parseCtlFlags(fs, o, args, 1)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	q := url.Values{}
+	q.Set("n", strconv.Itoa(*n))
+	q.Set("instance", strconv.Itoa(*instance))
+	if *stream != "" {
+		q.Set("stream", *stream)
+	}
+	printLine := func(line *hades.LogLine) {
+		switch o.output {
+		case outputJSON:
+			json.NewEncoder(os.Stdout).Encode(line)
+		case outputTable:
+			if *timestamps {
+				fmt.Printf("%s %s %s\n", line.Time.Format(time.RFC3339), line.Stream, line.Text)
+			} else {
+				fmt.Println(line.Text)
+			}
+		}
+	}
+	path := daemonPath(fs.Arg(0)) + "/logs?"
+	if !*follow {
+		var lines []*hades.LogLine
+		err := ctlRequest(o.control, "GET", path+q.Encode(), nil, &lines)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			printLine(line)
+		}
+		return nil
+	}
+	q.Set("follow", "1")
+	for {
+		resp, err := ctlDo(o.control, "GET", path+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(resp.Body)
+		for {
+			line := &hades.LogLine{}
+			err = dec.Decode(line)
+			if err != nil {
+				break
+			}
+			printLine(line)
+			q.Set("since", strconv.FormatUint(line.Seq, 10))
+		}
+		resp.Body.Close()
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// the server dropped the stream, resume where it ended
+		if q.Get("since") == "" {
+			q.Set("since", "0")
+		}
+		time.Sleep(followRetry)
+	}
+}
+
+// labelFlags collects repeated -label key=value flags.
+type labelFlags map[string]string
+
+func (l labelFlags) String() string {
+	return ""
+}
+
+func (l labelFlags) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected key=value")
+	}
+	l[kv[0]] = kv[1]
+	return nil
+}
+
+// ctl add: adds a daemon
+func ctlAdd(args []string) error {
+	fs, o := ctlFlags("add")
+	def := &hades.Daemon{Labels: labelFlags{}}
+	fs.StringVar(&def.Name, "name", "", "daemon name")
+	fs.StringVar(&def.Description, "description", "", "daemon description")
+	fs.StringVar(&def.Dir, "dir", "", "working directory")
+	fs.Var(labelFlags(def.Labels), "label", "label as key=value (repeatable)")
+	start := fs.Bool("start", false, "start it after adding")
+	parseCtlFlags(fs, o, args, 1)
+	def.Cmd = fs.Arg(0)
+	if fs.NArg() > 1 {
+		// keep arguments intact when hades splits the command
+		parts := make([]string, 0, fs.NArg())
+		for _, arg := range fs.Args() {
+			parts = append(parts, shellQuote(arg))
+		}
+		def.Cmd = strings.Join(parts, " ")
+	}
+	d := &hades.Daemon{}
+	err := ctlRequest(o.control, "POST", "/daemons", def, d)
+	if err != nil {
+		return err
+	}
+	if *start {
+		err = ctlRequest(o.control, "POST", daemonPath(strconv.FormatUint(d.ID, 10))+"/start", nil, d)
+		if err != nil {
+			return fmt.Errorf("added %d but not started: %s", d.ID, err)
+		}
+	}
+	switch o.output {
+	case outputJSON:
+		return printJSON(d)
+	case outputQuiet:
+		fmt.Println(d.ID)
+	default:
+		fmt.Printf("added %s (id %d): %s\n", daemonRef(d), d.ID, d.Status)
+	}
+	return nil
+}
+
+// shellQuote quotes s (if needed) so it's read as one argument.
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// ctl rm: removes daemons
+func ctlRemove(args []string) error {
+	fs, o := ctlFlags("rm")
+	parseCtlFlags(fs, o, args, 1)
+	for _, ref := range fs.Args() {
+		err := ctlRequest(o.control, "DELETE", daemonPath(ref), nil, nil)
+		if e, ok := err.(*exitError); ok && e.code == exitConflict {
+			e.err = fmt.Errorf("%s: still running, stop it first", ref)
+			return e
+		}
+		if err != nil {
+			return refError(ref, err)
+		}
+		if o.output == outputTable {
+			fmt.Printf("removed %s\n", ref)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package app
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+// ansiColors maps the standard and bright ANSI color codes to CSS colors.
+var ansiColors = [16]string{
+	"#1e1e1e", "#f92672", "#a6e22e", "#f4bf75",
+	"#66d9ef", "#ae81ff", "#a1efe4", "#c5c8c6",
+	"#676867", "#ff669d", "#beed5f", "#e6db74",
+	"#66d9ef", "#9e6ffe", "#a3babf", "#f8f8f2",
+}
+
+// ansiStyle is the current SGR state while rendering.
+type ansiStyle struct {
+	bold      bool
+	italic    bool
+	underline bool
+	fg        string
+	bg        string
+}
+
+// css returns the inline CSS for style (empty for the default style).
+func (s ansiStyle) css() string {
+	rules := make([]string, 0, 5)
+	if s.bold {
+		rules = append(rules, "font-weight:700")
+	}
+	if s.italic {
+		rules = append(rules, "font-style:italic")
+	}
+	if s.underline {
+		rules = append(rules, "text-decoration:underline")
+	}
+	if s.fg != "" {
+		rules = append(rules, "color:"+s.fg)
+	}
+	if s.bg != "" {
+		rules = append(rules, "background:"+s.bg)
+	}
+	return strings.Join(rules, ";")
+}
+
+// apply updates style from the parameters of an SGR sequence.
+func (s *ansiStyle) apply(params string) {
+	if params == "" {
+		params = "0"
+	}
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		n, err := strconv.Atoi(codes[i])
+		if err != nil {
+			continue
+		}
+		switch {
+		case n == 0:
+			*s = ansiStyle{}
+		case n == 1:
+			s.bold = true
+		case n == 3:
+			s.italic = true
+		case n == 4:
+			s.underline = true
+		case n == 22:
+			s.bold = false
+		case n == 23:
+			s.italic = false
+		case n == 24:
+			s.underline = false
+		case n >= 30 && n <= 37:
+			s.fg = ansiColors[n-30]
+		case n == 39:
+			s.fg = ""
+		case n >= 40 && n <= 47:
+			s.bg = ansiColors[n-40]
+		case n == 49:
+			s.bg = ""
+		case n >= 90 && n <= 97:
+			s.fg = ansiColors[n-90+8]
+		case n >= 100 && n <= 107:
+			s.bg = ansiColors[n-100+8]
+		case n == 38 || n == 48:
+			// extended colors: 5;n (256 color) or 2;r;g;b (truecolor)
+			color, skip := ansiExtendedColor(codes[i+1:])
+			if n == 38 {
+				s.fg = color
+			} else {
+				s.bg = color
+			}
+			i += skip
+		}
+	}
+}
+
+// ansiExtendedColor parses the arguments of an extended color code and
+// returns the CSS color and how many arguments were consumed.
+func ansiExtendedColor(args []string) (string, int) {
+	if len(args) == 0 {
+		return "", 0
+	}
+	atoi := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		if n < 0 || n > 255 {
+			return 0
+		}
+		return n
+	}
+	switch args[0] {
+	case "5":
+		if len(args) < 2 {
+			return "", len(args)
+		}
+		n := atoi(args[1])
+		if n < 16 {
+			return ansiColors[n], 2
+		}
+		if n >= 232 {
+			v := 8 + (n-232)*10
+			return rgb(v, v, v), 2
+		}
+		n -= 16
+		level := func(x int) int {
+			if x == 0 {
+				return 0
+			}
+			return 55 + x*40
+		}
+		return rgb(level(n/36), level(n/6%6), level(n%6)), 2
+	case "2":
+		if len(args) < 4 {
+			return "", len(args)
+		}
+		return rgb(atoi(args[1]), atoi(args[2]), atoi(args[3])), 4
+	}
+	return "", 1
+}
+
+// rgb returns a CSS rgb() color.
+func rgb(r, g, b int) string {
+	return "rgb(" + strconv.Itoa(r) + "," + strconv.Itoa(g) + "," + strconv.Itoa(b) + ")"
+}
+
+// ansiToHTML converts text containing ANSI escape sequences into escaped HTML
+// with colors rendered as styled spans. Non-color sequences are dropped.
+func ansiToHTML(text string) template.HTML {
+	var buf bytes.Buffer
+	style := ansiStyle{}
+	open := false
+	write := func(s string) {
+		if s == "" {
+			return
+		}
+		css := style.css()
+		if css != "" && !open {
+			buf.WriteString(`<span style="` + css + `">`)
+			open = true
+		}
+		buf.WriteString(html.EscapeString(s))
+	}
+	for {
+		i := strings.IndexByte(text, 0x1b)
+		if i < 0 {
+			write(text)
+			break
+		}
+		write(text[:i])
+		text = text[i+1:]
+		if !strings.HasPrefix(text, "[") {
+			// not a CSI sequence, drop the escape byte
+			continue
+		}
+		// CSI sequence ends with a byte in range 0x40-0x7e
+		end := strings.IndexFunc(text[1:], func(r rune) bool {
+			return r >= 0x40 && r <= 0x7e
+		})
+		if end < 0 {
+			break
+		}
+		params := text[1 : end+1]
+		final := text[end+1]
+		text = text[end+2:]
+		if final != 'm' {
+			continue
+		}
+		if open {
+			buf.WriteString("</span>")
+			open = false
+		}
+		style.apply(params)
+	}
+	if open {
+		buf.WriteString("</span>")
+	}
+	return template.HTML(buf.String())
+}
@@ -0,0 +1,450 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// largest request body accepted by the API.
+const maxAPIBody = 1024 * 1024
+
+// context key of the apiCaller making API requests.
+type apiCallerKey struct{}
+
+// apiCaller represents who makes an API request.
+type apiCaller struct {
+	// user is recorded in daemon events.
+	user string
+	role string
+}
+
+// apiRoutes adds the JSON API (authenticated with API tokens) to r.
+func (a *App) apiRoutes(r *mux.Router) {
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.Use(a.apiAuth)
+	a.apiHandlers(api)
+}
+
+// apiHandlers adds the JSON API handlers to api (which sets who is making
+// requests).
+func (a *App) apiHandlers(api *mux.Router) {
+	api.Handle("/daemons", a.apiRole(roleViewer, a.getAPIDaemonsHandler)).Methods("GET")
+	api.Handle("/daemons", a.apiRole(roleAdmin, a.postAPIDaemonsHandler)).Methods("POST")
+	api.Handle("/daemons/{id}", a.apiRole(roleViewer, a.getAPIDaemonHandler)).Methods("GET")
+	api.Handle("/daemons/{id}", a.apiRole(roleAdmin, a.putAPIDaemonHandler)).Methods("PUT")
+	api.Handle("/daemons/{id}", a.apiRole(roleAdmin, a.deleteAPIDaemonHandler)).Methods("DELETE")
+	api.Handle("/daemons/{id}/logs", a.apiRole(roleViewer, a.getAPILogsHandler)).Methods("GET")
+	api.Handle("/daemons/{id}/events", a.apiRole(roleViewer, a.getAPIDaemonEventsHandler)).Methods("GET")
+	api.Handle("/daemons/{id}/scale", a.apiRole(roleOperator, a.postAPIScaleHandler)).Methods("POST")
+	api.Handle("/daemons/{id}/{action}", a.apiRole(roleOperator, a.postAPIActionHandler)).Methods("POST")
+	api.Handle("/events", a.apiRole(roleViewer, a.getAPIEventsHandler)).Methods("GET")
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, "no such endpoint")
+	})
+}
+
+// apiAuth is middleware only allowing requests with a valid API token
+// ("Authorization: Bearer <token>").
+func (a *App) apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hades"`)
+			writeJSONError(w, http.StatusUnauthorized, "missing API token")
+			return
+		}
+		t, err := a.checkToken(strings.TrimSpace(auth[len("Bearer "):]))
+		if err == errInvalidToken {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hades", error="invalid_token"`)
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c := &apiCaller{user: "token:" + t.Name, role: t.role()}
+		ctx := context.WithValue(r.Context(), apiCallerKey{}, c)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// apiRole returns a handler only running h for callers with (at least)
+// role.
+func (a *App) apiRole(role string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiCan(r, role) {
+			writeJSONError(w, http.StatusForbidden, "permission denied (needs the "+role+" role)")
+			return
+		}
+		h(w, r)
+	})
+}
+
+// apiCan returns true if the caller of API request r has (at least) role.
+func apiCan(r *http.Request, role string) bool {
+	c, ok := r.Context().Value(apiCallerKey{}).(*apiCaller)
+	return ok && (&user{Role: c.role}).Can(role)
+}
+
+// apiUser returns who is recorded in daemon events for API request r.
+func apiUser(r *http.Request) string {
+	c, _ := r.Context().Value(apiCallerKey{}).(*apiCaller)
+	if c == nil {
+		return ""
+	}
+	return c.user
+}
+
+// redactEnv hides the values of environment variables set for d from
+// callers of API request r below operator (they can hold credentials).
+func redactEnv(r *http.Request, d *hades.Daemon) {
+	if apiCan(r, roleOperator) {
+		return
+	}
+	vars := make([]string, 0, len(d.Env.Vars))
+	for _, v := range d.Env.Vars {
+		name := strings.SplitN(v, "=", 2)[0]
+		vars = append(vars, name+"=<redacted>")
+	}
+	d.Env.Vars = vars
+}
+
+// writeJSON writes v as a JSON response with status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeJSONError writes a JSON error response with status.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// writeAPIError writes err with the status matching it (or fallback for
+// errors hades doesn't define).
+func writeAPIError(w http.ResponseWriter, err error, fallback int) {
+	status := fallback
+	switch err {
+	case hades.ErrNotFound:
+		status = http.StatusNotFound
+	case hades.ErrAlreadyStarted, hades.ErrNotStarted, hades.ErrRunning, hades.ErrStopping:
+		status = http.StatusConflict
+	case hades.ErrNotJob:
+		status = http.StatusBadRequest
+	}
+	writeJSONError(w, status, err.Error())
+}
+
+// decodeJSON reads the JSON request body into v (rejecting unknown fields).
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxAPIBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		return fmt.Errorf("invalid JSON body: %s", err)
+	}
+	return nil
+}
+
+// writeAPIDaemon writes the current state of daemon id.
+func (a *App) writeAPIDaemon(w http.ResponseWriter, status int, id uint64) {
+	d, err := a.Hades.Get(id)
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, d)
+}
+
+// API daemon list handler (filtered by q and selector like the index page)
+func (a *App) getAPIDaemonsHandler(w http.ResponseWriter, r *http.Request) {
+	sel, err := hades.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	daemons, err := a.Hades.Select(sel)
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	out := make([]*hades.Daemon, 0, len(daemons))
+	for _, d := range daemons {
+		if matchesSearch(d, search) {
+			redactEnv(r, d)
+			out = append(out, d)
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// API daemon add handler
+func (a *App) postAPIDaemonsHandler(w http.ResponseWriter, r *http.Request) {
+	def := &hades.Daemon{}
+	err := decodeJSON(r, def)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	d, err := a.Hades.Add(def, apiUser(r))
+	if err != nil {
+		writeAPIError(w, err, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/daemons/%d", d.ID))
+	writeJSON(w, http.StatusCreated, d)
+}
+
+// API daemon handler
+func (a *App) getAPIDaemonHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := a.Hades.Lookup(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	redactEnv(r, d)
+	writeJSON(w, http.StatusOK, d)
+}
+
+// API daemon update handler (restart=true restarts a running daemon to
+// apply the change)
+func (a *App) putAPIDaemonHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	restart := false
+	if v := r.URL.Query().Get("restart"); v != "" {
+		restart, err = strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid restart value")
+			return
+		}
+	}
+	def := &hades.Daemon{}
+	err = decodeJSON(r, def)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = a.Hades.Update(id, def, apiUser(r), restart)
+	if err != nil {
+		writeAPIError(w, err, http.StatusBadRequest)
+		return
+	}
+	a.writeAPIDaemon(w, http.StatusOK, id)
+}
+
+// API daemon remove handler
+func (a *App) deleteAPIDaemonHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	err = a.Hades.Remove(id, apiUser(r))
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// API action handler (start, stop, pause, resume, restart and run)
+func (a *App) postAPIActionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	user := apiUser(r)
+	switch mux.Vars(r)["action"] {
+	case "start":
+		err = a.Hades.Start(id, user)
+	case "stop":
+		err = a.Hades.Stop(id, user)
+	case "pause":
+		err = a.Hades.Pause(id, user)
+	case "resume":
+		err = a.Hades.Resume(id, user)
+	case "restart":
+		err = a.Hades.Restart(id, user)
+	case "run":
+		err = a.Hades.RunJob(id, user)
+	default:
+		writeJSONError(w, http.StatusNotFound, "no such endpoint")
+		return
+	}
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	a.writeAPIDaemon(w, http.StatusOK, id)
+}
+
+// API scale handler ({"replicas": n})
+func (a *App) postAPIScaleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	var body struct {
+		Replicas int `json:"replicas"`
+	}
+	err = decodeJSON(r, &body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = a.Hades.Scale(id, body.Replicas, apiUser(r))
+	if err != nil {
+		writeAPIError(w, err, http.StatusBadRequest)
+		return
+	}
+	a.writeAPIDaemon(w, http.StatusOK, id)
+}
+
+// API logs handler (n, stream and instance like the logs page, since
+// returns lines after a sequence number and follow streams new lines as
+// they're written, one JSON object per line)
+func (a *App) getAPILogsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	instance := parseInstance(r)
+	stream, n := parseLogQuery(r)
+	q := r.URL.Query()
+	var seq uint64
+	since := q.Get("since")
+	if since != "" {
+		seq, err = strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid since value")
+			return
+		}
+	}
+	follow := false
+	if v := q.Get("follow"); v != "" {
+		follow, err = strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid follow value")
+			return
+		}
+	}
+	var ch <-chan *hades.LogLine
+	if follow {
+		// subscribe before reading backlog so nothing is missed in between
+		var cancel func()
+		ch, cancel, err = a.Hades.SubscribeLogs(id, instance)
+		if err != nil {
+			writeAPIError(w, err, http.StatusInternalServerError)
+			return
+		}
+		defer cancel()
+	}
+	var lines []*hades.LogLine
+	if since != "" {
+		// all lines since seq, only filtered by stream
+		lines, err = a.Hades.LogsSince(id, instance, seq)
+		lines = filterLogLines(lines, stream, 0)
+	} else {
+		lines, err = a.Hades.Logs(id, instance, 0)
+		lines = filterLogLines(lines, stream, n)
+	}
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !follow {
+		writeJSON(w, http.StatusOK, lines)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	enc := json.NewEncoder(w)
+	last := seq
+	for _, line := range lines {
+		last = line.Seq
+		err = enc.Encode(line)
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line, ok := <-ch:
+			if !ok {
+				// subscription dropped, clients resume with since
+				return
+			}
+			if line.Seq <= last || (stream != "" && line.Stream != stream) {
+				continue
+			}
+			last = line.Seq
+			err = enc.Encode(line)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// API daemon events handler
+func (a *App) getAPIDaemonEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	q := parseEventQuery(r)
+	q.Daemon = id
+	a.writeAPIEvents(w, q)
+}
+
+// API events handler
+func (a *App) getAPIEventsHandler(w http.ResponseWriter, r *http.Request) {
+	q := parseEventQuery(r)
+	if !apiCan(r, roleAdmin) {
+		q.Exclude = loginEventTypes
+	}
+	a.writeAPIEvents(w, q)
+}
+
+// writeAPIEvents writes the events selected by q.
+func (a *App) writeAPIEvents(w http.ResponseWriter, q *hades.EventQuery) {
+	events, err := a.Hades.Events(q)
+	if err != nil {
+		writeAPIError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
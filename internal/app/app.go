@@ -3,19 +3,29 @@ package app
 
 import (
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"html/template"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/gobuffalo/packr"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"github.com/wybiral/hades/internal/importer"
 	"github.com/wybiral/hades/pkg/hades"
-	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// errInvalidReplicas returned when scaling to a non-numeric count.
+	errInvalidReplicas = errors.New("invalid number of instances")
 )
 
 // App represents main application.
@@ -28,13 +38,61 @@ type App struct {
 	Templates *template.Template
 	Listener  net.Listener
 	Router    *mux.Router
+	Metrics   *requestMetrics
+	// Logins holds password logins waiting for their second factor.
+	Logins *pendingLogins
+	// Limiter limits failed logins.
+	Limiter *loginLimiter
+	// TrustedProxies are reverse proxies whose X-Forwarded-For headers are
+	// used for client addresses.
+	TrustedProxies []*net.IPNet
+	// MetricsListener serves /metrics without authentication (nil if not
+	// configured).
+	MetricsListener net.Listener
+	// ControlListener is the unix socket used by the command line (nil if
+	// disabled).
+	ControlListener net.Listener
+	// TLSConfig is used to serve HTTPS (nil for plain HTTP).
+	TLSConfig *tls.Config
+	// RedirectListener serves redirects from HTTP to HTTPS (nil if not
+	// configured).
+	RedirectListener net.Listener
 }
 
-// NewApp returns a new instance of App.
-func NewApp(host string, port int) (*App, error) {
+// Config represents settings used to create an App.
+type Config struct {
+	Host  string
+	Port  int
+	Hades *hades.Options
+	// MetricsAddr is a separate address serving /metrics without
+	// authentication (empty for none).
+	MetricsAddr string
+	// ControlPath is the unix socket used by the command line (empty to
+	// disable it).
+	ControlPath string
+	// TLS serves HTTPS, with the certificate in CertFile and KeyFile (a
+	// generated self-signed one if empty).
+	TLS      bool
+	CertFile string
+	KeyFile  string
+	// RedirectAddr is an address redirecting HTTP to HTTPS (empty for
+	// none).
+	RedirectAddr string
+	// TrustedProxies are addresses and CIDR ranges of reverse proxies
+	// whose X-Forwarded-For headers are used for client addresses.
+	TrustedProxies []string
+}
+
+// NewApp returns a new instance of App from config.
+func NewApp(config *Config) (*App, error) {
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
 	a := &App{
-		Host: host,
-		Port: port,
+		Host:           config.Host,
+		Port:           config.Port,
+		TrustedProxies: proxies,
 	}
 	// setup DB
 	db, err := newDB("hades.db")
@@ -42,6 +100,14 @@ func NewApp(host string, port int) (*App, error) {
 		return nil, err
 	}
 	a.DB = db
+	// setup TLS
+	if config.TLS || config.CertFile != "" || config.KeyFile != "" {
+		tc, err := newTLSConfig(a, config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.TLSConfig = tc
+	}
 	// setup Sessions
 	s, err := newSessions(a)
 	if err != nil {
@@ -49,7 +115,7 @@ func NewApp(host string, port int) (*App, error) {
 	}
 	a.Sessions = s
 	// setup Hades
-	h, err := hades.NewHades(db)
+	h, err := hades.NewHades(db, config.Hades)
 	if err != nil {
 		return nil, err
 	}
@@ -60,30 +126,92 @@ func NewApp(host string, port int) (*App, error) {
 		return nil, err
 	}
 	a.Listener = ln
+	if a.TLSConfig != nil {
+		a.Listener = tls.NewListener(ln, a.TLSConfig)
+		if config.RedirectAddr != "" {
+			rln, err := net.Listen("tcp", config.RedirectAddr)
+			if err != nil {
+				return nil, err
+			}
+			a.RedirectListener = rln
+		}
+	}
+	if config.MetricsAddr != "" {
+		mln, err := net.Listen("tcp", config.MetricsAddr)
+		if err != nil {
+			return nil, err
+		}
+		a.MetricsListener = mln
+	}
+	if config.ControlPath != "" {
+		cln, err := newControlListener(config.ControlPath)
+		if err != nil {
+			return nil, err
+		}
+		a.ControlListener = cln
+	}
 	// setup Templates
 	t, err := newTemplates("../../templates")
 	a.Templates = t
 	// setup Router
 	r := mux.NewRouter().StrictSlash(true)
+	a.Metrics = newRequestMetrics()
+	a.Logins = newPendingLogins()
+	a.Limiter = newLoginLimiter()
+	r.Use(a.Metrics.middleware)
 	// static file handler
 	sbox := packr.NewBox("../../static")
 	fsHandler := http.StripPrefix("/static/", http.FileServer(sbox))
 	r.PathPrefix("/static/").Handler(fsHandler).Methods("GET")
+	// JSON API (before application routes so "/{id}/..." doesn't match)
+	a.apiRoutes(r)
 	// application routes
 	r.HandleFunc("/", a.getIndexHandler).Methods("GET")
 	r.HandleFunc("/error", a.getErrorHandler).Methods("GET")
 	r.HandleFunc("/login", a.getLoginHandler).Methods("GET")
 	r.HandleFunc("/login", a.postLoginHandler).Methods("POST")
+	r.HandleFunc("/login/2fa", a.getLoginCodeHandler).Methods("GET")
+	r.HandleFunc("/login/2fa", a.postLoginCodeHandler).Methods("POST")
 	r.HandleFunc("/logout", a.getLogoutHandler).Methods("POST")
 	r.HandleFunc("/add", a.getAddHandler).Methods("GET")
 	r.HandleFunc("/add", a.postAddHandler).Methods("POST")
+	r.HandleFunc("/import", a.postImportHandler).Methods("POST")
+	r.HandleFunc("/bulk", a.postBulkHandler).Methods("POST")
 	r.HandleFunc("/{id}/action", a.postActionHandler).Methods("POST")
+	r.HandleFunc("/{id}/edit", a.getEditHandler).Methods("GET")
+	r.HandleFunc("/{id}/edit", a.postEditHandler).Methods("POST")
+	r.HandleFunc("/{id}/rollback", a.postRollbackHandler).Methods("POST")
+	r.HandleFunc("/{id}/logs", a.getLogsHandler).Methods("GET")
+	r.HandleFunc("/{id}/logs/stream", a.getLogsStreamHandler).Methods("GET")
+	r.HandleFunc("/{id}/runs", a.getRunsHandler).Methods("GET")
+	r.HandleFunc("/{id}/events", a.getDaemonEventsHandler).Methods("GET")
+	r.HandleFunc("/events", a.getEventsHandler).Methods("GET")
+	r.HandleFunc("/tokens", a.getTokensHandler).Methods("GET")
+	r.HandleFunc("/tokens", a.postTokensHandler).Methods("POST")
+	r.HandleFunc("/tokens/{id}/revoke", a.postRevokeTokenHandler).Methods("POST")
+	r.HandleFunc("/users", a.getUsersHandler).Methods("GET")
+	r.HandleFunc("/users", a.postUsersHandler).Methods("POST")
+	r.HandleFunc("/users/{name}", a.postUserHandler).Methods("POST")
+	r.HandleFunc("/2fa", a.getTwoFactorHandler).Methods("GET")
+	r.HandleFunc("/2fa", a.postTwoFactorHandler).Methods("POST")
+	r.HandleFunc("/metrics", a.getMetricsHandler).Methods("GET")
 	a.Router = r
 	return a, nil
 }
 
 // Run imports the library and starts server.
 func (a *App) Run() error {
+	if a.MetricsListener != nil {
+		mr := mux.NewRouter()
+		mr.HandleFunc("/metrics", a.serveMetrics).Methods("GET")
+		go http.Serve(a.MetricsListener, mr)
+	}
+	if a.ControlListener != nil {
+		go http.Serve(a.ControlListener, a.controlRouter())
+	}
+	if a.RedirectListener != nil {
+		go http.Serve(a.RedirectListener, http.HandlerFunc(a.redirectHandler))
+	}
 	return http.Serve(a.Listener, a.Router)
 }
 
@@ -96,23 +224,158 @@ func (a *App) getIndexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	daemons, err := a.Hades.Daemons()
+	flashes := a.getFlashes(s)
+	s.Save(r, w)
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+	selector := strings.TrimSpace(r.URL.Query().Get("selector"))
+	sel, err := hades.ParseSelector(selector)
+	if err != nil {
+		flashes = append(flashes, err.Error())
+		sel = &hades.Selector{}
+	}
+	daemons, err := a.Hades.Select(sel)
 	if err != nil {
 		return
 	}
-	flashes := a.getFlashes(s)
-	s.Save(r, w)
+	total, err := a.Hades.Daemons()
+	if err != nil {
+		return
+	}
+	u, err := a.getSessionUser(s)
+	if err != nil {
+		return
+	}
+	views := make([]*daemonView, 0, len(daemons))
+	for _, d := range daemons {
+		if matchesSearch(d, search) {
+			views = append(views, a.newDaemonView(d))
+		}
+	}
 	a.Templates.ExecuteTemplate(w, "index.html", struct {
-		Token   string
-		Errors  []string
-		Daemons []*hades.Daemon
+		Token    string
+		User     *user
+		Errors   []string
+		Daemons  []*daemonView
+		Total    int
+		Search   string
+		Selector string
 	}{
-		Token:   token,
-		Errors:  flashes,
-		Daemons: daemons,
+		Token:    token,
+		User:     u,
+		Errors:   flashes,
+		Daemons:  views,
+		Total:    len(total),
+		Search:   search,
+		Selector: sel.String(),
 	})
 }
 
+// matchesSearch returns true if the name, description, command, directory
+// or a label of d contains search (ignoring case).
+func matchesSearch(d *hades.Daemon, search string) bool {
+	search = strings.ToLower(search)
+	fields := []string{d.Name, d.Description, d.Cmd, d.Dir}
+	for k, v := range d.Labels {
+		fields = append(fields, k+"="+v)
+	}
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), search) {
+			return true
+		}
+	}
+	return false
+}
+
+// daemonView is a daemon with display values for the index page.
+type daemonView struct {
+	*hades.Daemon
+	// Usage is nil if the daemon isn't running in a cgroup.
+	Usage *usageView
+	// NextRun is the next scheduled run of an enabled job.
+	NextRun string
+	// LastRun is the most recent run of a job (nil if none).
+	LastRun *runView
+	// Stats is nil if the daemon isn't running.
+	Stats *statsView
+}
+
+// statsView is process metrics formatted for display.
+type statsView struct {
+	CPU        string
+	RSS        string
+	Processes  int
+	Threads    int
+	FDs        int
+	ReadBytes  string
+	WriteBytes string
+}
+
+// usageView is cgroup resource usage formatted for display.
+type usageView struct {
+	Memory   string
+	CPU      string
+	Pids     uint64
+	OOMKills uint64
+}
+
+// newDaemonView returns the index page view of d.
+func (a *App) newDaemonView(d *hades.Daemon) *daemonView {
+	v := &daemonView{Daemon: d}
+	if d.Kind == hades.KindJob {
+		if !d.Disabled {
+			next, err := d.Schedule.Next(time.Now())
+			if err == nil {
+				v.NextRun = next.Format("2006-01-02 15:04:05 MST")
+			}
+		}
+		runs, err := a.Hades.Runs(d.ID, 1)
+		if err == nil && len(runs) > 0 {
+			v.LastRun = newRunView(runs[0])
+		}
+	}
+	st, err := a.Hades.Stats(d.ID)
+	if err == nil && st.Processes > 0 {
+		v.Stats = &statsView{
+			CPU:        fmt.Sprintf("%.1f%%", st.CPUPercent),
+			RSS:        formatBytes(st.RSS),
+			Processes:  st.Processes,
+			Threads:    st.Threads,
+			FDs:        st.FDs,
+			ReadBytes:  formatBytes(st.ReadBytes),
+			WriteBytes: formatBytes(st.WriteBytes),
+		}
+	}
+	u, err := a.Hades.CgroupUsage(d.ID)
+	if err != nil || u == nil {
+		return v
+	}
+	v.Usage = &usageView{
+		Memory:   formatBytes(u.MemoryCurrent),
+		CPU:      u.CPUUsage.Round(time.Millisecond).String(),
+		Pids:     u.PidsCurrent,
+		OOMKills: u.OOMKills,
+	}
+	if d.Cgroup.MemoryMax != "" {
+		v.Usage.Memory += " / " + d.Cgroup.MemoryMax
+	}
+	return v
+}
+
+// formatBytes formats n bytes using binary units.
+func formatBytes(n uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
+
 // error page handler
 func (a *App) getErrorHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -146,41 +409,58 @@ func (a *App) postLoginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/error", 302)
 		return
 	}
-	var hash []byte
-	err = a.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("settings"))
-		h := b.Get([]byte("password-hash"))
-		if h == nil {
-			return fmt.Errorf("missing password hash")
-		}
-		hash = make([]byte, len(h))
-		copy(hash, h)
-		return nil
-	})
+	err = a.loginBegin(r)
 	if err != nil {
-		http.Redirect(w, r, "/error", 302)
+		s.AddFlash(err.Error())
+		s.Save(r, w)
+		http.Redirect(w, r, "/login", 302)
 		return
 	}
+	defer a.loginEnd(r)
+	name := strings.TrimSpace(r.PostForm.Get("name"))
 	password := r.PostForm.Get("password")
-	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	u, err := a.checkLogin(name, password)
 	if err != nil {
+		a.loginFailed(r, name, "wrong password")
 		s.AddFlash("invalid login")
 		s.Save(r, w)
 		http.Redirect(w, r, "/login", 302)
 		return
 	}
-	tokenBytes := make([]byte, 32)
-	_, err = rand.Read(tokenBytes)
+	if u.TwoFactor() {
+		// the code is asked for on /login/2fa
+		id, err := a.Logins.add(u)
+		if err != nil {
+			http.Redirect(w, r, "/error", 302)
+			return
+		}
+		s.Values["pending"] = id
+		s.Save(r, w)
+		http.Redirect(w, r, "/login/2fa", 302)
+		return
+	}
+	err = a.logIn(s, u)
 	if err != nil {
 		http.Redirect(w, r, "/error", 302)
 		return
 	}
-	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
-	s.Values["user"] = token
 	s.Save(r, w)
 	http.Redirect(w, r, "/", 302)
 }
 
+// logIn logs user u in with session s.
+func (a *App) logIn(s *sessions.Session, u *user) error {
+	tokenBytes := make([]byte, 32)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return err
+	}
+	s.Values["user"] = base64.RawURLEncoding.EncodeToString(tokenBytes)
+	s.Values["name"] = u.Name
+	s.Values["stamp"] = u.Stamp
+	return nil
+}
+
 // logout post handler
 func (a *App) getLogoutHandler(w http.ResponseWriter, r *http.Request) {
 	s, _ := a.Sessions.Get(r, "session")
@@ -212,11 +492,23 @@ func (a *App) getAddHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/login", 302)
 		return
 	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	flashes := a.getFlashes(s)
+	s.Save(r, w)
 	a.Templates.ExecuteTemplate(w, "add.html", struct {
-		Token string
+		Token   string
+		Daemon  *hades.Daemon
+		Errors  []string
+		Formats []string
 	}{
-		Token: token,
+		Token:   token,
+		Daemon:  &hades.Daemon{},
+		Errors:  flashes,
+		Formats: importer.Formats,
 	})
 }
 
@@ -228,6 +520,10 @@ func (a *App) postAddHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/login", 302)
 		return
 	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
 	err = r.ParseForm()
 	if err != nil {
 		http.Redirect(w, r, "/error", 302)
@@ -238,11 +534,17 @@ func (a *App) postAddHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/error", 302)
 		return
 	}
-	cmd := r.PostForm.Get("cmd")
-	dir := r.PostForm.Get("dir")
-	_, err = a.Hades.Add(cmd, dir)
+	d := &hades.Daemon{
+		Name: strings.TrimSpace(r.PostForm.Get("name")),
+		Cmd:  r.PostForm.Get("cmd"),
+		Dir:  r.PostForm.Get("dir"),
+	}
+	err = parseSettings(r.PostForm, d)
+	if err == nil {
+		_, err = a.Hades.Add(d, a.actingUser(s, r))
+	}
 	if err != nil {
-		s.AddFlash("error adding daemon")
+		s.AddFlash("error adding daemon: " + err.Error())
 		s.Save(r, w)
 	}
 	http.Redirect(w, r, "/", 302)
@@ -256,6 +558,10 @@ func (a *App) postActionHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/login", 302)
 		return
 	}
+	if a.checkRole(s, roleOperator) != nil {
+		a.forbidden(w, roleOperator)
+		return
+	}
 	err = r.ParseForm()
 	if err != nil {
 		http.Redirect(w, r, "/error", 302)
@@ -267,24 +573,40 @@ func (a *App) postActionHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/error", 302)
 		return
 	}
-	vars := mux.Vars(r)
-	idStr := vars["id"]
-	id, err := strconv.ParseUint(idStr, 10, 64)
+	id, err := a.getDaemonID(r)
 	if err != nil {
 		http.Redirect(w, r, "/error", 302)
 		return
 	}
+	// removing changes the configuration
+	if action == "remove" && a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	user := a.actingUser(s, r)
 	switch action {
 	case "start":
-		err = a.Hades.Start(id)
+		err = a.Hades.Start(id, user)
 	case "resume":
-		err = a.Hades.Resume(id)
+		err = a.Hades.Resume(id, user)
 	case "pause":
-		err = a.Hades.Pause(id)
+		err = a.Hades.Pause(id, user)
 	case "stop":
-		err = a.Hades.Stop(id)
+		err = a.Hades.Stop(id, user)
 	case "remove":
-		err = a.Hades.Remove(id)
+		err = a.Hades.Remove(id, user)
+	case "run":
+		err = a.Hades.RunJob(id, user)
+	case "restart":
+		err = a.Hades.Restart(id, user)
+	case "scale":
+		var n int
+		n, err = strconv.Atoi(strings.TrimSpace(r.PostForm.Get("replicas")))
+		if err != nil {
+			err = errInvalidReplicas
+		} else {
+			err = a.Hades.Scale(id, n, user)
+		}
 	}
 	if err == hades.ErrAlreadyStarted {
 		s.AddFlash("daemon already running")
@@ -292,6 +614,9 @@ func (a *App) postActionHandler(w http.ResponseWriter, r *http.Request) {
 	} else if err == hades.ErrNotStarted {
 		s.AddFlash("daemon not running")
 		s.Save(r, w)
+	} else if err != nil && action == "scale" {
+		s.AddFlash("error scaling daemon: " + err.Error())
+		s.Save(r, w)
 	} else if err != nil {
 		s.AddFlash("action failed")
 		s.Save(r, w)
@@ -299,6 +624,48 @@ func (a *App) postActionHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", 302)
 }
 
+// bulk action post handler
+func (a *App) postBulkHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleOperator) != nil {
+		a.forbidden(w, roleOperator)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	formtoken := r.PostForm.Get("token")
+	if formtoken != token {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	selector := r.PostForm.Get("selector")
+	back := "/?selector=" + url.QueryEscape(selector)
+	sel, err := hades.ParseSelector(selector)
+	if err != nil || sel.Empty() {
+		s.AddFlash("bulk actions need a label selector")
+		s.Save(r, w)
+		http.Redirect(w, r, back, 302)
+		return
+	}
+	action := r.PostForm.Get("action")
+	ids, err := a.Hades.BulkAction(sel, action, a.actingUser(s, r))
+	if err != nil {
+		s.AddFlash(fmt.Sprintf("%s failed: %s", action, err))
+	} else {
+		s.AddFlash(fmt.Sprintf("%s: %d daemons", action, len(ids)))
+	}
+	s.Save(r, w)
+	http.Redirect(w, r, back, 302)
+}
+
 // getFlashes returns all flash messages attached to session
 // (does not clear them)
 func (a *App) getFlashes(s *sessions.Session) []string {
@@ -319,5 +686,26 @@ func (a *App) getUserToken(s *sessions.Session) (string, error) {
 	if !ok {
 		return "", fmt.Errorf("invalid token")
 	}
+	// removed users are logged out
+	_, err := a.getSessionUser(s)
+	if err != nil {
+		return "", err
+	}
 	return token, nil
 }
+
+// actingUser returns who is recorded in daemon events for request r (made
+// by the user logged in with session s).
+func (a *App) actingUser(s *sessions.Session, r *http.Request) string {
+	name, _ := s.Values["name"].(string)
+	return name + "@" + a.clientIP(r)
+}
+
+// getDaemonID returns the id of the daemon named or numbered in the route.
+func (a *App) getDaemonID(r *http.Request) (uint64, error) {
+	d, err := a.Hades.Lookup(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, err
+	}
+	return d.ID, nil
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/wybiral/hades/internal/config"
+)
+
+// largest config file accepted by the control socket.
+const maxConfigSize = 4 * 1024 * 1024
+
+// user recorded for changes made through the control socket.
+const controlUser = "local"
+
+// controlListener only accepts connections from root and the user running
+// hades (see checkPeer).
+type controlListener struct {
+	net.Listener
+}
+
+// Accept waits for the next allowed connection.
+func (l *controlListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		err = checkPeer(c)
+		if err == nil {
+			return c, nil
+		}
+		log.Printf("control socket: rejected connection: %s", err)
+		c.Close()
+	}
+}
+
+// newControlListener listens on the unix socket at path (replacing a stale
+// socket), only accessible by the user running hades.
+func newControlListener(path string) (net.Listener, error) {
+	err := checkPeerSupport()
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// before accepting anything (checkPeer still rejects connections made
+	// before this)
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &controlListener{ln}, nil
+}
+
+// controlRouter returns the router for the control socket (used by the
+// hades command line).
+func (a *App) controlRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/apply", a.postControlApplyHandler).Methods("POST")
+	r.HandleFunc("/export", a.getControlExportHandler).Methods("GET")
+	r.HandleFunc("/import", a.postControlImportHandler).Methods("POST")
+	r.HandleFunc("/users", a.getControlUsersHandler).Methods("GET")
+	r.HandleFunc("/users", a.postControlUsersHandler).Methods("POST")
+	r.HandleFunc("/users/{name}", a.putControlUserHandler).Methods("PUT")
+	r.HandleFunc("/users/{name}", a.deleteControlUserHandler).Methods("DELETE")
+	r.HandleFunc("/users/{name}/2fa", a.deleteControlTwoFactorHandler).Methods("DELETE")
+	// JSON API for hades ctl (no token needed, see controlListener)
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.Use(controlAuth)
+	a.apiHandlers(api)
+	return r
+}
+
+// controlAuth is middleware recording control socket API requests as made
+// by controlUser (an admin).
+func controlAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := &apiCaller{user: controlUser, role: roleAdmin}
+		ctx := context.WithValue(r.Context(), apiCallerKey{}, c)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// config apply handler (writes the plan, applying it unless dry_run is set)
+func (a *App) postControlApplyHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxConfigSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	specs, err := config.Parse(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plan, err := a.Hades.Plan(specs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out := plan.String()
+	if r.URL.Query().Get("dry_run") == "" && len(plan.Steps) > 0 {
+		err = a.Hades.ApplyPlan(plan, controlUser)
+		if err != nil {
+			http.Error(w, out+"error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		out += "Applied.\n"
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, out)
+}
+
+// config export handler
+func (a *App) getControlExportHandler(w http.ResponseWriter, r *http.Request) {
+	specs, err := a.Hades.Export()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := config.Format(specs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// number of events shown when not asked for.
+const defaultEventCount = 200
+
+// eventView represents a daemon event prepared for display.
+type eventView struct {
+	Time   string
+	Daemon uint64
+	Type   string
+	Detail string
+	User   string
+}
+
+// newEventView converts a hades.Event for display.
+func newEventView(e *hades.Event) *eventView {
+	detail := e.Cause
+	if e.Type == hades.EventStatus {
+		detail = e.Status
+		if e.Cause != "" {
+			detail += ": " + e.Cause
+		}
+	}
+	if e.Instance != nil {
+		prefix := "instance " + strconv.Itoa(*e.Instance)
+		if detail != "" {
+			prefix += ": "
+		}
+		detail = prefix + detail
+	}
+	user := e.User
+	if user == "" {
+		user = "hades"
+	}
+	return &eventView{
+		Time:   e.Time.Format("2006-01-02 15:04:05"),
+		Daemon: e.Daemon,
+		Type:   e.Type,
+		Detail: detail,
+		User:   user,
+	}
+}
+
+// parseEventQuery reads the event type and count from the URL query.
+func parseEventQuery(r *http.Request) *hades.EventQuery {
+	q := &hades.EventQuery{Limit: defaultEventCount}
+	if t := r.URL.Query().Get("type"); t != "" {
+		q.Types = []string{t}
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err == nil && n >= 0 {
+		q.Limit = n
+	}
+	return q
+}
+
+// all events page handler
+func (a *App) getEventsHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	q := parseEventQuery(r)
+	if a.checkRole(s, roleAdmin) != nil {
+		q.Exclude = loginEventTypes
+	}
+	a.renderEvents(w, r, token, nil, q)
+}
+
+// daemon events page handler
+func (a *App) getDaemonEventsHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	d, err := a.Hades.Get(id)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	q := parseEventQuery(r)
+	q.Daemon = id
+	a.renderEvents(w, r, token, d, q)
+}
+
+// renderEvents renders the events selected by q (for daemon d, nil for all).
+func (a *App) renderEvents(w http.ResponseWriter, r *http.Request, token string, d *hades.Daemon, q *hades.EventQuery) {
+	events, err := a.Hades.Events(q)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	views := make([]*eventView, 0, len(events))
+	for _, e := range events {
+		views = append(views, newEventView(e))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	a.Templates.ExecuteTemplate(w, "events.html", struct {
+		Token  string
+		Daemon *hades.Daemon
+		Events []*eventView
+	}{
+		Token:  token,
+		Daemon: d,
+		Events: views,
+	})
+}
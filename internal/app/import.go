@@ -0,0 +1,164 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/wybiral/hades/internal/importer"
+)
+
+// importOutcome represents what happened to an imported daemon.
+type importOutcome struct {
+	Name  string
+	Cmd   string
+	Start bool
+	// ID is the added daemon (0 if not added)
+	ID    uint64
+	Error string
+}
+
+// importDaemons adds the daemons in res (starting the ones started
+// automatically by their source) and returns what happened to each. With
+// preview set nothing is added.
+func (a *App) importDaemons(res *importer.Result, user string, preview bool) []*importOutcome {
+	outcomes := make([]*importOutcome, 0, len(res.Daemons))
+	for _, imp := range res.Daemons {
+		o := &importOutcome{Name: imp.Daemon.Name, Cmd: imp.Daemon.Cmd, Start: imp.Start}
+		outcomes = append(outcomes, o)
+		if preview {
+			continue
+		}
+		d, err := a.Hades.Add(imp.Daemon, user)
+		if err != nil {
+			o.Error = err.Error()
+			continue
+		}
+		o.ID = d.ID
+		if imp.Start {
+			err = a.Hades.Start(d.ID, user)
+			if err != nil {
+				o.Error = "added but not started: " + err.Error()
+			}
+		}
+	}
+	return outcomes
+}
+
+// formatImport writes a text report of an import.
+func formatImport(res *importer.Result, outcomes []*importOutcome, preview bool) string {
+	var b strings.Builder
+	for _, o := range outcomes {
+		fmt.Fprintf(&b, "+ %s: %s", o.Name, o.Cmd)
+		if o.Start {
+			b.WriteString(" (start)")
+		}
+		if o.Error != "" {
+			fmt.Fprintf(&b, "\n  error: %s", o.Error)
+		}
+		b.WriteString("\n")
+	}
+	for _, w := range res.Warnings {
+		fmt.Fprintf(&b, "! %s\n", w)
+	}
+	if preview {
+		fmt.Fprintf(&b, "Preview: %d to add from %s file.\n", len(outcomes), res.Format)
+	}
+	return b.String()
+}
+
+// import post handler (multipart file upload or previewed data)
+func (a *App) postImportHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	err = r.ParseMultipartForm(maxConfigSize)
+	if err != nil && err != http.ErrNotMultipart {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	formtoken := r.PostForm.Get("token")
+	if formtoken != token {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	filename := r.PostForm.Get("filename")
+	data := []byte(r.PostForm.Get("data"))
+	f, header, err := r.FormFile("file")
+	if err == nil {
+		defer f.Close()
+		filename = header.Filename
+		data, err = ioutil.ReadAll(io.LimitReader(f, maxConfigSize))
+	} else if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		err = nil
+	}
+	if err == nil && len(data) == 0 {
+		err = fmt.Errorf("no file to import")
+	}
+	format := r.PostForm.Get("format")
+	var res *importer.Result
+	if err == nil {
+		res, err = importer.Parse(format, filename, data)
+	}
+	if err != nil {
+		s.AddFlash("error importing: " + err.Error())
+		s.Save(r, w)
+		http.Redirect(w, r, "/add", 302)
+		return
+	}
+	preview := r.PostForm.Get("preview") != ""
+	outcomes := a.importDaemons(res, a.actingUser(s, r), preview)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	a.Templates.ExecuteTemplate(w, "import.html", struct {
+		Token    string
+		Preview  bool
+		Format   string
+		Filename string
+		Data     string
+		Outcomes []*importOutcome
+		Warnings []string
+	}{
+		Token:    token,
+		Preview:  preview,
+		Format:   res.Format,
+		Filename: filename,
+		Data:     string(data),
+		Outcomes: outcomes,
+		Warnings: res.Warnings,
+	})
+}
+
+// import handler for the control socket (writes a text report)
+func (a *App) postControlImportHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxConfigSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	res, err := importer.Parse(q.Get("format"), q.Get("filename"), data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	preview := q.Get("dry_run") != ""
+	outcomes := a.importDaemons(res, controlUser, preview)
+	out := formatImport(res, outcomes, preview)
+	for _, o := range outcomes {
+		if o.Error != "" {
+			http.Error(w, out, http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, out)
+}
@@ -0,0 +1,318 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// Failed login limits.
+const (
+	// failed logins from an address before its attempts are delayed.
+	loginFreeFailures = 3
+	// longest delay between attempts from an address (doubling from a
+	// second).
+	loginMaxDelay = 30 * time.Second
+	// failed logins from an address that lock it out.
+	loginLockoutFailures = 10
+	// how long addresses are locked out (and failed logins remembered).
+	loginLockout = 15 * time.Minute
+	// failed logins from all addresses within a minute that lock out all
+	// logins.
+	globalLockoutFailures = 100
+	// how long all logins are locked out.
+	globalLockout = 5 * time.Minute
+	// most addresses failed logins are remembered for (the oldest are
+	// forgotten first).
+	maxLoginAddrs = 10000
+)
+
+// event types only shown to admins
+var loginEventTypes = []string{hades.EventLoginFailed, hades.EventLockout}
+
+// errLoginBusy returned when a login from the same address is still being
+// checked.
+var errLoginBusy = errors.New("another login from this address is in progress, try again")
+
+// loginFailures counts recent failed logins from an address.
+type loginFailures struct {
+	count  int
+	last   time.Time
+	locked time.Time
+	// busy is set while a login from the address is checked (so parallel
+	// attempts can't all get in before the first failure is counted).
+	busy bool
+}
+
+// loginLimiter limits failed logins (passwords and two-factor codes) per
+// client address and from all addresses together.
+type loginLimiter struct {
+	mu    sync.Mutex
+	addrs map[string]*loginFailures
+	// failed logins from all addresses since window started.
+	window   time.Time
+	failures int
+	locked   time.Time
+}
+
+// newLoginLimiter returns a loginLimiter without failed logins.
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{addrs: make(map[string]*loginFailures)}
+}
+
+// begin starts a login attempt from addr, returning how long it has to wait
+// first instead (0 if it started). Only one attempt per address is checked
+// at a time (errLoginBusy for others), end has to be called once it's done.
+func (l *loginLimiter) begin(addr string, now time.Time) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	wait := l.wait(addr, now)
+	if wait > 0 {
+		return wait, nil
+	}
+	f, ok := l.addrs[addr]
+	if !ok {
+		if len(l.addrs) >= maxLoginAddrs {
+			l.forgetOldest()
+		}
+		f = &loginFailures{last: now}
+		l.addrs[addr] = f
+	}
+	if f.busy {
+		return 0, errLoginBusy
+	}
+	f.busy = true
+	return 0, nil
+}
+
+// end ends the login attempt from addr started by begin (after counting it
+// with fail if it failed).
+func (l *loginLimiter) end(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.addrs[addr]
+	if !ok {
+		return
+	}
+	f.busy = false
+	if f.count == 0 {
+		// only remembered for the attempt
+		delete(l.addrs, addr)
+	}
+}
+
+// wait returns how long addr has to wait before trying to log in again (0
+// if it can now). l.mu has to be held.
+func (l *loginLimiter) wait(addr string, now time.Time) time.Duration {
+	if now.Before(l.locked) {
+		return l.locked.Sub(now)
+	}
+	f, ok := l.addrs[addr]
+	if !ok {
+		return 0
+	}
+	if now.Before(f.locked) {
+		return f.locked.Sub(now)
+	}
+	if f.count < loginFreeFailures {
+		return 0
+	}
+	delay := time.Second
+	for i := loginFreeFailures; i < f.count && delay < loginMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+	next := f.last.Add(delay)
+	if now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// fail counts a failed login from addr, returning whether addr and all
+// logins got locked out by it.
+func (l *loginLimiter) fail(addr string, now time.Time) (bool, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, f := range l.addrs {
+		if !f.busy && now.Sub(f.last) > loginLockout && now.After(f.locked) {
+			delete(l.addrs, k)
+		}
+	}
+	f, ok := l.addrs[addr]
+	if !ok {
+		if len(l.addrs) >= maxLoginAddrs {
+			l.forgetOldest()
+		}
+		f = &loginFailures{}
+		l.addrs[addr] = f
+	}
+	f.count++
+	f.last = now
+	addrLocked := false
+	// every failure past the limit locks the address out again
+	if f.count >= loginLockoutFailures {
+		f.locked = now.Add(loginLockout)
+		addrLocked = true
+	}
+	if now.Sub(l.window) > time.Minute {
+		l.window = now
+		l.failures = 0
+	}
+	l.failures++
+	allLocked := false
+	if l.failures >= globalLockoutFailures {
+		l.locked = now.Add(globalLockout)
+		l.failures = 0
+		allLocked = true
+	}
+	return addrLocked, allLocked
+}
+
+// forgetOldest forgets the address with the oldest failed login (except
+// addresses with logins being checked).
+func (l *loginLimiter) forgetOldest() {
+	oldest := ""
+	var last time.Time
+	for k, f := range l.addrs {
+		if f.busy {
+			continue
+		}
+		if oldest == "" || f.last.Before(last) {
+			oldest = k
+			last = f.last
+		}
+	}
+	if oldest != "" {
+		delete(l.addrs, oldest)
+	}
+}
+
+// loginBegin starts a login attempt by the client of r, returning an error
+// telling it how long to wait if it has to first. loginEnd has to be called
+// once an attempt that started is done.
+func (a *App) loginBegin(r *http.Request) error {
+	wait, err := a.Limiter.begin(a.clientIP(r), time.Now())
+	if err != nil || wait <= 0 {
+		return err
+	}
+	wait = time.Duration(math.Ceil(wait.Seconds())) * time.Second
+	return fmt.Errorf("too many failed logins, try again in %s", wait)
+}
+
+// loginEnd ends the login attempt by the client of r started by loginBegin.
+func (a *App) loginEnd(r *http.Request) {
+	a.Limiter.end(a.clientIP(r))
+}
+
+// loginFailed counts a failed login as name by the client of r and records
+// it (and any lockout) in the events.
+func (a *App) loginFailed(r *http.Request, name, cause string) {
+	addr := a.clientIP(r)
+	addrLocked, allLocked := a.Limiter.fail(addr, time.Now())
+	if !userName.MatchString(name) {
+		name = "?"
+	}
+	a.Hades.RecordEvent(&hades.Event{
+		Type:  hades.EventLoginFailed,
+		User:  name + "@" + addr,
+		Cause: cause,
+	})
+	if addrLocked {
+		log.Printf("login: locked out %s for %s after too many failed logins", addr, loginLockout)
+		a.Hades.RecordEvent(&hades.Event{
+			Type:  hades.EventLockout,
+			Cause: fmt.Sprintf("%s locked out for %s after %d failed logins", addr, loginLockout, loginLockoutFailures),
+		})
+	}
+	if allLocked {
+		log.Printf("login: locked out all logins for %s after too many failed logins", globalLockout)
+		a.Hades.RecordEvent(&hades.Event{
+			Type:  hades.EventLockout,
+			Cause: fmt.Sprintf("all logins locked out for %s after %d failed logins within a minute", globalLockout, globalLockoutFailures),
+		})
+	}
+}
+
+// parseTrustedProxies parses addresses and CIDR ranges of trusted proxies.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trustedProxy returns true if addr is a trusted proxy.
+func (a *App) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client making request r (taken from
+// X-Forwarded-For when r comes through trusted proxies).
+func (a *App) clientIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !a.trustedProxy(addr) {
+		return addr
+	}
+	hops := make([]string, 0)
+	for _, h := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	// the last address not added by a trusted proxy is the client (the ones
+	// before it could be made up)
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		addr = ip.String()
+		if !a.trustedProxy(addr) {
+			break
+		}
+	}
+	return addr
+}
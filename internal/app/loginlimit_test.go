@@ -0,0 +1,178 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failLogin makes a failed login attempt from addr at now, which has to be
+// allowed.
+func failLogin(t *testing.T, l *loginLimiter, addr string, now time.Time) (bool, bool) {
+	t.Helper()
+	wait, err := l.begin(addr, now)
+	if err != nil || wait != 0 {
+		t.Fatalf("attempt from %s at %s: wait %s, %v", addr, now, wait, err)
+	}
+	defer l.end(addr)
+	return l.fail(addr, now)
+}
+
+func TestLoginDelay(t *testing.T) {
+	l := newLoginLimiter()
+	now := time.Unix(1700000000, 0)
+	// delay after each failure, the last ones lock the address out
+	for i, want := range []time.Duration{
+		0, 0, 1 * time.Second, 2 * time.Second, 4 * time.Second,
+		8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second,
+		loginLockout, loginLockout,
+	} {
+		addrLocked, _ := failLogin(t, l, "192.0.2.1", now)
+		if addrLocked != (i+1 >= loginLockoutFailures) {
+			t.Errorf("failure %d: locked out = %t", i+1, addrLocked)
+		}
+		wait, err := l.begin("192.0.2.1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != want {
+			t.Errorf("after %d failures: wait %s, expected %s", i+1, wait, want)
+		}
+		if wait == 0 {
+			l.end("192.0.2.1")
+		}
+		// the wait goes down with time
+		if want > 0 {
+			half, _ := l.begin("192.0.2.1", now.Add(want/2))
+			if half != want-want/2 {
+				t.Errorf("after %d failures: wait %s half way, expected %s", i+1, half, want-want/2)
+			}
+		}
+		now = now.Add(want)
+	}
+	// other addresses aren't affected
+	wait, err := l.begin("192.0.2.2", now)
+	if wait != 0 || err != nil {
+		t.Errorf("other address: wait %s, %v", wait, err)
+	}
+}
+
+func TestLoginForgetsFailures(t *testing.T) {
+	l := newLoginLimiter()
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < loginFreeFailures; i++ {
+		failLogin(t, l, "192.0.2.1", now)
+	}
+	// forgotten once another failure cleans up after the lockout period
+	later := now.Add(loginLockout + time.Second)
+	failLogin(t, l, "192.0.2.2", later)
+	if _, ok := l.addrs["192.0.2.1"]; ok {
+		t.Error("failures weren't forgotten")
+	}
+	// successful attempts aren't remembered
+	l.begin("192.0.2.3", later)
+	l.end("192.0.2.3")
+	if _, ok := l.addrs["192.0.2.3"]; ok {
+		t.Error("attempt without failures remembered")
+	}
+}
+
+func TestGlobalLockout(t *testing.T) {
+	l := newLoginLimiter()
+	now := time.Unix(1700000000, 0)
+	// failures spread over more than a minute don't count together
+	for i := 0; i < globalLockoutFailures-1; i++ {
+		failLogin(t, l, fmt.Sprintf("10.0.%d.%d", i/256, i%256), now)
+	}
+	now = now.Add(time.Minute + time.Second)
+	for i := 0; i < globalLockoutFailures-1; i++ {
+		_, allLocked := failLogin(t, l, fmt.Sprintf("10.1.%d.%d", i/256, i%256), now)
+		if allLocked {
+			t.Fatalf("all logins locked out after %d failures", i+1)
+		}
+	}
+	_, allLocked := failLogin(t, l, "10.2.0.0", now)
+	if !allLocked {
+		t.Fatal("all logins weren't locked out")
+	}
+	wait, err := l.begin("192.0.2.1", now)
+	if wait != globalLockout || err != nil {
+		t.Errorf("new address: wait %s, %v, expected %s", wait, err, globalLockout)
+	}
+	wait, err = l.begin("192.0.2.1", now.Add(globalLockout))
+	if wait != 0 || err != nil {
+		t.Errorf("after the lockout: wait %s, %v", wait, err)
+	}
+}
+
+func TestLoginConcurrentAttempts(t *testing.T) {
+	l := newLoginLimiter()
+	now := time.Unix(1700000000, 0)
+	const n = 50
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	started, busy := 0, 0
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			wait, err := l.begin("192.0.2.1", now)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == errLoginBusy:
+				busy++
+			case err == nil && wait == 0:
+				started++
+			default:
+				t.Errorf("unexpected wait %s, %v", wait, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if started != 1 || busy != n-1 {
+		t.Fatalf("%d attempts started and %d busy, expected 1 and %d", started, busy, n-1)
+	}
+	// other addresses can still try
+	wait, err := l.begin("192.0.2.2", now)
+	if wait != 0 || err != nil {
+		t.Errorf("other address: wait %s, %v", wait, err)
+	}
+	l.end("192.0.2.2")
+	// once the attempt failed the next one is delayed like any other
+	for i := 0; i < loginFreeFailures; i++ {
+		l.fail("192.0.2.1", now)
+		l.end("192.0.2.1")
+		wait, err = l.begin("192.0.2.1", now)
+		if i < loginFreeFailures-1 && (wait != 0 || err != nil) {
+			t.Fatalf("after %d failures: wait %s, %v", i+1, wait, err)
+		}
+	}
+	if wait != time.Second || err != nil {
+		t.Errorf("after %d failures: wait %s, %v, expected 1s", loginFreeFailures, wait, err)
+	}
+}
+
+func TestLoginAddrLimit(t *testing.T) {
+	l := newLoginLimiter()
+	now := time.Unix(1700000000, 0)
+	// an address with a login in progress isn't forgotten
+	l.begin("192.0.2.1", now)
+	for i := 0; i < maxLoginAddrs+10; i++ {
+		at := now.Add(time.Duration(i) * time.Millisecond)
+		l.fail(fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff), at)
+	}
+	if len(l.addrs) != maxLoginAddrs {
+		t.Errorf("%d addresses remembered, expected %d", len(l.addrs), maxLoginAddrs)
+	}
+	if _, ok := l.addrs["192.0.2.1"]; !ok {
+		t.Error("address with a login in progress forgotten")
+	}
+	if _, ok := l.addrs["10.0.0.0"]; ok {
+		t.Error("oldest address remembered")
+	}
+	if _, ok := l.addrs[fmt.Sprintf("10.0.%d.%d", (maxLoginAddrs+9)>>8, (maxLoginAddrs+9)&0xff)]; !ok {
+		t.Error("newest address forgotten")
+	}
+}
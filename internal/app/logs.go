@@ -0,0 +1,251 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// default number of lines shown on the logs page.
+const defaultLogLines = 100
+
+// time between keep-alive comments on idle log streams.
+const logStreamPing = 30 * time.Second
+
+// logEpoch identifies this hades process in log stream event ids (sequence
+// numbers start over when hades restarts).
+var logEpoch = strconv.FormatInt(time.Now().UnixNano(), 10)
+
+// logEventID returns the log stream event id of sequence number seq.
+func logEventID(seq uint64) string {
+	return logEpoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// parseLogEventID returns the sequence number of log stream event id (false
+// if it's invalid or from another hades process).
+func parseLogEventID(id string) (uint64, bool) {
+	epoch, seq := "", id
+	if i := strings.LastIndex(id, "-"); i >= 0 {
+		epoch, seq = id[:i], id[i+1:]
+	}
+	if epoch != logEpoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
+
+// logLine represents a log line prepared for display.
+type logLine struct {
+	Seq    uint64        `json:"seq"`
+	Time   string        `json:"time"`
+	Stream string        `json:"stream"`
+	HTML   template.HTML `json:"html"`
+}
+
+// newLogLine converts a hades.LogLine for display.
+func newLogLine(line *hades.LogLine) *logLine {
+	return &logLine{
+		Seq:    line.Seq,
+		Time:   line.Time.Format("2006-01-02 15:04:05"),
+		Stream: line.Stream,
+		HTML:   ansiToHTML(line.Text),
+	}
+}
+
+// filterLogLines returns the last n lines matching stream ("" for all).
+func filterLogLines(lines []*hades.LogLine, stream string, n int) []*hades.LogLine {
+	out := make([]*hades.LogLine, 0, len(lines))
+	for _, line := range lines {
+		if stream == "" || line.Stream == stream {
+			out = append(out, line)
+		}
+	}
+	if n > 0 && len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// parseLogQuery returns the stream filter and line count from query.
+func parseLogQuery(r *http.Request) (string, int) {
+	q := r.URL.Query()
+	stream := q.Get("stream")
+	if stream != "stdout" && stream != "stderr" {
+		stream = ""
+	}
+	n, err := strconv.Atoi(q.Get("n"))
+	if err != nil || n <= 0 {
+		n = defaultLogLines
+	}
+	return stream, n
+}
+
+// parseInstance returns the daemon instance number from query (0 if not
+// set).
+func parseInstance(r *http.Request) int {
+	i, err := strconv.Atoi(r.URL.Query().Get("instance"))
+	if err != nil || i < 0 {
+		return 0
+	}
+	return i
+}
+
+// logs page handler
+func (a *App) getLogsHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	d, err := a.Hades.Get(id)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	instance := parseInstance(r)
+	all, err := a.Hades.Logs(id, instance, 0)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	stream, n := parseLogQuery(r)
+	lines := make([]*logLine, 0, n)
+	for _, line := range filterLogLines(all, stream, n) {
+		lines = append(lines, newLogLine(line))
+	}
+	var last uint64
+	if len(all) > 0 {
+		last = all[len(all)-1].Seq
+	}
+	// where the stream starts
+	after := logEventID(last)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	a.Templates.ExecuteTemplate(w, "logs.html", struct {
+		Token    string
+		Daemon   *hades.Daemon
+		Instance int
+		Stream   string
+		N        int
+		Lines    []*logLine
+		After    string
+	}{
+		Token:    token,
+		Daemon:   d,
+		Instance: instance,
+		Stream:   stream,
+		N:        n,
+		Lines:    lines,
+		After:    after,
+	})
+}
+
+// logs event stream handler (Server-Sent Events)
+func (a *App) getLogsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	_, err := a.getUserToken(s)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// subscribe before reading backlog so nothing is missed in between
+	instance := parseInstance(r)
+	ch, cancel, err := a.Hades.SubscribeLogs(id, instance)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer cancel()
+	stream, n := parseLogQuery(r)
+	// resume from Last-Event-ID (set by reconnecting clients) or "after"
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("after")
+	}
+	var backlog []*hades.LogLine
+	var last uint64
+	if resume != "" {
+		seq, ok := parseLogEventID(resume)
+		if ok {
+			last = seq
+			backlog, err = a.Hades.LogsSince(id, instance, last)
+		} else {
+			// hades restarted since (sequence numbers started over)
+			backlog, err = a.Hades.Logs(id, instance, 0)
+		}
+	} else {
+		backlog, err = a.Hades.Logs(id, instance, 0)
+		backlog = filterLogLines(backlog, stream, n)
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	send := func(line *hades.LogLine) error {
+		last = line.Seq
+		if stream != "" && line.Stream != stream {
+			return nil
+		}
+		data, err := json.Marshal(newLogLine(line))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", logEventID(line.Seq), data)
+		return err
+	}
+	for _, line := range backlog {
+		err = send(line)
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	ping := time.NewTicker(logStreamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case line, ok := <-ch:
+			if !ok {
+				// subscription dropped, client will reconnect and resume
+				return
+			}
+			if line.Seq <= last {
+				continue
+			}
+			err = send(line)
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
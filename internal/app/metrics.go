@@ -0,0 +1,363 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// request duration histogram buckets (seconds).
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestKey identifies a request counter.
+type requestKey struct {
+	method string
+	route  string
+	code   int
+}
+
+// histogram counts observations into cumulative buckets.
+type histogram struct {
+	// counts[i] counts observations <= durationBuckets[i]
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// observe adds value v to the histogram.
+func (h *histogram) observe(v float64) {
+	for i, b := range durationBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// requestMetrics counts requests served by the app and their durations.
+type requestMetrics struct {
+	mutex     sync.Mutex
+	counts    map[requestKey]uint64
+	durations map[string]*histogram
+}
+
+// newRequestMetrics returns empty request metrics.
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		counts:    make(map[requestKey]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// statusWriter records the status code written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader records the status code.
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush passes flushes through (needed for log streams).
+func (w *statusWriter) Flush() {
+	f, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		f.Flush()
+	}
+}
+
+// middleware records the count and duration of requests to each route.
+func (m *requestMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			tmpl, err := cr.GetPathTemplate()
+			if err == nil {
+				route = tmpl
+			}
+		}
+		m.observe(r.Method, route, sw.code, time.Since(start))
+	})
+}
+
+// observe records a single request.
+func (m *requestMetrics) observe(method, route string, code int, d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counts[requestKey{method, route, code}]++
+	h, ok := m.durations[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[route] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// write writes the request metrics in Prometheus text format.
+func (m *requestMetrics) write(w *metricsWriter) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	keys := make([]requestKey, 0, len(m.counts))
+	for k := range m.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	w.header("hades_http_requests_total", "counter", "HTTP requests served by hades.")
+	for _, k := range keys {
+		w.sample("hades_http_requests_total", float64(m.counts[k]),
+			"method", k.method, "route", k.route, "code", strconv.Itoa(k.code))
+	}
+	routes := make([]string, 0, len(m.durations))
+	for route := range m.durations {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	name := "hades_http_request_duration_seconds"
+	w.header(name, "histogram", "HTTP request latencies.")
+	for _, route := range routes {
+		h := m.durations[route]
+		for i, b := range durationBuckets {
+			le := strconv.FormatFloat(b, 'g', -1, 64)
+			w.sample(name+"_bucket", float64(h.counts[i]), "route", route, "le", le)
+		}
+		w.sample(name+"_bucket", float64(h.count), "route", route, "le", "+Inf")
+		w.sample(name+"_sum", h.sum, "route", route)
+		w.sample(name+"_count", float64(h.count), "route", route)
+	}
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+// header writes the HELP and TYPE lines of a metric.
+func (w *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a single sample with label name and value pairs.
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&w.buf, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.buf.WriteByte('\n')
+}
+
+// escapeLabel escapes a label value.
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return strings.Replace(v, `"`, `\"`, -1)
+}
+
+// daemonUp returns true if status means the daemon has a live process.
+func daemonUp(status string) bool {
+	switch status {
+	case "running", "healthy", "unhealthy", "paused", "degraded":
+		return true
+	}
+	return false
+}
+
+// boolValue returns 1 for true and 0 for false.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeMetrics writes all hades metrics to out.
+func (a *App) writeMetrics(out io.Writer) error {
+	daemons, err := a.Hades.Daemons()
+	if err != nil {
+		return err
+	}
+	w := &metricsWriter{}
+	now := time.Now()
+	ids := make([]string, len(daemons))
+	for i, d := range daemons {
+		ids[i] = strconv.FormatUint(d.ID, 10)
+	}
+	// no command label, it's served without login on -metrics and command
+	// lines can hold credentials
+	w.header("hades_daemon_info", "gauge", "Daemon name, kind and status.")
+	for i, d := range daemons {
+		kind := d.Kind
+		if kind == "" {
+			kind = hades.KindDaemon
+		}
+		w.sample("hades_daemon_info", 1, "id", ids[i], "name", d.Name, "kind", kind, "status", d.Status)
+	}
+	w.header("hades_daemon_up", "gauge", "Whether the daemon process is running.")
+	for i, d := range daemons {
+		w.sample("hades_daemon_up", boolValue(daemonUp(d.Status)), "id", ids[i])
+	}
+	w.header("hades_daemon_enabled", "gauge", "Whether the daemon is started (including waiting or restarting).")
+	for i, d := range daemons {
+		w.sample("hades_daemon_enabled", boolValue(!d.Disabled), "id", ids[i])
+	}
+	w.header("hades_daemon_restarts", "gauge", "Restarts since the daemon was last started.")
+	for i, d := range daemons {
+		w.sample("hades_daemon_restarts", float64(d.Restarts), "id", ids[i])
+	}
+	w.header("hades_daemon_replicas", "gauge", "Number of instances the daemon runs.")
+	for i, d := range daemons {
+		replicas := d.Replicas
+		if replicas < 1 {
+			replicas = 1
+		}
+		w.sample("hades_daemon_replicas", float64(replicas), "id", ids[i])
+	}
+	w.header("hades_instance_up", "gauge", "Whether the process of a daemon instance is running.")
+	for i, d := range daemons {
+		for n, in := range d.Instances {
+			w.sample("hades_instance_up", boolValue(daemonUp(in.Status)), "id", ids[i], "instance", strconv.Itoa(n))
+		}
+	}
+	w.header("hades_instance_restarts", "gauge", "Restarts of a daemon instance since it was last started.")
+	for i, d := range daemons {
+		for n, in := range d.Instances {
+			w.sample("hades_instance_restarts", float64(in.Restarts), "id", ids[i], "instance", strconv.Itoa(n))
+		}
+	}
+	w.header("hades_daemon_last_exit_code", "gauge", "Exit code of the last process exit (-1 for signals).")
+	for i, d := range daemons {
+		w.sample("hades_daemon_last_exit_code", float64(d.ExitCode), "id", ids[i])
+	}
+	w.header("hades_daemon_uptime_seconds", "gauge", "Time since the current process started.")
+	for i, d := range daemons {
+		if daemonUp(d.Status) && !d.Started.IsZero() {
+			w.sample("hades_daemon_uptime_seconds", now.Sub(d.Started).Seconds(), "id", ids[i])
+		}
+	}
+	stats := make(map[int]*hades.Stats)
+	for i, d := range daemons {
+		st, err := a.Hades.Stats(d.ID)
+		if err == nil {
+			stats[i] = st
+		}
+	}
+	// process totals reset when processes restart so they're gauges
+	gauges := []struct {
+		name  string
+		help  string
+		value func(st *hades.Stats) float64
+	}{
+		{"hades_daemon_cpu_seconds", "CPU time used by current daemon processes.",
+			func(st *hades.Stats) float64 { return st.CPUTime.Seconds() }},
+		{"hades_daemon_cpu_percent", "CPU usage over the last sample interval.",
+			func(st *hades.Stats) float64 { return st.CPUPercent }},
+		{"hades_daemon_memory_rss_bytes", "Resident memory of daemon processes.",
+			func(st *hades.Stats) float64 { return float64(st.RSS) }},
+		{"hades_daemon_processes", "Number of daemon processes.",
+			func(st *hades.Stats) float64 { return float64(st.Processes) }},
+		{"hades_daemon_threads", "Number of daemon threads.",
+			func(st *hades.Stats) float64 { return float64(st.Threads) }},
+		{"hades_daemon_open_fds", "Open file descriptors of daemon processes.",
+			func(st *hades.Stats) float64 { return float64(st.FDs) }},
+		{"hades_daemon_read_bytes", "Bytes read from storage by current daemon processes.",
+			func(st *hades.Stats) float64 { return float64(st.ReadBytes) }},
+		{"hades_daemon_write_bytes", "Bytes written to storage by current daemon processes.",
+			func(st *hades.Stats) float64 { return float64(st.WriteBytes) }},
+	}
+	for _, g := range gauges {
+		w.header(g.name, "gauge", g.help)
+		for i := range daemons {
+			st, ok := stats[i]
+			if ok {
+				w.sample(g.name, g.value(st), "id", ids[i])
+			}
+		}
+	}
+	w.header("hades_daemon_cgroup_memory_bytes", "gauge", "Memory usage of the daemon cgroup.")
+	for i, d := range daemons {
+		u, err := a.Hades.CgroupUsage(d.ID)
+		if err == nil && u != nil {
+			w.sample("hades_daemon_cgroup_memory_bytes", float64(u.MemoryCurrent), "id", ids[i])
+		}
+	}
+	a.Metrics.write(w)
+	_, err = w.buf.WriteTo(out)
+	return err
+}
+
+// serveMetrics writes the metrics response.
+func (a *App) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := a.writeMetrics(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// metrics handler (logged in session or basic auth with a user account
+// without two-factor authentication)
+func (a *App) getMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	_, err := a.getUserToken(s)
+	if err != nil {
+		name, password, ok := r.BasicAuth()
+		if !ok {
+			err = errUserNotFound
+		} else {
+			err = a.loginBegin(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+			var u *user
+			u, err = a.checkLogin(name, password)
+			if err != nil {
+				a.loginFailed(r, name, "wrong password (metrics)")
+			}
+			a.loginEnd(r)
+			if err == nil && u.TwoFactor() {
+				// a password alone isn't enough for two-factor accounts
+				err = errInvalidCode
+			}
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="hades"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	a.serveMetrics(w, r)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package app
+
+import (
+	"errors"
+	"net"
+)
+
+// errNoPeerCred returned where the peer of control socket connections can't
+// be checked.
+var errNoPeerCred = errors.New("the control socket needs peer credentials (only available on linux), disable it with -control \"\"")
+
+// checkPeerSupport returns errNoPeerCred, the control socket isn't started
+// without a way to check its peers.
+func checkPeerSupport() error {
+	return errNoPeerCred
+}
+
+// checkPeer rejects every connection (see checkPeerSupport).
+func checkPeer(c net.Conn) error {
+	return errNoPeerCred
+}
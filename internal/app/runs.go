@@ -0,0 +1,67 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// runView represents a job run prepared for display.
+type runView struct {
+	Scheduled  string
+	Start      string
+	Duration   string
+	ExitCode   int
+	ExitReason string
+}
+
+// newRunView converts a hades.JobRun for display.
+func newRunView(r *hades.JobRun) *runView {
+	return &runView{
+		Scheduled:  r.Scheduled.Format("2006-01-02 15:04:05 MST"),
+		Start:      r.Start.Format("2006-01-02 15:04:05"),
+		Duration:   time.Duration(r.Duration).Round(time.Millisecond).String(),
+		ExitCode:   r.ExitCode,
+		ExitReason: r.ExitReason,
+	}
+}
+
+// job runs page handler
+func (a *App) getRunsHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	d, err := a.Hades.Get(id)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	runs, err := a.Hades.Runs(id, 0)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	views := make([]*runView, 0, len(runs))
+	for _, run := range runs {
+		views = append(views, newRunView(run))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	a.Templates.ExecuteTemplate(w, "runs.html", struct {
+		Token  string
+		Daemon *hades.Daemon
+		Runs   []*runView
+	}{
+		Token:  token,
+		Daemon: d,
+		Runs:   views,
+	})
+}
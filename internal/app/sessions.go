@@ -18,6 +18,8 @@ func newSessions(a *App) (sessions.Store, error) {
 	}
 	s := sessions.NewCookieStore(hashKey, blockKey)
 	s.Options.HttpOnly = true
+	// only send cookies over HTTPS when it's used
+	s.Options.Secure = a.TLSConfig != nil
 	return s, nil
 }
 
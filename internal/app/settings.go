@@ -0,0 +1,421 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// parseRestartPolicy reads restart policy fields from a submitted form.
+func parseRestartPolicy(form url.Values) (hades.RestartPolicy, error) {
+	p := hades.RestartPolicy{
+		Policy: form.Get("restart"),
+	}
+	var err error
+	if v := form.Get("max_restarts"); v != "" {
+		p.MaxRestarts, err = strconv.Atoi(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid max restarts")
+		}
+	}
+	durations := []struct {
+		field string
+		name  string
+		value *hades.Duration
+	}{
+		{"restart_window", "restart window", &p.Window},
+		{"backoff_min", "backoff min", &p.BackoffMin},
+		{"backoff_max", "backoff max", &p.BackoffMax},
+	}
+	for _, x := range durations {
+		v := form.Get(x.field)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid %s", x.name)
+		}
+		*x.value = hades.Duration(d)
+	}
+	return p, nil
+}
+
+// parseStopPolicy reads stop signal and timeout fields from a submitted form.
+func parseStopPolicy(form url.Values) (string, hades.Duration, error) {
+	signal := form.Get("stop_signal")
+	v := form.Get("stop_timeout")
+	if v == "" {
+		return signal, 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return signal, 0, fmt.Errorf("invalid stop timeout")
+	}
+	return signal, hades.Duration(d), nil
+}
+
+// parseHealthCheck reads health check fields from a submitted form.
+func parseHealthCheck(form url.Values) (hades.HealthCheck, error) {
+	hc := hades.HealthCheck{
+		Type:    form.Get("health_type"),
+		Target:  strings.TrimSpace(form.Get("health_target")),
+		Restart: form.Get("health_restart") != "",
+	}
+	var err error
+	if v := form.Get("health_status"); v != "" {
+		hc.Status, err = strconv.Atoi(v)
+		if err != nil {
+			return hc, fmt.Errorf("invalid health check status")
+		}
+	}
+	if v := form.Get("health_threshold"); v != "" {
+		hc.Threshold, err = strconv.Atoi(v)
+		if err != nil {
+			return hc, fmt.Errorf("invalid health check threshold")
+		}
+	}
+	durations := []struct {
+		field string
+		name  string
+		value *hades.Duration
+	}{
+		{"health_interval", "health check interval", &hc.Interval},
+		{"health_timeout", "health check timeout", &hc.Timeout},
+	}
+	for _, x := range durations {
+		v := form.Get(x.field)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return hc, fmt.Errorf("invalid %s", x.name)
+		}
+		*x.value = hades.Duration(d)
+	}
+	return hc, nil
+}
+
+// parseEnvironment reads environment fields from a submitted form.
+func parseEnvironment(form url.Values) hades.Environment {
+	env := hades.Environment{
+		Mode:  form.Get("env_mode"),
+		Allow: parseList(form.Get("env_allow")),
+		File:  strings.TrimSpace(form.Get("env_file")),
+	}
+	for _, line := range strings.Split(form.Get("env_vars"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		env.Vars = append(env.Vars, line)
+	}
+	return env
+}
+
+// parseLimits reads resource limit fields from a submitted form.
+func parseLimits(form url.Values) (hades.Limits, error) {
+	l := hades.Limits{
+		NoFile:       strings.TrimSpace(form.Get("limit_nofile")),
+		Core:         strings.TrimSpace(form.Get("limit_core")),
+		AddressSpace: strings.TrimSpace(form.Get("limit_as")),
+		NProc:        strings.TrimSpace(form.Get("limit_nproc")),
+		IOPriority:   strings.TrimSpace(form.Get("ioprio")),
+		CPUAffinity:  strings.TrimSpace(form.Get("cpu_affinity")),
+	}
+	var err error
+	if v := form.Get("nice"); v != "" {
+		l.Nice, err = strconv.Atoi(v)
+		if err != nil {
+			return l, fmt.Errorf("invalid nice")
+		}
+	}
+	if v := form.Get("oom_score_adj"); v != "" {
+		l.OOMScoreAdj, err = strconv.Atoi(v)
+		if err != nil {
+			return l, fmt.Errorf("invalid oom score adjustment")
+		}
+	}
+	return l, nil
+}
+
+// parseSettings reads all daemon settings fields from a submitted form into d.
+func parseSettings(form url.Values, d *hades.Daemon) error {
+	var err error
+	d.Description = strings.TrimSpace(form.Get("description"))
+	d.Labels, err = parseLabels(form.Get("labels"))
+	if err != nil {
+		return err
+	}
+	d.Restart, err = parseRestartPolicy(form)
+	if err != nil {
+		return err
+	}
+	d.StopSignal, d.StopTimeout, err = parseStopPolicy(form)
+	if err != nil {
+		return err
+	}
+	d.Health, err = parseHealthCheck(form)
+	if err != nil {
+		return err
+	}
+	d.Limits, err = parseLimits(form)
+	if err != nil {
+		return err
+	}
+	d.Requires, err = parseIDs(form.Get("requires"))
+	if err != nil {
+		return err
+	}
+	d.After, err = parseIDs(form.Get("after"))
+	if err != nil {
+		return err
+	}
+	d.Replicas, d.Port, err = parseReplicas(form)
+	if err != nil {
+		return err
+	}
+	d.OnDependencyDown = form.Get("on_dependency_down")
+	d.Kind = form.Get("kind")
+	d.Schedule = hades.Schedule{
+		Cron:     strings.TrimSpace(form.Get("cron")),
+		Timezone: strings.TrimSpace(form.Get("timezone")),
+		Overlap:  form.Get("overlap"),
+		CatchUp:  form.Get("catch_up") != "",
+	}
+	d.Cgroup = hades.CgroupLimits{
+		MemoryMax: strings.TrimSpace(form.Get("memory_max")),
+		CPUMax:    strings.TrimSpace(form.Get("cpu_max")),
+		PidsMax:   strings.TrimSpace(form.Get("pids_max")),
+	}
+	d.Env = parseEnvironment(form)
+	d.User = strings.TrimSpace(form.Get("user"))
+	d.Group = strings.TrimSpace(form.Get("group"))
+	d.Groups = parseList(form.Get("groups"))
+	return nil
+}
+
+// parseReplicas reads the instance count and first port from a submitted
+// form (0 if not set).
+func parseReplicas(form url.Values) (int, int, error) {
+	replicas, port := 0, 0
+	var err error
+	if v := strings.TrimSpace(form.Get("replicas")); v != "" {
+		replicas, err = strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid number of instances")
+		}
+	}
+	if v := strings.TrimSpace(form.Get("port")); v != "" {
+		port, err = strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid port")
+		}
+	}
+	return replicas, port, nil
+}
+
+// parseIDs reads a comma or space separated list of daemon ids.
+func parseIDs(v string) ([]uint64, error) {
+	ids := make([]uint64, 0)
+	for _, x := range parseList(v) {
+		id, err := strconv.ParseUint(x, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid daemon id %q", x)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseLabels reads "key=value" labels separated by lines or commas.
+func parseLabels(v string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, x := range parseList(v) {
+		kv := strings.SplitN(x, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid label %q (expected key=value)", x)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
+
+// parseList splits a comma or space separated form value.
+func parseList(v string) []string {
+	return strings.Fields(strings.Replace(v, ",", " ", -1))
+}
+
+// revisionView represents a daemon revision prepared for display.
+type revisionView struct {
+	Seq     uint64
+	Time    string
+	User    string
+	Cause   string
+	Changes string
+	Cmd     string
+}
+
+// newRevisionView converts a hades.Revision for display.
+func newRevisionView(rev *hades.Revision) *revisionView {
+	return &revisionView{
+		Seq:     rev.Seq,
+		Time:    rev.Time.Format("2006-01-02 15:04:05"),
+		User:    rev.User,
+		Cause:   rev.Cause,
+		Changes: strings.Join(rev.Changes, ", "),
+		Cmd:     rev.Daemon.Cmd,
+	}
+}
+
+// edit page handler
+func (a *App) getEditHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	d, err := a.Hades.Get(id)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	revs, err := a.Hades.Revisions(id)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	views := make([]*revisionView, 0, len(revs))
+	for _, rev := range revs {
+		views = append(views, newRevisionView(rev))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	flashes := a.getFlashes(s)
+	s.Save(r, w)
+	a.Templates.ExecuteTemplate(w, "edit.html", struct {
+		Token     string
+		Errors    []string
+		Daemon    *hades.Daemon
+		Revisions []*revisionView
+	}{
+		Token:     token,
+		Errors:    flashes,
+		Daemon:    d,
+		Revisions: views,
+	})
+}
+
+// edit post handler
+func (a *App) postEditHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	formtoken := r.PostForm.Get("token")
+	if formtoken != token {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	idStr := mux.Vars(r)["id"]
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	d := &hades.Daemon{
+		Name: strings.TrimSpace(r.PostForm.Get("name")),
+		Cmd:  r.PostForm.Get("cmd"),
+		Dir:  r.PostForm.Get("dir"),
+	}
+	restart := r.PostForm.Get("apply") == "restart"
+	err = parseSettings(r.PostForm, d)
+	if err == nil {
+		err = a.Hades.Update(id, d, a.actingUser(s, r), restart)
+	}
+	if err == hades.ErrRunning {
+		s.AddFlash("daemon is running, use apply and restart")
+	} else if err != nil {
+		s.AddFlash(err.Error())
+	}
+	if err != nil {
+		s.Save(r, w)
+		http.Redirect(w, r, "/"+idStr+"/edit", 302)
+		return
+	}
+	http.Redirect(w, r, "/", 302)
+}
+
+// rollback post handler
+func (a *App) postRollbackHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	formtoken := r.PostForm.Get("token")
+	if formtoken != token {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	idStr := mux.Vars(r)["id"]
+	id, err := a.getDaemonID(r)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	seq, err := strconv.ParseUint(r.PostForm.Get("revision"), 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	restart := r.PostForm.Get("apply") == "restart"
+	err = a.Hades.Rollback(id, seq, a.actingUser(s, r), restart)
+	if err == hades.ErrRunning {
+		s.AddFlash("daemon is running, use rollback and restart")
+	} else if err != nil {
+		s.AddFlash("rollback failed: " + err.Error())
+	}
+	s.Save(r, w)
+	http.Redirect(w, r, "/"+idStr+"/edit", 302)
+}
@@ -0,0 +1,255 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// settings keys of the generated self-signed certificate (PEM encoded).
+var (
+	selfSignedCertKey = []byte("tls-cert")
+	selfSignedKeyKey  = []byte("tls-key")
+)
+
+const (
+	// how long generated self-signed certificates are valid.
+	selfSignedValidity = 365 * 24 * time.Hour
+	// how long before expiring self-signed certificates are replaced.
+	selfSignedRenewal = 30 * 24 * time.Hour
+	// how often certificates are checked for changes.
+	certCheckInterval = 10 * time.Second
+)
+
+// certReloader serves a certificate, loading it again when it's stale.
+type certReloader struct {
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	checked time.Time
+	// load returns the current certificate.
+	load func() (*tls.Certificate, error)
+	// stale returns true if cert needs to be loaded again.
+	stale func(cert *tls.Certificate) bool
+}
+
+// getCertificate returns the certificate for TLS handshakes (keeping the
+// old one if loading a new one fails).
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+	if r.stale(r.cert) {
+		cert, err := r.load()
+		if err != nil {
+			log.Printf("tls: keeping current certificate: %s", err)
+		} else {
+			r.cert = cert
+		}
+	}
+	return r.cert, nil
+}
+
+// newTLSConfig returns the TLS config of a, serving the certificate in
+// certFile and keyFile (reloaded when they change) or a self-signed one
+// stored in the database if both are empty.
+func newTLSConfig(a *App, certFile, keyFile string) (*tls.Config, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("tls: both a certificate and a key file are needed")
+	}
+	r := &certReloader{checked: time.Now()}
+	if certFile != "" {
+		var loaded time.Time
+		r.load = func() (*tls.Certificate, error) {
+			mod := modTime(certFile, keyFile)
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			loaded = mod
+			return &cert, nil
+		}
+		r.stale = func(*tls.Certificate) bool {
+			return modTime(certFile, keyFile).After(loaded)
+		}
+	} else {
+		r.load = func() (*tls.Certificate, error) {
+			return selfSignedCert(a.DB, a.Host)
+		}
+		r.stale = func(cert *tls.Certificate) bool {
+			return time.Until(cert.Leaf.NotAfter) < selfSignedRenewal
+		}
+	}
+	cert, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.cert = cert
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+	}, nil
+}
+
+// modTime returns when the last of files was modified.
+func modTime(files ...string) time.Time {
+	var latest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// selfSignedCert returns the self-signed certificate stored in db,
+// generating a new one if there's none, it's about to expire or it isn't
+// valid for host.
+func selfSignedCert(db *bolt.DB, host string) (*tls.Certificate, error) {
+	var certPEM, keyPEM []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("settings"))
+		if b == nil {
+			return nil
+		}
+		certPEM = append(certPEM, b.Get(selfSignedCertKey)...)
+		keyPEM = append(keyPEM, b.Get(selfSignedKeyKey)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(certPEM) > 0 {
+		cert, err := parseKeyPair(certPEM, keyPEM)
+		// certificates generated as CAs are replaced
+		if err == nil && !cert.Leaf.IsCA && time.Until(cert.Leaf.NotAfter) > selfSignedRenewal && coversHost(cert.Leaf, host) {
+			return cert, nil
+		}
+	}
+	certPEM, keyPEM, err = generateSelfSigned(host)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("settings"))
+		if err != nil {
+			return err
+		}
+		err = b.Put(selfSignedCertKey, certPEM)
+		if err != nil {
+			return err
+		}
+		return b.Put(selfSignedKeyKey, keyPEM)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("tls: generated self-signed certificate for %s", host)
+	return parseKeyPair(certPEM, keyPEM)
+}
+
+// parseKeyPair parses a PEM encoded certificate and key.
+func parseKeyPair(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// coversHost returns true if cert is valid for the host hades listens on
+// (any host for wildcard addresses).
+func coversHost(cert *x509.Certificate, host string) bool {
+	ip := net.ParseIP(host)
+	if host == "" || (ip != nil && ip.IsUnspecified()) {
+		return true
+	}
+	return cert.VerifyHostname(host) == nil
+}
+
+// generateSelfSigned returns a new self-signed certificate and key (PEM
+// encoded) for host, localhost and the machine's hostname.
+func generateSelfSigned(host string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	// a leaf, trusting it mustn't mean trusting a CA whose key is in the
+	// database
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"hades"}, CommonName: "hades"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !ip.IsUnspecified() && !ip.IsLoopback() {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}
+	} else if host != "" && host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// redirect handler (sends plain HTTP requests to the HTTPS server)
+func (a *App) redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	// the port actually listened on (not the configured one, which can be 0)
+	_, port, err := net.SplitHostPort(a.Listener.Addr().String())
+	if err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), 301)
+}
@@ -0,0 +1,308 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// bolt.DB bucket for API tokens (keyed by id)
+var tokenBucket = []byte("api-tokens")
+
+// prefix of API tokens (so they're recognizable in configs and logs).
+const tokenPrefix = "hades_"
+
+// how often the last use time of a token is saved.
+const tokenUsedInterval = time.Minute
+
+// errInvalidToken returned when an API token doesn't exist.
+var errInvalidToken = errors.New("invalid API token")
+
+// apiToken represents an API token (only its hash is stored).
+type apiToken struct {
+	ID       uint64    `json:"id"`
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash"`
+	Role     string    `json:"role"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+// hashToken returns the stored hash of a raw token.
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenKey converts a token id to its bucket key.
+func tokenKey(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+// createToken adds a new API token called name with role and returns the
+// raw token (which can't be recovered later).
+func (a *App) createToken(name, role string) (string, error) {
+	if roleLevel(role) < 0 {
+		return "", errInvalidRole
+	}
+	r := make([]byte, 32)
+	_, err := rand.Read(r)
+	if err != nil {
+		return "", err
+	}
+	raw := tokenPrefix + base64.RawURLEncoding.EncodeToString(r)
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(tokenBucket)
+		if err != nil {
+			return err
+		}
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		t := &apiToken{ID: id, Name: name, Hash: hashToken(raw), Role: role, Created: time.Now()}
+		enc, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put(tokenKey(id), enc)
+	})
+	if err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// listTokens returns all API tokens (oldest first).
+func (a *App) listTokens() ([]*apiToken, error) {
+	tokens := make([]*apiToken, 0)
+	err := a.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokenBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			t := &apiToken{}
+			err := json.Unmarshal(v, t)
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, t)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// revokeToken removes API token id.
+func (a *App) revokeToken(id uint64) error {
+	return a.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokenBucket)
+		if b == nil || b.Get(tokenKey(id)) == nil {
+			return errInvalidToken
+		}
+		return b.Delete(tokenKey(id))
+	})
+}
+
+// checkToken returns the API token matching raw (recording its use).
+func (a *App) checkToken(raw string) (*apiToken, error) {
+	if !strings.HasPrefix(raw, tokenPrefix) {
+		return nil, errInvalidToken
+	}
+	hash := []byte(hashToken(raw))
+	tokens, err := a.listTokens()
+	if err != nil {
+		return nil, err
+	}
+	var found *apiToken
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			found = t
+		}
+	}
+	if found == nil {
+		return nil, errInvalidToken
+	}
+	now := time.Now()
+	if now.Sub(found.LastUsed) < tokenUsedInterval {
+		return found, nil
+	}
+	found.LastUsed = now
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokenBucket)
+		if b == nil || b.Get(tokenKey(found.ID)) == nil {
+			// revoked in the meantime
+			return errInvalidToken
+		}
+		enc, err := json.Marshal(found)
+		if err != nil {
+			return err
+		}
+		return b.Put(tokenKey(found.ID), enc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// role returns the role of t (viewer if it's missing or unknown).
+func (t *apiToken) role() string {
+	if roleLevel(t.Role) < 0 {
+		return roleViewer
+	}
+	return t.Role
+}
+
+// tokenView represents an API token prepared for display.
+type tokenView struct {
+	ID       uint64
+	Name     string
+	Role     string
+	Created  string
+	LastUsed string
+}
+
+// tokens page handler
+func (a *App) getTokensHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	tokens, err := a.listTokens()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	views := make([]*tokenView, 0, len(tokens))
+	for _, t := range tokens {
+		v := &tokenView{
+			ID:       t.ID,
+			Name:     t.Name,
+			Role:     t.role(),
+			Created:  t.Created.Format("2006-01-02 15:04:05"),
+			LastUsed: "never",
+		}
+		if !t.LastUsed.IsZero() {
+			v.LastUsed = t.LastUsed.Format("2006-01-02 15:04:05")
+		}
+		views = append(views, v)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	flashes := a.getFlashes(s)
+	// new tokens are only shown once
+	created := make([]string, 0)
+	for _, x := range s.Flashes("token") {
+		created = append(created, x.(string))
+	}
+	s.Save(r, w)
+	a.Templates.ExecuteTemplate(w, "tokens.html", struct {
+		Token   string
+		Errors  []string
+		Created []string
+		Tokens  []*tokenView
+		Roles   []string
+	}{
+		Token:   token,
+		Errors:  flashes,
+		Created: created,
+		Tokens:  views,
+		Roles:   roles,
+	})
+}
+
+// token creation post handler
+func (a *App) postTokensHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	formtoken := r.PostForm.Get("token")
+	if formtoken != token {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	if name == "" {
+		s.AddFlash("tokens need a name")
+		s.Save(r, w)
+		http.Redirect(w, r, "/tokens", 302)
+		return
+	}
+	raw, err := a.createToken(name, r.PostForm.Get("role"))
+	if err != nil {
+		s.AddFlash("error creating token: " + err.Error())
+	} else {
+		s.AddFlash(raw, "token")
+	}
+	s.Save(r, w)
+	http.Redirect(w, r, "/tokens", 302)
+}
+
+// token revoke post handler
+func (a *App) postRevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	formtoken := r.PostForm.Get("token")
+	if formtoken != token {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err == nil {
+		err = a.revokeToken(id)
+	}
+	if err != nil {
+		s.AddFlash("error revoking token: " + err.Error())
+		s.Save(r, w)
+	}
+	http.Redirect(w, r, "/tokens", 302)
+}
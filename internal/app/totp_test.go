@@ -0,0 +1,123 @@
+package app
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA1 secret of the RFC 6238 test vectors
+const rfcSecret = "12345678901234567890"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B (8 digit codes, of which the last 6 are ours)
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, test := range tests {
+		step := totpStep(time.Unix(test.unix, 0))
+		got := totpCode([]byte(rfcSecret), step)
+		want := test.code[len(test.code)-totpDigits:]
+		if got != want {
+			t.Errorf("code at %d = %s, expected %s", test.unix, got, want)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte(rfcSecret))
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+	code := func(step int64) string {
+		return totpCode([]byte(rfcSecret), step)
+	}
+	tests := []struct {
+		secret string
+		code   string
+		last   int64
+		step   int64
+		ok     bool
+	}{
+		{secret, "050471", 0, current, true},
+		{strings.ToLower(secret), "050 471", 0, current, true},
+		// one period of clock drift either way
+		{secret, code(current - 1), 0, current - 1, true},
+		{secret, code(current + 1), 0, current + 1, true},
+		{secret, code(current - 2), 0, 0, false},
+		{secret, code(current + 2), 0, 0, false},
+		// codes can't be used twice (or after a later one)
+		{secret, "050471", current, 0, false},
+		{secret, code(current - 1), current - 1, 0, false},
+		{secret, code(current + 1), current, current + 1, true},
+		{secret, "050472", 0, 0, false},
+		{secret, "05047", 0, 0, false},
+		{secret, "0504711", 0, 0, false},
+		{secret, "", 0, 0, false},
+		{"not base32!", "050471", 0, 0, false},
+	}
+	for _, test := range tests {
+		step, ok := checkTOTP(test.secret, test.code, test.last, now)
+		if ok != test.ok || step != test.step {
+			t.Errorf("checkTOTP(%q, %q, %d) = %d, %t, expected %d, %t", test.secret, test.code, test.last, step, ok, test.step, test.ok)
+		}
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(totpURI("ABC", "jo smith"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/hades:jo smith" {
+		t.Errorf("unexpected URI %s", u)
+	}
+	q := u.Query()
+	for k, want := range map[string]string{
+		"secret":    "ABC",
+		"issuer":    "hades",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	} {
+		if q.Get(k) != want {
+			t.Errorf("%s = %q, expected %q", k, q.Get(k), want)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, expected %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		if len(code) != 19 || strings.Count(code, "-") != 3 || seen[code] {
+			t.Errorf("unexpected code %q", code)
+		}
+		seen[code] = true
+		if hashRecoveryCode(code) != hashes[i] {
+			t.Errorf("hash of %q doesn't match", code)
+		}
+		// typed differently
+		typed := strings.ToUpper(strings.Replace(code, "-", " ", -1))
+		if hashRecoveryCode(typed) != hashes[i] {
+			t.Errorf("hash of %q doesn't match %q", typed, code)
+		}
+	}
+	if hashRecoveryCode(codes[0]) == hashRecoveryCode(codes[1]) {
+		t.Error("different codes have the same hash")
+	}
+}
@@ -0,0 +1,407 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// how long a password login waits for its second factor.
+	pendingLoginTimeout = 5 * time.Minute
+	// wrong codes allowed before a login has to start over.
+	maxCodeFailures = 5
+)
+
+var (
+	// errInvalidCode returned for wrong TOTP and recovery codes.
+	errInvalidCode = errors.New("invalid code")
+	// errTwoFactorOn returned when setting up two-factor authentication
+	// for a user that already has it.
+	errTwoFactorOn = errors.New("two-factor authentication is already enabled")
+	// errTwoFactorOff returned for actions that need two-factor
+	// authentication enabled.
+	errTwoFactorOff = errors.New("two-factor authentication isn't enabled")
+)
+
+// pendingLogin is a password login waiting for its second factor.
+type pendingLogin struct {
+	name string
+	// stamp of the user when the password was checked.
+	stamp    string
+	expires  time.Time
+	failures int
+}
+
+// pendingLogins holds password logins waiting for their second factor by
+// a random id stored in the session (so wrong codes are counted here and
+// replaying an old cookie doesn't reset them).
+type pendingLogins struct {
+	mu     sync.Mutex
+	logins map[string]*pendingLogin
+}
+
+// newPendingLogins returns an empty pendingLogins.
+func newPendingLogins() *pendingLogins {
+	return &pendingLogins{logins: make(map[string]*pendingLogin)}
+}
+
+// add starts a pending login for user u and returns its id.
+func (p *pendingLogins) add(u *user) (string, error) {
+	r := make([]byte, 32)
+	_, err := rand.Read(r)
+	if err != nil {
+		return "", err
+	}
+	id := base64.RawURLEncoding.EncodeToString(r)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for k, l := range p.logins {
+		if now.After(l.expires) {
+			delete(p.logins, k)
+		}
+	}
+	p.logins[id] = &pendingLogin{name: u.Name, stamp: u.Stamp, expires: now.Add(pendingLoginTimeout)}
+	return id, nil
+}
+
+// get returns the user name and stamp of pending login id (false if
+// there's none or it expired).
+func (p *pendingLogins) get(id string) (string, string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.logins[id]
+	if !ok || time.Now().After(l.expires) {
+		return "", "", false
+	}
+	return l.name, l.stamp, true
+}
+
+// fail counts a wrong code for pending login id (returning false if it
+// ended after too many).
+func (p *pendingLogins) fail(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.logins[id]
+	if !ok {
+		return false
+	}
+	l.failures++
+	if l.failures >= maxCodeFailures {
+		delete(p.logins, id)
+		return false
+	}
+	return true
+}
+
+// remove ends pending login id.
+func (p *pendingLogins) remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.logins, id)
+}
+
+// enableTwoFactor turns on two-factor authentication for user name with
+// secret (if code is valid for it) and returns new recovery codes.
+func (a *App) enableTwoFactor(name, secret, code string) ([]string, error) {
+	step, ok := checkTOTP(secret, code, 0, time.Now())
+	if !ok {
+		return nil, errInvalidCode
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = a.updateUser(name, func(u *user) error {
+		if u.TwoFactor() {
+			return errTwoFactorOn
+		}
+		u.TOTPSecret = secret
+		u.TOTPStep = step
+		u.Recovery = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// disableTwoFactor turns off two-factor authentication for user name.
+func (a *App) disableTwoFactor(name string) error {
+	return a.updateUser(name, func(u *user) error {
+		u.TOTPSecret = ""
+		u.TOTPStep = 0
+		u.Recovery = nil
+		return nil
+	})
+}
+
+// resetRecoveryCodes replaces the recovery codes of user name with new ones.
+func (a *App) resetRecoveryCodes(name string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = a.updateUser(name, func(u *user) error {
+		if !u.TwoFactor() {
+			return errTwoFactorOff
+		}
+		u.Recovery = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// checkSecondFactor returns errInvalidCode unless code is a TOTP code or
+// recovery code of user name (recovery codes and TOTP time steps can only
+// be used once).
+func (a *App) checkSecondFactor(name, code string) error {
+	return a.updateUser(name, func(u *user) error {
+		if !u.TwoFactor() {
+			// turned off since the password was checked
+			return nil
+		}
+		step, ok := checkTOTP(u.TOTPSecret, code, u.TOTPStep, time.Now())
+		if ok {
+			u.TOTPStep = step
+			return nil
+		}
+		hash := hashRecoveryCode(code)
+		for i, h := range u.Recovery {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				u.Recovery = append(u.Recovery[:i], u.Recovery[i+1:]...)
+				return nil
+			}
+		}
+		return errInvalidCode
+	})
+}
+
+// login code page handler (second step of logins with two-factor
+// authentication)
+func (a *App) getLoginCodeHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	id, _ := s.Values["pending"].(string)
+	if _, _, ok := a.Logins.get(id); !ok {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	flashes := a.getFlashes(s)
+	s.Save(r, w)
+	a.Templates.ExecuteTemplate(w, "verify.html", struct {
+		Errors []string
+	}{
+		Errors: flashes,
+	})
+}
+
+// login code post handler
+func (a *App) postLoginCodeHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	err := r.ParseForm()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	id, _ := s.Values["pending"].(string)
+	name, stamp, ok := a.Logins.get(id)
+	if !ok {
+		delete(s.Values, "pending")
+		s.AddFlash("login expired, try again")
+		s.Save(r, w)
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	err = a.loginBegin(r)
+	if err != nil {
+		s.AddFlash(err.Error())
+		s.Save(r, w)
+		http.Redirect(w, r, "/login/2fa", 302)
+		return
+	}
+	defer a.loginEnd(r)
+	err = a.checkSecondFactor(name, strings.TrimSpace(r.PostForm.Get("code")))
+	if err != nil {
+		a.loginFailed(r, name, "wrong two-factor code")
+		if !a.Logins.fail(id) {
+			delete(s.Values, "pending")
+			s.AddFlash("too many invalid codes, try again")
+			s.Save(r, w)
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+		s.AddFlash("invalid code")
+		s.Save(r, w)
+		http.Redirect(w, r, "/login/2fa", 302)
+		return
+	}
+	a.Logins.remove(id)
+	delete(s.Values, "pending")
+	u, err := a.getUser(name)
+	if err != nil || u.Stamp != stamp {
+		// removed or password changed since it was checked
+		s.AddFlash("login expired, try again")
+		s.Save(r, w)
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	err = a.logIn(s, u)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	s.Save(r, w)
+	http.Redirect(w, r, "/", 302)
+}
+
+// two-factor settings page handler
+func (a *App) getTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	u, err := a.getSessionUser(s)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	flashes := a.getFlashes(s)
+	// new recovery codes are only shown once
+	recovery := make([]string, 0)
+	for _, x := range s.Flashes("recovery") {
+		recovery = append(recovery, x.(string))
+	}
+	s.Save(r, w)
+	secret, _ := s.Values["totp-secret"].(string)
+	// otpauth links need to get past html/template's URL filter
+	var uri template.URL
+	if secret != "" {
+		uri = template.URL(totpURI(secret, u.Name))
+	}
+	a.Templates.ExecuteTemplate(w, "twofactor.html", struct {
+		Token     string
+		Errors    []string
+		User      *user
+		Secret    string
+		URI       template.URL
+		Recovery  []string
+		Remaining int
+	}{
+		Token:     token,
+		Errors:    flashes,
+		User:      u,
+		Secret:    secret,
+		URI:       uri,
+		Recovery:  recovery,
+		Remaining: len(u.Recovery),
+	})
+}
+
+// two-factor settings post handler (setup, enable, cancel, recovery or
+// disable)
+func (a *App) postTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	formtoken := r.PostForm.Get("token")
+	if formtoken != token {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	u, err := a.getSessionUser(s)
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	code := strings.TrimSpace(r.PostForm.Get("code"))
+	var codes []string
+	action := r.PostForm.Get("action")
+	switch action {
+	case "setup":
+		if u.TwoFactor() {
+			err = errTwoFactorOn
+			break
+		}
+		var secret string
+		secret, err = newTOTPSecret()
+		if err == nil {
+			s.Values["totp-secret"] = secret
+		}
+	case "enable":
+		secret, _ := s.Values["totp-secret"].(string)
+		if secret == "" {
+			err = fmt.Errorf("set up two-factor authentication first")
+			break
+		}
+		codes, err = a.enableTwoFactor(u.Name, secret, code)
+		if err == nil {
+			delete(s.Values, "totp-secret")
+			s.AddFlash("two-factor authentication enabled")
+		}
+	case "cancel":
+		delete(s.Values, "totp-secret")
+	case "recovery":
+		err = a.checkSecondFactor(u.Name, code)
+		if err == nil {
+			codes, err = a.resetRecoveryCodes(u.Name)
+		}
+	case "disable":
+		err = a.checkSecondFactor(u.Name, code)
+		if err == nil {
+			err = a.disableTwoFactor(u.Name)
+		}
+		if err == nil {
+			s.AddFlash("two-factor authentication disabled")
+		}
+	default:
+		err = fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		s.AddFlash("error: " + err.Error())
+	}
+	for _, c := range codes {
+		s.AddFlash(c, "recovery")
+	}
+	s.Save(r, w)
+	http.Redirect(w, r, "/2fa", 302)
+}
+
+// two-factor reset handler for the control socket (for users who lost
+// their authenticator and recovery codes)
+func (a *App) deleteControlTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.disableTwoFactor(mux.Vars(r)["name"])
+	if err == errUserNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
@@ -0,0 +1,613 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bolt.DB bucket for user accounts (keyed by name)
+var userBucket = []byte("users")
+
+// User roles (each allowed everything the previous one is).
+const (
+	// roleViewer can see daemons, logs and events.
+	roleViewer = "viewer"
+	// roleOperator can also start, stop, restart and scale daemons.
+	roleOperator = "operator"
+	// roleAdmin can also add, change and remove daemons, API tokens and
+	// users.
+	roleAdmin = "admin"
+)
+
+// roles lists user roles from least to most allowed.
+var roles = []string{roleViewer, roleOperator, roleAdmin}
+
+// name of the user created when there are none.
+const defaultAdmin = "admin"
+
+// shortest password accepted for accounts.
+const minPasswordLength = 8
+
+var (
+	// errUserNotFound returned when a user doesn't exist.
+	errUserNotFound = errors.New("no such user")
+	// errUserExists returned when adding a user that already exists.
+	errUserExists = errors.New("user already exists")
+	// errInvalidRole returned for unknown roles.
+	errInvalidRole = errors.New("role must be viewer, operator or admin")
+	// errInvalidUserName returned for user names that can't be used.
+	errInvalidUserName = errors.New("user names can only use letters, numbers, '.', '_' and '-'")
+	// errShortPassword returned for passwords that are too short.
+	errShortPassword = fmt.Errorf("passwords need at least %d characters", minPasswordLength)
+	// errLastAdmin returned when removing (or demoting) the last admin.
+	errLastAdmin = errors.New("can't remove the last admin")
+	// errForbidden returned when a user's role doesn't allow an action.
+	errForbidden = errors.New("permission denied")
+	// errStaleSession returned for sessions logged in before the password
+	// of their user changed.
+	errStaleSession = errors.New("password changed since logging in")
+)
+
+// user names look like "alice" or "ci-bot"
+var userName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// hash compared against when logging in as an unknown user (so it takes as
+// long as a wrong password)
+var dummyHash = []byte("$2a$10$eu/wUDZYbnibR9BANjfjYOaGmDlQDtbO1xjMfOZ5uAx0GYZlVEqQe")
+
+// user represents a user account.
+type user struct {
+	Name    string    `json:"name"`
+	Hash    []byte    `json:"hash"`
+	Role    string    `json:"role"`
+	Created time.Time `json:"created"`
+	// TOTPSecret is the base32 TOTP secret (empty without two-factor
+	// authentication).
+	TOTPSecret string `json:"totp_secret,omitempty"`
+	// TOTPStep is the last time step a code was used for (so codes can't
+	// be used twice).
+	TOTPStep int64 `json:"totp_step,omitempty"`
+	// Recovery holds hashes of unused recovery codes.
+	Recovery []string `json:"recovery,omitempty"`
+	// Stamp changes with the password and is stored in sessions (so
+	// sessions from before are logged out).
+	Stamp string `json:"stamp,omitempty"`
+}
+
+// roleLevel returns the position of role in roles (-1 if unknown).
+func roleLevel(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// Can returns true if the role of u allows what role is allowed.
+func (u *user) Can(role string) bool {
+	return roleLevel(u.Role) >= roleLevel(role) && roleLevel(role) >= 0
+}
+
+// TwoFactor returns true if u logs in with a second factor.
+func (u *user) TwoFactor() bool {
+	return u.TOTPSecret != ""
+}
+
+// userInfo represents a user account without its secrets.
+type userInfo struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Created   time.Time `json:"created"`
+	TwoFactor bool      `json:"two_factor"`
+}
+
+// getUser returns the user account called name.
+func (a *App) getUser(name string) (*user, error) {
+	u := &user{}
+	err := a.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(userBucket)
+		if b == nil {
+			return errUserNotFound
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return errUserNotFound
+		}
+		return json.Unmarshal(v, u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// listUsers returns all user accounts (sorted by name).
+func (a *App) listUsers() ([]*userInfo, error) {
+	users := make([]*userInfo, 0)
+	err := a.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(userBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			u := &user{}
+			err := json.Unmarshal(v, u)
+			if err != nil {
+				return err
+			}
+			users = append(users, &userInfo{
+				Name:      u.Name,
+				Role:      u.Role,
+				Created:   u.Created,
+				TwoFactor: u.TwoFactor(),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// updateUser runs fn on user name and saves it (checking there's an admin
+// left).
+func (a *App) updateUser(name string, fn func(u *user) error) error {
+	return a.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(userBucket)
+		if err != nil {
+			return err
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return errUserNotFound
+		}
+		u := &user{}
+		err = json.Unmarshal(v, u)
+		if err != nil {
+			return err
+		}
+		err = fn(u)
+		if err != nil {
+			return err
+		}
+		enc, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(name), enc)
+		if err != nil {
+			return err
+		}
+		return checkAdmins(b)
+	})
+}
+
+// checkAdmins returns errLastAdmin if no user in b is an admin.
+func checkAdmins(b *bolt.Bucket) error {
+	found := false
+	err := b.ForEach(func(k, v []byte) error {
+		u := &user{}
+		err := json.Unmarshal(v, u)
+		if err != nil {
+			return err
+		}
+		if u.Role == roleAdmin {
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errLastAdmin
+	}
+	return nil
+}
+
+// hashPassword returns the hash stored for password.
+func hashPassword(password string) ([]byte, error) {
+	if len(password) < minPasswordLength {
+		return nil, errShortPassword
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// addUser adds a user account.
+func (a *App) addUser(name, password, role string) error {
+	if !userName.MatchString(name) {
+		return errInvalidUserName
+	}
+	if roleLevel(role) < 0 {
+		return errInvalidRole
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	// new stamp so sessions of a removed user with the same name don't
+	// work
+	stamp, err := newUserStamp()
+	if err != nil {
+		return err
+	}
+	u := &user{Name: name, Hash: hash, Role: role, Created: time.Now(), Stamp: stamp}
+	enc, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return a.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(userBucket)
+		if err != nil {
+			return err
+		}
+		if b.Get([]byte(name)) != nil {
+			return errUserExists
+		}
+		return b.Put([]byte(name), enc)
+	})
+}
+
+// setUserPassword changes the password of user name (logging out its
+// sessions).
+func (a *App) setUserPassword(name, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	stamp, err := newUserStamp()
+	if err != nil {
+		return err
+	}
+	return a.updateUser(name, func(u *user) error {
+		u.Hash = hash
+		u.Stamp = stamp
+		return nil
+	})
+}
+
+// newUserStamp returns a new random user stamp.
+func newUserStamp() (string, error) {
+	r := make([]byte, 16)
+	_, err := rand.Read(r)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(r), nil
+}
+
+// setUserRole changes the role of user name.
+func (a *App) setUserRole(name, role string) error {
+	if roleLevel(role) < 0 {
+		return errInvalidRole
+	}
+	return a.updateUser(name, func(u *user) error {
+		u.Role = role
+		return nil
+	})
+}
+
+// removeUser removes user name (logging out its sessions).
+func (a *App) removeUser(name string) error {
+	return a.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(userBucket)
+		if b == nil || b.Get([]byte(name)) == nil {
+			return errUserNotFound
+		}
+		err := b.Delete([]byte(name))
+		if err != nil {
+			return err
+		}
+		return checkAdmins(b)
+	})
+}
+
+// checkLogin returns user name if password is theirs.
+func (a *App) checkLogin(name, password string) (*user, error) {
+	u, err := a.getUser(name)
+	if err == errUserNotFound {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = bcrypt.CompareHashAndPassword(u.Hash, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// SetupUsers makes sure there's a user account, turning the password of
+// older versions into the admin account or creating one with a random
+// password (returned, empty if nothing was created).
+func (a *App) SetupUsers() (string, string, error) {
+	users, err := a.listUsers()
+	if err != nil || len(users) > 0 {
+		return "", "", err
+	}
+	migrated := false
+	err = a.DB.Update(func(tx *bolt.Tx) error {
+		settings := tx.Bucket([]byte("settings"))
+		hash := settings.Get([]byte("password-hash"))
+		if hash == nil {
+			return nil
+		}
+		b, err := tx.CreateBucketIfNotExists(userBucket)
+		if err != nil {
+			return err
+		}
+		u := &user{Name: defaultAdmin, Hash: hash, Role: roleAdmin, Created: time.Now()}
+		enc, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		err = b.Put([]byte(u.Name), enc)
+		if err != nil {
+			return err
+		}
+		migrated = true
+		return settings.Delete([]byte("password-hash"))
+	})
+	if err != nil || migrated {
+		return "", "", err
+	}
+	password, err := GeneratePassword()
+	if err != nil {
+		return "", "", err
+	}
+	err = a.addUser(defaultAdmin, password, roleAdmin)
+	if err != nil {
+		return "", "", err
+	}
+	return defaultAdmin, password, nil
+}
+
+// GeneratePassword returns a new random password.
+func GeneratePassword() (string, error) {
+	r := make([]byte, 16)
+	_, err := rand.Read(r)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(r), nil
+}
+
+// getSessionUser returns the user logged in with session s (or error if
+// not logged in, the account was removed or its password changed).
+func (a *App) getSessionUser(s *sessions.Session) (*user, error) {
+	name, ok := s.Values["name"].(string)
+	if !ok {
+		return nil, fmt.Errorf("no user found")
+	}
+	u, err := a.getUser(name)
+	if err != nil {
+		return nil, err
+	}
+	stamp, _ := s.Values["stamp"].(string)
+	if stamp != u.Stamp {
+		return nil, errStaleSession
+	}
+	return u, nil
+}
+
+// checkRole returns errForbidden unless the user logged in with session s
+// has (at least) role.
+func (a *App) checkRole(s *sessions.Session, role string) error {
+	u, err := a.getSessionUser(s)
+	if err != nil {
+		return err
+	}
+	if !u.Can(role) {
+		return errForbidden
+	}
+	return nil
+}
+
+// forbidden writes the error page for actions the user isn't allowed.
+func (a *App) forbidden(w http.ResponseWriter, role string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	a.Templates.ExecuteTemplate(w, "error.html", "permission denied (needs the "+role+" role)")
+}
+
+// users page handler
+func (a *App) getUsersHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	users, err := a.listUsers()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	flashes := a.getFlashes(s)
+	s.Save(r, w)
+	a.Templates.ExecuteTemplate(w, "users.html", struct {
+		Token  string
+		Errors []string
+		Users  []*userInfo
+		Roles  []string
+		Self   string
+	}{
+		Token:  token,
+		Errors: flashes,
+		Users:  users,
+		Roles:  roles,
+		Self:   s.Values["name"].(string),
+	})
+}
+
+// user add post handler
+func (a *App) postUsersHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	formtoken := r.PostForm.Get("token")
+	if formtoken != token {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	err = a.addUser(name, r.PostForm.Get("password"), r.PostForm.Get("role"))
+	if err != nil {
+		s.AddFlash("error adding user: " + err.Error())
+	} else {
+		s.AddFlash("added user " + name)
+	}
+	s.Save(r, w)
+	http.Redirect(w, r, "/users", 302)
+}
+
+// user change post handler (role, password, two-factor reset or removal)
+func (a *App) postUserHandler(w http.ResponseWriter, r *http.Request) {
+	s, _ := a.Sessions.Get(r, "session")
+	token, err := a.getUserToken(s)
+	if err != nil {
+		http.Redirect(w, r, "/login", 302)
+		return
+	}
+	if a.checkRole(s, roleAdmin) != nil {
+		a.forbidden(w, roleAdmin)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	formtoken := r.PostForm.Get("token")
+	if formtoken != token {
+		http.Redirect(w, r, "/error", 302)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	action := r.PostForm.Get("action")
+	switch action {
+	case "role":
+		err = a.setUserRole(name, r.PostForm.Get("role"))
+	case "password":
+		err = a.setUserPassword(name, r.PostForm.Get("password"))
+		if err == nil && name == s.Values["name"] {
+			// other sessions are logged out but not this one
+			var u *user
+			u, err = a.getUser(name)
+			if err == nil {
+				s.Values["stamp"] = u.Stamp
+			}
+		}
+	case "reset-2fa":
+		err = a.disableTwoFactor(name)
+	case "remove":
+		err = a.removeUser(name)
+	default:
+		err = fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		s.AddFlash(fmt.Sprintf("error changing user %s: %s", name, err))
+	} else {
+		s.AddFlash(fmt.Sprintf("changed user %s (%s)", name, action))
+	}
+	s.Save(r, w)
+	http.Redirect(w, r, "/users", 302)
+}
+
+// controlUserRequest is the body of control socket user requests.
+type controlUserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
+
+// user list handler for the control socket
+func (a *App) getControlUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := a.listUsers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// user add handler for the control socket
+func (a *App) postControlUsersHandler(w http.ResponseWriter, r *http.Request) {
+	req := &controlUserRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err == nil {
+		err = a.addUser(req.Name, req.Password, req.Role)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// user change handler for the control socket (password and role)
+func (a *App) putControlUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	req := &controlUserRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err == nil && req.Password != "" {
+		err = a.setUserPassword(name, req.Password)
+	}
+	if err == nil && req.Role != "" {
+		err = a.setUserRole(name, req.Role)
+	}
+	if err == errUserNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+// user remove handler for the control socket
+func (a *App) deleteControlUserHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.removeUser(mux.Vars(r)["name"])
+	if err == errUserNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
@@ -0,0 +1,244 @@
+// Package config reads and writes daemon definitions as config files (YAML
+// or JSON) used by "hades apply" and "hades export".
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/wybiral/hades/internal/yaml"
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// runtime state kept with daemons that can't be set in a config.
+var stateKeys = map[string]bool{
+	"status":      true,
+	"restarts":    true,
+	"exit_code":   true,
+	"exit_reason": true,
+	"started":     true,
+	"instances":   true,
+	"disabled":    true,
+}
+
+// Parse reads the daemon specs from a config file. The file has a single
+// "daemons" key with a list of daemon definitions using the same keys as
+// the JSON encoding of hades.Daemon, except that dependencies are listed
+// by name and "id" is only used to match existing daemons without names.
+func Parse(data []byte) ([]*hades.Spec, error) {
+	var root interface{}
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		root, err = yaml.FromJSON(data)
+	} else {
+		root, err = yaml.Unmarshal(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]*hades.Spec, 0)
+	if root == nil {
+		return specs, nil
+	}
+	m, ok := root.(yaml.Map)
+	if !ok {
+		return nil, fmt.Errorf("config: expected a mapping with \"daemons\"")
+	}
+	var list []interface{}
+	for _, it := range m {
+		if it.Key != "daemons" {
+			return nil, fmt.Errorf("config: unknown key %q", it.Key)
+		}
+		if it.Value == nil {
+			continue
+		}
+		list, ok = it.Value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("config: \"daemons\" must be a list")
+		}
+	}
+	for i, item := range list {
+		s, err := parseSpec(item)
+		if err != nil {
+			return nil, fmt.Errorf("config: daemon %d: %s", i+1, err)
+		}
+		specs = append(specs, s)
+	}
+	return specs, nil
+}
+
+// parseSpec reads a single daemon definition.
+func parseSpec(item interface{}) (*hades.Spec, error) {
+	m, ok := item.(yaml.Map)
+	if !ok {
+		return nil, fmt.Errorf("expected a mapping")
+	}
+	s := &hades.Spec{}
+	rest := make(yaml.Map, 0, len(m))
+	for _, it := range m {
+		var err error
+		switch {
+		case it.Key == "id":
+			s.ID, err = parseID(it.Value)
+		case it.Key == "requires":
+			s.Requires, err = parseRefs(it.Value)
+		case it.Key == "after":
+			s.After, err = parseRefs(it.Value)
+		case stateKeys[it.Key]:
+			err = fmt.Errorf("%q is runtime state, not a setting", it.Key)
+		default:
+			rest = append(rest, it)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	enc, err := yaml.ToJSON(rest)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(enc))
+	dec.DisallowUnknownFields()
+	s.Daemon = &hades.Daemon{}
+	err = dec.Decode(s.Daemon)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseID reads a daemon id.
+func parseID(v interface{}) (uint64, error) {
+	n, ok := v.(int64)
+	if !ok || n < 1 {
+		return 0, fmt.Errorf("invalid id %v", v)
+	}
+	return uint64(n), nil
+}
+
+// parseRefs reads a list of daemon names (or ids).
+func parseRefs(v interface{}) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		// a single dependency
+		list = []interface{}{v}
+	}
+	refs := make([]string, len(list))
+	for i, item := range list {
+		switch x := item.(type) {
+		case string:
+			refs[i] = x
+		case int64:
+			refs[i] = strconv.FormatInt(x, 10)
+		default:
+			return nil, fmt.Errorf("invalid dependency %v", item)
+		}
+	}
+	return refs, nil
+}
+
+// Format writes specs as a YAML config file (read by Parse). Empty
+// settings are left out.
+func Format(specs []*hades.Spec) ([]byte, error) {
+	list := make([]interface{}, 0, len(specs))
+	for _, s := range specs {
+		enc, err := json.Marshal(s.Daemon)
+		if err != nil {
+			return nil, err
+		}
+		v, err := yaml.FromJSON(enc)
+		if err != nil {
+			return nil, err
+		}
+		m := make(yaml.Map, 0)
+		if s.Daemon.Name != "" {
+			m = append(m, yaml.Item{Key: "name", Value: s.Daemon.Name})
+		} else if s.ID != 0 {
+			m = append(m, yaml.Item{Key: "id", Value: int64(s.ID)})
+		}
+		for _, it := range v.(yaml.Map) {
+			if it.Key == "id" || it.Key == "name" || it.Key == "requires" || it.Key == "after" || stateKeys[it.Key] {
+				continue
+			}
+			if it.Key == "on_dependency_down" || it.Key == "replicas" {
+				m = appendRefs(m, s)
+			}
+			value, ok := prune(it.Value)
+			if it.Key == "labels" {
+				// labels can have empty values
+				value = it.Value
+			}
+			if ok {
+				m = append(m, yaml.Item{Key: it.Key, Value: value})
+			}
+		}
+		m = appendRefs(m, s)
+		list = append(list, m)
+	}
+	return yaml.Marshal(yaml.Map{{Key: "daemons", Value: list}})
+}
+
+// appendRefs adds the dependencies of s to m (unless they're already
+// there).
+func appendRefs(m yaml.Map, s *hades.Spec) yaml.Map {
+	if _, ok := m.Get("requires"); ok {
+		return m
+	}
+	if _, ok := m.Get("after"); ok {
+		return m
+	}
+	if len(s.Requires) > 0 {
+		m = append(m, yaml.Item{Key: "requires", Value: refList(s.Requires)})
+	}
+	if len(s.After) > 0 {
+		m = append(m, yaml.Item{Key: "after", Value: refList(s.After)})
+	}
+	return m
+}
+
+// refList converts dependency names for encoding.
+func refList(refs []string) []interface{} {
+	list := make([]interface{}, len(refs))
+	for i, ref := range refs {
+		list[i] = ref
+		n, err := strconv.ParseInt(ref, 10, 64)
+		if err == nil {
+			// ids are written as numbers
+			list[i] = n
+		}
+	}
+	return list
+}
+
+// prune removes empty values (zero, false, empty strings and collections)
+// from v. ok is false if v is empty itself.
+func prune(v interface{}) (interface{}, bool) {
+	switch x := v.(type) {
+	case nil:
+		return nil, false
+	case bool:
+		return x, x
+	case string:
+		return x, x != ""
+	case json.Number:
+		f, err := x.Float64()
+		return x, err != nil || f != 0
+	case yaml.Map:
+		out := make(yaml.Map, 0, len(x))
+		for _, it := range x {
+			value, ok := prune(it.Value)
+			if ok {
+				out = append(out, yaml.Item{Key: it.Key, Value: value})
+			}
+		}
+		return out, len(out) > 0
+	case []interface{}:
+		return x, len(x) > 0
+	}
+	return v, true
+}
@@ -0,0 +1,261 @@
+// Package importer translates daemons defined for other process managers
+// (supervisord programs, Procfiles and systemd services) into hades daemon
+// definitions, reporting settings it can't translate.
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// Supported formats.
+const (
+	// FormatSupervisord reads [program:x] sections of supervisord configs.
+	FormatSupervisord = "supervisord"
+	// FormatProcfile reads "name: command" lines of Procfiles.
+	FormatProcfile = "procfile"
+	// FormatSystemd reads systemd .service units.
+	FormatSystemd = "systemd"
+)
+
+// Formats lists the supported formats.
+var Formats = []string{FormatSupervisord, FormatProcfile, FormatSystemd}
+
+// Daemon represents an imported daemon.
+type Daemon struct {
+	Daemon *hades.Daemon
+	// Start is true if the source starts it automatically.
+	Start bool
+}
+
+// Result represents the daemons read from a file.
+type Result struct {
+	Format  string
+	Daemons []*Daemon
+	// Warnings describe settings that couldn't be translated.
+	Warnings []string
+}
+
+// warn adds a warning about daemon name (empty for the whole file).
+func (r *Result) warn(name, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if name != "" {
+		msg = name + ": " + msg
+	}
+	r.Warnings = append(r.Warnings, msg)
+}
+
+// procfile lines look like "web: command"
+var procfileLine = regexp.MustCompile(`^([A-Za-z0-9_-]+):\s*(.*)$`)
+
+// Detect guesses the format of a file from its name and content (empty if
+// unknown).
+func Detect(filename string, data []byte) string {
+	base := filepath.Base(filename)
+	switch {
+	case strings.HasSuffix(base, ".service"):
+		return FormatSystemd
+	case strings.HasPrefix(base, "Procfile"):
+		return FormatProcfile
+	case bytes.Contains(data, []byte("[program:")):
+		return FormatSupervisord
+	case bytes.Contains(data, []byte("[Service]")):
+		return FormatSystemd
+	}
+	lines := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !procfileLine.MatchString(line) {
+			return ""
+		}
+		lines++
+	}
+	if lines > 0 {
+		return FormatProcfile
+	}
+	return ""
+}
+
+// Parse reads the daemons defined in data (read from filename, which is
+// used to name systemd services). An empty format is detected.
+func Parse(format, filename string, data []byte) (*Result, error) {
+	if format == "" {
+		format = Detect(filename, data)
+		if format == "" {
+			return nil, fmt.Errorf("importer: unknown format (use one of %s)", strings.Join(Formats, ", "))
+		}
+	}
+	r := &Result{Format: format, Daemons: make([]*Daemon, 0), Warnings: make([]string, 0)}
+	var err error
+	switch format {
+	case FormatSupervisord:
+		err = parseSupervisord(r, filename, data)
+	case FormatProcfile:
+		err = parseProcfile(r, data)
+	case FormatSystemd:
+		err = parseSystemd(r, filename, data)
+	default:
+		return nil, fmt.Errorf("importer: unknown format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Daemons) == 0 {
+		return nil, fmt.Errorf("importer: no daemons found in %s file", format)
+	}
+	return r, nil
+}
+
+// parseProcfile reads "name: command" lines. Commands are run by a shell
+// (like on Heroku) when they use shell syntax.
+func parseProcfile(r *Result, data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := procfileLine.FindStringSubmatch(line)
+		if m == nil {
+			return fmt.Errorf("importer: line %d: expected \"name: command\"", n)
+		}
+		name, cmd := m[1], strings.TrimSpace(m[2])
+		if name == "release" {
+			r.warn(name, "release commands run once per deploy, skipped")
+			continue
+		}
+		d := &hades.Daemon{Name: name, Cmd: shellCommand(cmd)}
+		if strings.Contains(cmd, "$PORT") || strings.Contains(cmd, "${PORT}") {
+			r.warn(name, "uses $PORT, set a port so hades provides it")
+		}
+		r.Daemons = append(r.Daemons, &Daemon{Daemon: d})
+	}
+	return scanner.Err()
+}
+
+// characters that need a shell to run a command
+const shellChars = "$|&;<>`*?(){}~"
+
+// shellCommand wraps cmd to run with sh -c if it uses shell syntax.
+func shellCommand(cmd string) string {
+	if !strings.ContainsAny(cmd, shellChars) {
+		return cmd
+	}
+	return runInShell(cmd)
+}
+
+// runInShell returns a command running cmd with sh -c.
+func runInShell(cmd string) string {
+	return "sh -c '" + strings.Replace(cmd, "'", `'\''`, -1) + "'"
+}
+
+// section represents a section of an INI style file.
+type section struct {
+	name    string
+	entries []*entry
+}
+
+// entry represents a single setting of a section.
+type entry struct {
+	key   string
+	value string
+}
+
+// parseINI reads the sections of an INI style file. supervisord continues
+// values on indented lines and allows inline " ;" comments, systemd
+// continues lines ending with a backslash.
+func parseINI(data []byte, systemd bool) ([]*section, error) {
+	sections := make([]*section, 0)
+	var cur *section
+	var last *entry
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		raw := lines[i]
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			if !systemd {
+				last = nil
+			}
+			continue
+		}
+		if !systemd && last != nil && (raw[0] == ' ' || raw[0] == '\t') {
+			last.value += "\n" + stripInlineComment(line)
+			continue
+		}
+		if systemd {
+			for strings.HasSuffix(line, `\`) && i+1 < len(lines) {
+				i++
+				line = strings.TrimSpace(strings.TrimSuffix(line, `\`)) + " " + strings.TrimSpace(lines[i])
+			}
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("importer: line %d: invalid section header", i+1)
+			}
+			cur = &section{name: strings.TrimSpace(line[1 : len(line)-1])}
+			sections = append(sections, cur)
+			last = nil
+			continue
+		}
+		sep := strings.IndexAny(line, "=:")
+		if systemd {
+			sep = strings.Index(line, "=")
+		}
+		if sep < 0 {
+			return nil, fmt.Errorf("importer: line %d: expected \"key=value\"", i+1)
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("importer: line %d: setting outside of a section", i+1)
+		}
+		value := strings.TrimSpace(line[sep+1:])
+		if !systemd {
+			value = stripInlineComment(value)
+		}
+		last = &entry{key: strings.TrimSpace(line[:sep]), value: value}
+		cur.entries = append(cur.entries, last)
+	}
+	return sections, nil
+}
+
+// stripInlineComment removes a supervisord inline comment (" ;") from s.
+func stripInlineComment(s string) string {
+	i := strings.Index(s, " ;")
+	if i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// parseBool reads a boolean setting.
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", s)
+}
+
+// seconds reads a number of seconds.
+func seconds(s string) (hades.Duration, error) {
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number of seconds %q", s)
+	}
+	return hades.Duration(n * float64(time.Second)), nil
+}
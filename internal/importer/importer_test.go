@@ -0,0 +1,423 @@
+package importer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// importTest is a file and what it's expected to import as.
+type importTest struct {
+	filename string
+	data     string
+	daemons  []*Daemon
+	warnings []string
+}
+
+// run parses test in format and compares the result.
+func (test *importTest) run(t *testing.T, format string) {
+	r, err := Parse(format, test.filename, []byte(test.data))
+	if err != nil {
+		t.Errorf("Parse(%q): %s", test.data, err)
+		return
+	}
+	if len(r.Daemons) != len(test.daemons) {
+		t.Errorf("Parse(%q): %d daemons, expected %d", test.data, len(r.Daemons), len(test.daemons))
+		return
+	}
+	for i, d := range r.Daemons {
+		want := test.daemons[i]
+		if d.Start != want.Start || !reflect.DeepEqual(d.Daemon, want.Daemon) {
+			t.Errorf("Parse(%q) daemon %d:\n got %+v start=%t\nwant %+v start=%t", test.data, i, d.Daemon, d.Start, want.Daemon, want.Start)
+		}
+	}
+	warnings := test.warnings
+	if warnings == nil {
+		warnings = []string{}
+	}
+	if !reflect.DeepEqual(r.Warnings, warnings) {
+		t.Errorf("Parse(%q) warnings:\n got %q\nwant %q", test.data, r.Warnings, warnings)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		filename string
+		data     string
+		want     string
+	}{
+		{"web.service", "", FormatSystemd},
+		{"/etc/Procfile.dev", "", FormatProcfile},
+		{"app.conf", "[program:web]\ncommand=x", FormatSupervisord},
+		{"unit", "[Unit]\n[Service]\nExecStart=x", FormatSystemd},
+		{"procs", "# comment\nweb: ./server\n\nworker: ./worker", FormatProcfile},
+		{"notes.txt", "web: ./server\nnot a process", ""},
+		{"empty", "\n# nothing\n", ""},
+	}
+	for _, test := range tests {
+		got := Detect(test.filename, []byte(test.data))
+		if got != test.want {
+			t.Errorf("Detect(%q, %q) = %q, expected %q", test.filename, test.data, got, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+		err    string
+	}{
+		{"", "just some text", "unknown format"},
+		{"ini", "a=b", "unknown format"},
+		{FormatProcfile, "# nothing", "no daemons"},
+		{FormatProcfile, "web ./server", "line 1"},
+		{FormatSupervisord, "[program:web]\nautostart=false", "missing command"},
+		{FormatSupervisord, "[program:web]\ncommand=x\nautostart=maybe", "autostart"},
+		{FormatSupervisord, "[program:web]\ncommand=x\nnumprocs=0", "numprocs"},
+		{FormatSupervisord, "[program:web]\ncommand=x\nenvironment=A=\"1", "unterminated quote"},
+		{FormatSupervisord, "[program:web]\ncommand=x\nenvironment=A=1,B", "invalid variable"},
+		{FormatSupervisord, "[program:web\ncommand=x", "invalid section header"},
+		{FormatSupervisord, "command=x", "outside of a section"},
+		{FormatSystemd, "[Service]\nType=simple", "missing ExecStart"},
+		{FormatSystemd, "[Service]\nExecStart=x\nRestartSec=soon", "RestartSec"},
+		{FormatSystemd, "[Service]\nExecStart=x\nIOSchedulingClass=fast", "invalid class"},
+		{FormatSystemd, "[Service]\nExecStart=x\nEnvironment=A", "invalid variable"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.format, "web", []byte(test.data))
+		if err == nil {
+			t.Errorf("Parse(%q, %q) succeeded, expected an error", test.format, test.data)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Parse(%q, %q): error %q doesn't mention %q", test.format, test.data, err, test.err)
+		}
+	}
+}
+
+func TestProcfile(t *testing.T) {
+	tests := []*importTest{
+		{
+			data: "web: ./server -p 8080\n# comment\n\nworker:  bundle exec sidekiq  ",
+			daemons: []*Daemon{
+				{Daemon: &hades.Daemon{Name: "web", Cmd: "./server -p 8080"}},
+				{Daemon: &hades.Daemon{Name: "worker", Cmd: "bundle exec sidekiq"}},
+			},
+		},
+		{
+			data: "web: ./server -p $PORT\nclock: echo 'it''s' && ./clock\nrelease: ./migrate",
+			daemons: []*Daemon{
+				{Daemon: &hades.Daemon{Name: "web", Cmd: "sh -c './server -p $PORT'"}},
+				{Daemon: &hades.Daemon{Name: "clock", Cmd: `sh -c 'echo '\''it'\'''\''s'\'' && ./clock'`}},
+			},
+			warnings: []string{
+				"web: uses $PORT, set a port so hades provides it",
+				"release: release commands run once per deploy, skipped",
+			},
+		},
+	}
+	for _, test := range tests {
+		test.run(t, FormatProcfile)
+	}
+}
+
+func TestSupervisord(t *testing.T) {
+	tests := []*importTest{
+		{
+			data: "[program:web]\ncommand=/usr/bin/server --name %(program_name)s\n",
+			daemons: []*Daemon{{
+				Daemon: &hades.Daemon{
+					Name:    "web",
+					Cmd:     "/usr/bin/server --name web",
+					Restart: hades.RestartPolicy{Policy: hades.RestartOnFailure},
+				},
+				Start: true,
+			}},
+		},
+		{
+			data: `[supervisord]
+logfile=/var/log/supervisord.log
+
+[program:worker]
+command=./worker ; inline comment
+  --verbose
+directory=/srv/app
+environment=A="1",B='two, three',C=4
+user=app
+autostart=false
+autorestart=true
+stopsignal=term
+stopwaitsecs=2.5
+exitcodes=0,2
+stdout_logfile=/var/log/worker.log
+priority=10
+
+[program:once]
+command=./once
+autorestart=false
+`,
+			daemons: []*Daemon{
+				{Daemon: &hades.Daemon{
+					Name:        "worker",
+					Cmd:         "./worker\n--verbose",
+					Dir:         "/srv/app",
+					Env:         hades.Environment{Vars: []string{"A=1", "B=two, three", "C=4"}},
+					User:        "app",
+					Restart:     hades.RestartPolicy{Policy: hades.RestartAlways},
+					StopSignal:  "TERM",
+					StopTimeout: hades.Duration(2500 * time.Millisecond),
+				}},
+				{
+					Daemon: &hades.Daemon{
+						Name:    "once",
+						Cmd:     "./once",
+						Restart: hades.RestartPolicy{Policy: hades.RestartNever},
+					},
+					Start: true,
+				},
+			},
+			warnings: []string{
+				"[supervisord] section ignored",
+				"worker: exitcodes 0,2 not supported (only 0 is a successful exit)",
+				"worker: stdout_logfile ignored (output is kept in hades logs)",
+				"worker: priority not supported",
+			},
+		},
+		{
+			data: `[program:queue]
+command=./queue --id %(process_num)02d
+process_name=%(program_name)s_%(process_num)s
+numprocs=3
+numprocs_start=1
+autorestart=unexpected
+`,
+			daemons: []*Daemon{{
+				Daemon: &hades.Daemon{
+					Name:     "queue",
+					Cmd:      "./queue --id %(process_num)02d",
+					Replicas: 3,
+					Restart:  hades.RestartPolicy{Policy: hades.RestartOnFailure},
+				},
+				Start: true,
+			}},
+			warnings: []string{
+				"queue: command uses %(process_num)02d, use $HADES_INSTANCE instead",
+				"queue: numprocs_start ignored (instances are numbered from 0 in $HADES_INSTANCE)",
+			},
+		},
+		{
+			data: "[program:one]\ncommand=./one %(process_num)02d %(host_node_name)s\nprocess_name=one_%(process_num)s\n",
+			daemons: []*Daemon{{
+				Daemon: &hades.Daemon{
+					Name:    "one",
+					Cmd:     "./one 00 %(host_node_name)s",
+					Restart: hades.RestartPolicy{Policy: hades.RestartOnFailure},
+				},
+				Start: true,
+			}},
+			warnings: []string{
+				"one: command uses %(host_node_name)s which can't be expanded",
+				"one: process_name ignored",
+			},
+		},
+	}
+	for _, test := range tests {
+		test.run(t, FormatSupervisord)
+	}
+}
+
+func TestSupervisordEnv(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", []string{}},
+		{"A=1", []string{"A=1"}},
+		{`A="x,y",B='"q"', C=3,`, []string{"A=x,y", `B="q"`, "C=3"}},
+		{"A=1\nB=2", []string{"A=1", "B=2"}},
+		{`PATH="/bin:/usr/bin"`, []string{"PATH=/bin:/usr/bin"}},
+	}
+	for _, test := range tests {
+		got, err := parseSupervisordEnv(test.s)
+		if err != nil {
+			t.Errorf("parseSupervisordEnv(%q): %s", test.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseSupervisordEnv(%q) = %q, expected %q", test.s, got, test.want)
+		}
+	}
+}
+
+func TestSystemd(t *testing.T) {
+	tests := []*importTest{
+		{
+			filename: "/etc/systemd/system/web.service",
+			data: `[Unit]
+Description=Web server
+After=network.target
+Documentation=https://example.com
+
+[Service]
+Type=simple
+ExecStart=/usr/bin/server \
+  --port 8080
+WorkingDirectory=-/srv/web
+Environment=A=1 "B=two words"
+Environment=C=3
+EnvironmentFile=-/etc/default/web
+User=www
+Group=www
+SupplementaryGroups=ssl-cert adm
+Restart=on-failure
+RestartSec=5
+StartLimitBurst=3
+StartLimitIntervalSec=1min 30s
+KillSignal=SIGINT
+TimeoutStopSec=20s
+LimitNOFILE=65536
+Nice=5
+OOMScoreAdjust=-100
+CPUAffinity=0 1,2
+IOSchedulingPriority=7
+MemoryMax=512M
+CPUQuota=150%
+TasksMax=64
+
+[Install]
+WantedBy=multi-user.target
+`,
+			daemons: []*Daemon{{
+				Daemon: &hades.Daemon{
+					Name:        "web",
+					Description: "Web server",
+					Cmd:         "/usr/bin/server --port 8080",
+					Dir:         "/srv/web",
+					Env: hades.Environment{
+						File: "/etc/default/web",
+						Vars: []string{"A=1", "B=two words", "C=3"},
+					},
+					User:   "www",
+					Group:  "www",
+					Groups: []string{"ssl-cert", "adm"},
+					Restart: hades.RestartPolicy{
+						Policy:      hades.RestartOnFailure,
+						MaxRestarts: 3,
+						Window:      hades.Duration(90 * time.Second),
+						BackoffMin:  hades.Duration(5 * time.Second),
+						BackoffMax:  hades.Duration(5 * time.Second),
+					},
+					StopSignal:  "INT",
+					StopTimeout: hades.Duration(20 * time.Second),
+					Limits: hades.Limits{
+						NoFile:      "65536",
+						Nice:        5,
+						OOMScoreAdj: -100,
+						CPUAffinity: "0,1,2",
+						IOPriority:  "be:7",
+					},
+					Cgroup: hades.CgroupLimits{MemoryMax: "512M", CPUMax: "1.5", PidsMax: "64"},
+				},
+				Start: true,
+			}},
+			warnings: []string{
+				"web: After=network.target not imported (set dependencies on hades daemons instead)",
+			},
+		},
+		{
+			filename: "worker@.service",
+			data: `[Unit]
+Description=Worker %i
+
+[Service]
+Type=notify
+ExecStart=-/usr/bin/worker --name %p --unit %n --home $HOME
+ExecStart=/usr/bin/other
+Restart=on-abort
+IOSchedulingClass=idle
+IOSchedulingPriority=3
+TasksMax=10%
+StandardOutput=journal
+ProtectSystem=strict
+
+[X-Extra]
+Key=value
+`,
+			daemons: []*Daemon{{
+				Daemon: &hades.Daemon{
+					Name:        "worker",
+					Description: "Worker %i",
+					Cmd:         "sh -c '/usr/bin/worker --name worker --unit worker@.service --home $HOME'",
+					Restart:     hades.RestartPolicy{Policy: hades.RestartOnFailure},
+					Limits:      hades.Limits{IOPriority: "idle"},
+				},
+			}},
+			warnings: []string{
+				"worker: template unit imported without an instance",
+				"worker: Description uses specifier %i which can't be expanded",
+				"worker: Type=notify readiness notifications not supported (add a health check)",
+				`worker: ExecStart prefix "-" ignored`,
+				"worker: ExecStart runs with sh -c to expand variables",
+				"worker: only the first ExecStart is imported",
+				"worker: Restart=on-abort imported as on-failure",
+				"worker: TasksMax=10% not supported (needs a number)",
+				"worker: StandardOutput ignored (output is kept in hades logs)",
+				"worker: ProtectSystem not supported",
+				"worker: [X-Extra] section ignored",
+			},
+		},
+		{
+			// an empty ExecStart resets earlier ones (like in drop-ins)
+			filename: "app@blue.service",
+			data:     "[Service]\nExecStart=/bin/old\nExecStart=\nExecStart=/bin/new\nMemoryMax=infinity\n",
+			daemons: []*Daemon{{
+				Daemon: &hades.Daemon{
+					Name:    "app-blue",
+					Cmd:     "/bin/new",
+					Restart: hades.RestartPolicy{Policy: hades.RestartNever},
+				},
+			}},
+		},
+	}
+	for _, test := range tests {
+		test.run(t, FormatSystemd)
+	}
+}
+
+func TestParseTimespan(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+	}{
+		{"90", 90 * time.Second},
+		{"0.5", 500 * time.Millisecond},
+		{"infinity", 0},
+		{"5s", 5 * time.Second},
+		{"250ms", 250 * time.Millisecond},
+		{"1min 30s", 90 * time.Second},
+		{"2h30min", 150 * time.Minute},
+		{"1 day", 24 * time.Hour},
+		{"1.5hours", 90 * time.Minute},
+		{"10us", 10 * time.Microsecond},
+	}
+	for _, test := range tests {
+		got, err := parseTimespan(test.s)
+		if err != nil {
+			t.Errorf("parseTimespan(%q): %s", test.s, err)
+			continue
+		}
+		if time.Duration(got) != test.want {
+			t.Errorf("parseTimespan(%q) = %s, expected %s", test.s, time.Duration(got), test.want)
+		}
+	}
+	for _, s := range []string{"soon", "5 fortnights", "s", "1..5s"} {
+		_, err := parseTimespan(s)
+		if err == nil {
+			t.Errorf("parseTimespan(%q) succeeded, expected an error", s)
+		}
+	}
+}
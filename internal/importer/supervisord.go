@@ -0,0 +1,200 @@
+package importer
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// supervisord settings about output logs (hades captures output itself).
+var supervisordLogKeys = map[string]bool{
+	"redirect_stderr":         true,
+	"stdout_logfile":          true,
+	"stdout_logfile_maxbytes": true,
+	"stdout_logfile_backups":  true,
+	"stdout_capture_maxbytes": true,
+	"stdout_events_enabled":   true,
+	"stdout_syslog":           true,
+	"stderr_logfile":          true,
+	"stderr_logfile_maxbytes": true,
+	"stderr_logfile_backups":  true,
+	"stderr_capture_maxbytes": true,
+	"stderr_events_enabled":   true,
+	"stderr_syslog":           true,
+}
+
+// supervisord expansions like %(program_name)s
+var supervisordExpansion = regexp.MustCompile(`%\(([A-Za-z_]+)\)([-#0 +]*[0-9]*[sd])`)
+
+// parseSupervisord reads the [program:x] sections of a supervisord config.
+func parseSupervisord(r *Result, filename string, data []byte) error {
+	sections, err := parseINI(data, false)
+	if err != nil {
+		return err
+	}
+	for _, sec := range sections {
+		if !strings.HasPrefix(sec.name, "program:") {
+			r.warn("", "[%s] section ignored", sec.name)
+			continue
+		}
+		name := strings.TrimSpace(strings.TrimPrefix(sec.name, "program:"))
+		err = parseProgram(r, name, filename, sec)
+		if err != nil {
+			return fmt.Errorf("importer: [%s]: %s", sec.name, err)
+		}
+	}
+	return nil
+}
+
+// parseProgram reads a single supervisord program.
+func parseProgram(r *Result, name, filename string, sec *section) error {
+	d := &hades.Daemon{Name: name}
+	// supervisord defaults
+	d.Restart.Policy = hades.RestartOnFailure
+	start := true
+	for _, e := range sec.entries {
+		if e.key == "numprocs" {
+			n, err := strconv.Atoi(e.value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid numprocs %q", e.value)
+			}
+			if n > 1 {
+				d.Replicas = n
+			}
+		}
+	}
+	expand := func(key, s string) string {
+		return supervisordExpansion.ReplaceAllStringFunc(s, func(m string) string {
+			sub := supervisordExpansion.FindStringSubmatch(m)
+			switch sub[1] {
+			case "program_name", "group_name":
+				return name
+			case "process_num":
+				if d.Replicas > 0 {
+					r.warn(name, "%s uses %s, use $HADES_INSTANCE instead", key, m)
+					return m
+				}
+				if strings.HasSuffix(sub[2], "d") {
+					return fmt.Sprintf("%"+sub[2], 0)
+				}
+				return "0"
+			case "here":
+				if filename != "" {
+					dir, err := filepath.Abs(filepath.Dir(filename))
+					if err == nil {
+						return dir
+					}
+				}
+			}
+			r.warn(name, "%s uses %s which can't be expanded", key, m)
+			return m
+		})
+	}
+	for _, e := range sec.entries {
+		value := e.value
+		switch e.key {
+		case "command", "directory", "environment", "user":
+			value = expand(e.key, value)
+		}
+		var err error
+		switch {
+		case e.key == "command":
+			d.Cmd = value
+		case e.key == "directory":
+			d.Dir = value
+		case e.key == "environment":
+			d.Env.Vars, err = parseSupervisordEnv(value)
+		case e.key == "user":
+			d.User = value
+		case e.key == "autostart":
+			start, err = parseBool(value)
+		case e.key == "autorestart":
+			switch strings.ToLower(value) {
+			case "unexpected":
+				d.Restart.Policy = hades.RestartOnFailure
+			default:
+				var b bool
+				b, err = parseBool(value)
+				d.Restart.Policy = hades.RestartNever
+				if b {
+					d.Restart.Policy = hades.RestartAlways
+				}
+			}
+		case e.key == "exitcodes":
+			if value != "0" {
+				r.warn(name, "exitcodes %s not supported (only 0 is a successful exit)", value)
+			}
+		case e.key == "stopsignal":
+			d.StopSignal = strings.ToUpper(value)
+		case e.key == "stopwaitsecs":
+			d.StopTimeout, err = seconds(value)
+		case e.key == "numprocs":
+		case e.key == "process_name":
+			if d.Replicas == 0 && value != "%(program_name)s" {
+				r.warn(name, "process_name ignored")
+			}
+		case e.key == "numprocs_start":
+			r.warn(name, "numprocs_start ignored (instances are numbered from 0 in $HADES_INSTANCE)")
+		case supervisordLogKeys[e.key]:
+			r.warn(name, "%s ignored (output is kept in hades logs)", e.key)
+		default:
+			r.warn(name, "%s not supported", e.key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", e.key, err)
+		}
+	}
+	if d.Cmd == "" {
+		return fmt.Errorf("missing command")
+	}
+	r.Daemons = append(r.Daemons, &Daemon{Daemon: d, Start: start})
+	return nil
+}
+
+// parseSupervisordEnv reads an environment setting like
+// A="1",B='two',C=3.
+func parseSupervisordEnv(s string) ([]string, error) {
+	vars := make([]string, 0)
+	var b strings.Builder
+	quote := rune(0)
+	flush := func() error {
+		kv := strings.TrimSpace(b.String())
+		b.Reset()
+		if kv == "" {
+			return nil
+		}
+		if !strings.Contains(kv, "=") {
+			return fmt.Errorf("invalid variable %q", kv)
+		}
+		vars = append(vars, kv)
+		return nil
+	}
+	for _, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				b.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',' || c == '\n':
+			err := flush()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			b.WriteRune(c)
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	err := flush()
+	return vars, err
+}
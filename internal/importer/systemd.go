@@ -0,0 +1,291 @@
+package importer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/wybiral/hades/pkg/hades"
+)
+
+// systemd resource limits by setting.
+var systemdLimits = map[string]func(l *hades.Limits, v string){
+	"LimitNOFILE": func(l *hades.Limits, v string) { l.NoFile = v },
+	"LimitCORE":   func(l *hades.Limits, v string) { l.Core = v },
+	"LimitAS":     func(l *hades.Limits, v string) { l.AddressSpace = v },
+	"LimitNPROC":  func(l *hades.Limits, v string) { l.NProc = v },
+}
+
+// systemd I/O scheduling classes.
+var systemdIOClasses = map[string]string{
+	"realtime":    "rt",
+	"best-effort": "be",
+	"idle":        "idle",
+}
+
+// systemd time span units.
+var systemdTimeUnits = map[string]time.Duration{
+	"us": time.Microsecond, "usec": time.Microsecond,
+	"ms": time.Millisecond, "msec": time.Millisecond,
+	"s": time.Second, "sec": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+}
+
+// systemd settings that don't affect how a daemon runs.
+var systemdIgnored = map[string]bool{
+	"Documentation": true,
+	"Alias":         true,
+	"Also":          true,
+}
+
+// parseSystemd reads a systemd service unit (named after filename).
+func parseSystemd(r *Result, filename string, data []byte) error {
+	sections, err := parseINI(data, true)
+	if err != nil {
+		return err
+	}
+	unit := filepath.Base(filename)
+	name := strings.TrimSuffix(unit, ".service")
+	if strings.HasSuffix(name, "@") {
+		name = strings.TrimSuffix(name, "@")
+		r.warn(name, "template unit imported without an instance")
+	}
+	name = strings.Replace(name, "@", "-", -1)
+	if name == "" || name == "." {
+		name = "service"
+		r.warn(name, "no unit file name, named %q", name)
+	}
+	d := &hades.Daemon{Name: name}
+	// systemd defaults
+	d.Restart.Policy = hades.RestartNever
+	start := false
+	ioClass, ioLevel := "", ""
+	expand := func(key, s string) string {
+		if !strings.Contains(s, "%") {
+			return s
+		}
+		var b strings.Builder
+		for i := 0; i < len(s); i++ {
+			if s[i] != '%' || i+1 == len(s) {
+				b.WriteByte(s[i])
+				continue
+			}
+			i++
+			switch s[i] {
+			case '%':
+				b.WriteByte('%')
+			case 'n':
+				b.WriteString(unit)
+			case 'N', 'p':
+				b.WriteString(name)
+			default:
+				r.warn(name, "%s uses specifier %%%c which can't be expanded", key, s[i])
+				b.WriteByte('%')
+				b.WriteByte(s[i])
+			}
+		}
+		return b.String()
+	}
+	for _, sec := range sections {
+		switch sec.name {
+		case "Unit", "Service", "Install":
+		default:
+			r.warn(name, "[%s] section ignored", sec.name)
+			continue
+		}
+		for _, e := range sec.entries {
+			value := expand(e.key, e.value)
+			err := applySystemd(r, d, sec.name, e.key, value, &start, &ioClass, &ioLevel)
+			if err != nil {
+				return fmt.Errorf("importer: %s: %s", e.key, err)
+			}
+		}
+	}
+	if ioClass != "" || ioLevel != "" {
+		if ioClass == "" {
+			ioClass = "be"
+		}
+		d.Limits.IOPriority = ioClass
+		if ioLevel != "" && ioClass != "idle" {
+			d.Limits.IOPriority += ":" + ioLevel
+		}
+	}
+	if d.Restart.BackoffMin > 0 {
+		// systemd waits the same time before every restart
+		d.Restart.BackoffMax = d.Restart.BackoffMin
+	}
+	if d.Cmd == "" {
+		return fmt.Errorf("importer: missing ExecStart")
+	}
+	r.Daemons = append(r.Daemons, &Daemon{Daemon: d, Start: start})
+	return nil
+}
+
+// applySystemd applies a single setting of section sec to d.
+func applySystemd(r *Result, d *hades.Daemon, sec, key, value string, start *bool, ioClass, ioLevel *string) error {
+	name := d.Name
+	var err error
+	switch {
+	case key == "Description":
+		d.Description = value
+	case key == "After" || key == "Before" || key == "Requires" || key == "Wants" || key == "BindsTo" || key == "PartOf":
+		r.warn(name, "%s=%s not imported (set dependencies on hades daemons instead)", key, value)
+	case key == "StartLimitBurst":
+		d.Restart.MaxRestarts, err = strconv.Atoi(value)
+	case key == "StartLimitIntervalSec" || key == "StartLimitInterval":
+		d.Restart.Window, err = parseTimespan(value)
+	case key == "Type":
+		switch value {
+		case "simple", "exec":
+		case "notify", "notify-reload":
+			r.warn(name, "Type=%s readiness notifications not supported (add a health check)", value)
+		case "forking":
+			r.warn(name, "Type=forking, the command must stay in the foreground under hades")
+		case "oneshot":
+			r.warn(name, "Type=oneshot imported as a daemon (consider a scheduled job)")
+		default:
+			r.warn(name, "Type=%s not supported", value)
+		}
+	case key == "ExecStart":
+		if value == "" {
+			d.Cmd = ""
+			break
+		}
+		if d.Cmd != "" {
+			r.warn(name, "only the first ExecStart is imported")
+			break
+		}
+		cmd := strings.TrimLeft(value, "-@:+!")
+		if cmd != value {
+			r.warn(name, "ExecStart prefix %q ignored", value[:len(value)-len(cmd)])
+		}
+		d.Cmd = strings.TrimSpace(cmd)
+		if strings.Contains(d.Cmd, "$") {
+			r.warn(name, "ExecStart runs with sh -c to expand variables")
+			d.Cmd = runInShell(d.Cmd)
+		}
+	case key == "WorkingDirectory":
+		d.Dir = strings.TrimPrefix(value, "-")
+	case key == "Environment":
+		var vars []string
+		vars, err = shlex.Split(value)
+		for _, kv := range vars {
+			if !strings.Contains(kv, "=") {
+				return fmt.Errorf("invalid variable %q", kv)
+			}
+		}
+		d.Env.Vars = append(d.Env.Vars, vars...)
+	case key == "EnvironmentFile":
+		if d.Env.File != "" {
+			r.warn(name, "only the first EnvironmentFile is imported")
+			break
+		}
+		d.Env.File = strings.TrimPrefix(value, "-")
+	case key == "User":
+		d.User = value
+	case key == "Group":
+		d.Group = value
+	case key == "SupplementaryGroups":
+		d.Groups = append(d.Groups, strings.Fields(value)...)
+	case key == "Restart":
+		switch value {
+		case "no":
+			d.Restart.Policy = hades.RestartNever
+		case "always":
+			d.Restart.Policy = hades.RestartAlways
+		case "on-failure":
+			d.Restart.Policy = hades.RestartOnFailure
+		case "on-abnormal", "on-abort", "on-watchdog":
+			d.Restart.Policy = hades.RestartOnFailure
+			r.warn(name, "Restart=%s imported as on-failure", value)
+		default:
+			r.warn(name, "Restart=%s not supported", value)
+		}
+	case key == "RestartSec":
+		d.Restart.BackoffMin, err = parseTimespan(value)
+	case key == "KillSignal":
+		d.StopSignal = strings.TrimPrefix(strings.ToUpper(value), "SIG")
+	case key == "TimeoutStopSec" || key == "TimeoutSec":
+		d.StopTimeout, err = parseTimespan(value)
+	case systemdLimits[key] != nil:
+		systemdLimits[key](&d.Limits, value)
+	case key == "Nice":
+		d.Limits.Nice, err = strconv.Atoi(value)
+	case key == "OOMScoreAdjust":
+		d.Limits.OOMScoreAdj, err = strconv.Atoi(value)
+	case key == "CPUAffinity":
+		d.Limits.CPUAffinity = strings.Join(strings.Fields(strings.Replace(value, ",", " ", -1)), ",")
+	case key == "IOSchedulingClass":
+		c, ok := systemdIOClasses[value]
+		if !ok {
+			return fmt.Errorf("invalid class %q", value)
+		}
+		*ioClass = c
+	case key == "IOSchedulingPriority":
+		*ioLevel = value
+	case key == "MemoryMax" || key == "MemoryLimit":
+		if value != "infinity" {
+			d.Cgroup.MemoryMax = value
+		}
+	case key == "CPUQuota":
+		var pct float64
+		pct, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err == nil {
+			d.Cgroup.CPUMax = strconv.FormatFloat(pct/100, 'f', -1, 64)
+		}
+	case key == "TasksMax":
+		switch {
+		case value == "infinity":
+		case strings.HasSuffix(value, "%"):
+			r.warn(name, "TasksMax=%s not supported (needs a number)", value)
+		default:
+			d.Cgroup.PidsMax = value
+		}
+	case key == "StandardOutput" || key == "StandardError":
+		r.warn(name, "%s ignored (output is kept in hades logs)", key)
+	case sec == "Install" && (key == "WantedBy" || key == "RequiredBy"):
+		*start = true
+	case systemdIgnored[key]:
+	default:
+		r.warn(name, "%s not supported", key)
+	}
+	return err
+}
+
+// parseTimespan reads a systemd time span like "90", "5s" or "1min 30s".
+func parseTimespan(s string) (hades.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "infinity" {
+		return 0, nil
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err == nil {
+		// plain numbers are seconds
+		return hades.Duration(n * float64(time.Second)), nil
+	}
+	var total time.Duration
+	rest := strings.Replace(s, " ", "", -1)
+	for rest != "" {
+		i := 0
+		for i < len(rest) && (rest[i] >= '0' && rest[i] <= '9' || rest[i] == '.') {
+			i++
+		}
+		j := i
+		for j < len(rest) && (rest[j] < '0' || rest[j] > '9') && rest[j] != '.' {
+			j++
+		}
+		n, err := strconv.ParseFloat(rest[:i], 64)
+		unit, ok := systemdTimeUnits[rest[i:j]]
+		if err != nil || !ok {
+			return 0, fmt.Errorf("invalid time span %q", s)
+		}
+		total += time.Duration(n * float64(unit))
+		rest = rest[j:]
+	}
+	return hades.Duration(total), nil
+}
@@ -0,0 +1,850 @@
+// Package yaml reads and writes the subset of YAML used by hades config
+// files: block mappings and sequences, flow collections, plain and quoted
+// scalars, literal/folded block scalars and comments (anchors, aliases, tags
+// and directives are rejected). Values convert to and from JSON so they can
+// be decoded into structs using their JSON tags.
+package yaml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Map is a mapping that keeps the order of its keys.
+type Map []Item
+
+// Item is a single key and value of a Map.
+type Item struct {
+	Key   string
+	Value interface{}
+}
+
+// Get returns the value of key in m.
+func (m Map) Get(key string) (interface{}, bool) {
+	for _, it := range m {
+		if it.Key == key {
+			return it.Value, true
+		}
+	}
+	return nil, false
+}
+
+var (
+	intPattern   = regexp.MustCompile(`^[-+]?[0-9]+$`)
+	floatPattern = regexp.MustCompile(`^[-+]?([0-9]+\.[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$|^[-+]?[0-9]+[eE][-+]?[0-9]+$`)
+)
+
+// line is a line of the document.
+type line struct {
+	num    int
+	indent int
+	// text is the line without indentation
+	text string
+}
+
+// parser reads a document line by line.
+type parser struct {
+	lines []*line
+	pos   int
+}
+
+// Unmarshal parses a YAML document into a Map, []interface{} or scalar
+// (string, int64, float64, bool or nil).
+func Unmarshal(data []byte) (interface{}, error) {
+	p := &parser{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, " \t\r")
+		text := strings.TrimLeft(raw, " ")
+		p.lines = append(p.lines, &line{num: i + 1, indent: len(raw) - len(text), text: text})
+	}
+	p.skip()
+	if p.pos < len(p.lines) && p.lines[p.pos].text == "---" {
+		p.pos++
+		p.skip()
+	}
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	v, err := p.parseBlock(p.lines[p.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+	p.skip()
+	if p.pos < len(p.lines) && p.lines[p.pos].text != "..." {
+		return nil, p.errorf(p.lines[p.pos], "unexpected indentation")
+	}
+	return v, nil
+}
+
+// errorf returns an error for line l.
+func (p *parser) errorf(l *line, format string, args ...interface{}) error {
+	return fmt.Errorf("yaml: line %d: %s", l.num, fmt.Sprintf(format, args...))
+}
+
+// skip moves past blank and comment lines.
+func (p *parser) skip() {
+	for p.pos < len(p.lines) {
+		t := p.lines[p.pos].text
+		if t != "" && !strings.HasPrefix(t, "#") {
+			return
+		}
+		p.pos++
+	}
+}
+
+// current returns the next content line (nil at the end of the document).
+func (p *parser) current() *line {
+	p.skip()
+	if p.pos >= len(p.lines) {
+		return nil
+	}
+	l := p.lines[p.pos]
+	if l.indent == 0 && l.text == "..." {
+		return nil
+	}
+	return l
+}
+
+// isSeqItem returns true if text starts a sequence item.
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// parseBlock parses the mapping, sequence or scalar starting at the current
+// line (indented by indent).
+func (p *parser) parseBlock(indent int) (interface{}, error) {
+	l := p.current()
+	if strings.HasPrefix(l.text, "\t") {
+		return nil, p.errorf(l, "tabs can't be used for indentation")
+	}
+	if isSeqItem(l.text) {
+		return p.parseSeq(indent)
+	}
+	_, _, ok, err := splitKey(stripComment(l.text))
+	if err != nil {
+		return nil, p.errorf(l, "%s", err)
+	}
+	if ok {
+		return p.parseMap(indent)
+	}
+	p.pos++
+	v, err := parseInline(stripComment(l.text))
+	if err != nil {
+		return nil, p.errorf(l, "%s", err)
+	}
+	return v, nil
+}
+
+// parseSeq parses a block sequence with items indented by indent.
+func (p *parser) parseSeq(indent int) (interface{}, error) {
+	seq := make([]interface{}, 0)
+	for {
+		l := p.current()
+		if l == nil || l.indent < indent {
+			return seq, nil
+		}
+		if l.indent > indent {
+			return nil, p.errorf(l, "unexpected indentation")
+		}
+		if !isSeqItem(l.text) {
+			return seq, nil
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			p.pos++
+			v, err := p.parseNested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+		// parse the rest of the line as if it started a nested block
+		offset := len(l.text) - len(rest)
+		p.lines[p.pos] = &line{num: l.num, indent: l.indent + offset, text: rest}
+		v, err := p.parseBlock(l.indent + offset)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+}
+
+// parseMap parses a block mapping with keys indented by indent.
+func (p *parser) parseMap(indent int) (interface{}, error) {
+	m := make(Map, 0)
+	seen := make(map[string]bool)
+	for {
+		l := p.current()
+		if l == nil || l.indent < indent {
+			return m, nil
+		}
+		if l.indent > indent {
+			return nil, p.errorf(l, "unexpected indentation")
+		}
+		if isSeqItem(l.text) {
+			return m, nil
+		}
+		if strings.HasPrefix(l.text, "\t") {
+			return nil, p.errorf(l, "tabs can't be used for indentation")
+		}
+		key, rest, ok, err := splitKey(stripComment(l.text))
+		if err != nil {
+			return nil, p.errorf(l, "%s", err)
+		}
+		if !ok {
+			return nil, p.errorf(l, "expected \"key: value\"")
+		}
+		if seen[key] {
+			return nil, p.errorf(l, "duplicate key %q", key)
+		}
+		seen[key] = true
+		p.pos++
+		var v interface{}
+		switch {
+		case rest == "":
+			v, err = p.parseNested(indent, true)
+		case strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">"):
+			v, err = p.parseBlockScalar(l, indent, rest)
+		default:
+			v, err = parseInline(rest)
+			if err != nil {
+				err = p.errorf(l, "%s", err)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, Item{key, v})
+	}
+}
+
+// parseNested parses the block value of a key or sequence item at indent
+// (nil if there is none). Sequences can be at the same indentation as the
+// key owning them.
+func (p *parser) parseNested(indent int, key bool) (interface{}, error) {
+	l := p.current()
+	if l == nil {
+		return nil, nil
+	}
+	if l.indent > indent {
+		return p.parseBlock(l.indent)
+	}
+	if key && l.indent == indent && isSeqItem(l.text) {
+		return p.parseSeq(indent)
+	}
+	return nil, nil
+}
+
+// parseBlockScalar parses a literal ("|") or folded (">") block scalar
+// following line l of a key indented by indent.
+func (p *parser) parseBlockScalar(l *line, indent int, header string) (interface{}, error) {
+	header = strings.TrimSpace(stripComment(header))
+	folded := header[0] == '>'
+	chomp := header[1:]
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, p.errorf(l, "unsupported block scalar header %q", header)
+	}
+	// raw lines (comments are content here)
+	lines := make([]string, 0)
+	blockIndent := -1
+	for p.pos < len(p.lines) {
+		next := p.lines[p.pos]
+		if next.text == "" {
+			lines = append(lines, "")
+			p.pos++
+			continue
+		}
+		if next.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = next.indent
+		}
+		if next.indent < blockIndent {
+			return nil, p.errorf(next, "bad block scalar indentation")
+		}
+		lines = append(lines, strings.Repeat(" ", next.indent-blockIndent)+next.text)
+		p.pos++
+	}
+	// trailing blank lines only matter for "+"
+	n := len(lines)
+	for n > 0 && lines[n-1] == "" {
+		n--
+	}
+	trailing := len(lines) - n
+	lines = lines[:n]
+	var s string
+	if folded {
+		var b strings.Builder
+		for i, ln := range lines {
+			if i > 0 {
+				prev := lines[i-1]
+				switch {
+				case strings.HasPrefix(ln, " ") || strings.HasPrefix(prev, " "):
+					// more indented lines aren't folded
+					b.WriteString("\n")
+				case ln == "":
+					// each empty line is a line break
+					b.WriteString("\n")
+				case prev == "":
+					// the break before empty lines is dropped
+				default:
+					b.WriteString(" ")
+				}
+			}
+			b.WriteString(ln)
+		}
+		s = b.String()
+	} else {
+		s = strings.Join(lines, "\n")
+	}
+	switch chomp {
+	case "":
+		if n > 0 {
+			s += "\n"
+		}
+	case "+":
+		s += strings.Repeat("\n", trailing+1)
+	}
+	return s, nil
+}
+
+// stripComment removes a trailing comment (outside quotes) from text.
+func stripComment(text string) string {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" [{,:", rune(text[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return strings.TrimRight(text[:i], " \t")
+		}
+	}
+	return text
+}
+
+// splitKey splits "key: value" into the key and value text. ok is false if
+// text isn't a mapping entry.
+func splitKey(text string) (key, rest string, ok bool, err error) {
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		end := quotedEnd(text)
+		if end < 0 {
+			return "", "", false, nil
+		}
+		after := text[end:]
+		if !strings.HasPrefix(after, ":") || (len(after) > 1 && after[1] != ' ') {
+			return "", "", false, nil
+		}
+		k, err := parseQuoted(text[:end])
+		if err != nil {
+			return "", "", false, err
+		}
+		return k, strings.TrimSpace(after[1:]), true, nil
+	}
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false, nil
+	}
+	i := strings.Index(text, ": ")
+	if i < 0 {
+		if !strings.HasSuffix(text, ":") {
+			return "", "", false, nil
+		}
+		i = len(text) - 1
+	}
+	key = strings.TrimSpace(text[:i])
+	if key == "" {
+		return "", "", false, nil
+	}
+	err = checkPlain(key)
+	if err != nil {
+		return "", "", false, err
+	}
+	return key, strings.TrimSpace(text[i+1:]), true, nil
+}
+
+// quotedEnd returns the index after the closing quote of the quoted string
+// starting text (-1 if unterminated).
+func quotedEnd(text string) int {
+	q := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case q == '"' && text[i] == '\\':
+			i++
+		case text[i] == q:
+			if q == '\'' && i+1 < len(text) && text[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// parseQuoted decodes a single or double quoted string.
+func parseQuoted(s string) (string, error) {
+	if s[0] == '\'' {
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	v, err := strconv.Unquote(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted string %s", s)
+	}
+	return v, nil
+}
+
+// parseInline parses a scalar or flow collection that makes up all of s.
+func parseInline(s string) (interface{}, error) {
+	f := &flow{s: s}
+	v, err := f.value(false)
+	if err != nil {
+		return nil, err
+	}
+	f.space()
+	if f.i < len(f.s) {
+		return nil, fmt.Errorf("unexpected %q", f.s[f.i:])
+	}
+	return v, nil
+}
+
+// flow parses inline values.
+type flow struct {
+	s string
+	i int
+}
+
+// space skips spaces.
+func (f *flow) space() {
+	for f.i < len(f.s) && (f.s[f.i] == ' ' || f.s[f.i] == '\t') {
+		f.i++
+	}
+}
+
+// value parses a value (inside a flow collection if nested).
+func (f *flow) value(nested bool) (interface{}, error) {
+	f.space()
+	if f.i >= len(f.s) {
+		return nil, nil
+	}
+	switch f.s[f.i] {
+	case '[':
+		return f.seq()
+	case '{':
+		return f.mapping()
+	case '"', '\'':
+		end := quotedEnd(f.s[f.i:])
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		v, err := parseQuoted(f.s[f.i : f.i+end])
+		f.i += end
+		return v, err
+	}
+	start := f.i
+	if nested {
+		for f.i < len(f.s) && !strings.ContainsRune(",]}", rune(f.s[f.i])) {
+			if f.s[f.i] == ':' && (f.i+1 == len(f.s) || f.s[f.i+1] == ' ') {
+				break
+			}
+			f.i++
+		}
+	} else {
+		f.i = len(f.s)
+	}
+	s := strings.TrimSpace(f.s[start:f.i])
+	err := checkPlain(s)
+	if err != nil {
+		return nil, err
+	}
+	return resolve(s), nil
+}
+
+// seq parses a flow sequence.
+func (f *flow) seq() (interface{}, error) {
+	f.i++
+	seq := make([]interface{}, 0)
+	for {
+		f.space()
+		if f.i < len(f.s) && f.s[f.i] == ']' {
+			f.i++
+			return seq, nil
+		}
+		v, err := f.value(true)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+		f.space()
+		if f.i >= len(f.s) {
+			return nil, fmt.Errorf("unterminated sequence")
+		}
+		switch f.s[f.i] {
+		case ',':
+			f.i++
+		case ']':
+		default:
+			return nil, fmt.Errorf("expected \",\" or \"]\"")
+		}
+	}
+}
+
+// mapping parses a flow mapping.
+func (f *flow) mapping() (interface{}, error) {
+	f.i++
+	m := make(Map, 0)
+	for {
+		f.space()
+		if f.i < len(f.s) && f.s[f.i] == '}' {
+			f.i++
+			return m, nil
+		}
+		k, err := f.value(true)
+		if err != nil {
+			return nil, err
+		}
+		f.space()
+		if f.i >= len(f.s) || f.s[f.i] != ':' {
+			return nil, fmt.Errorf("expected \":\" in mapping")
+		}
+		f.i++
+		v, err := f.value(true)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, Item{scalarString(k), v})
+		f.space()
+		if f.i >= len(f.s) {
+			return nil, fmt.Errorf("unterminated mapping")
+		}
+		switch f.s[f.i] {
+		case ',':
+			f.i++
+		case '}':
+		default:
+			return nil, fmt.Errorf("expected \",\" or \"}\"")
+		}
+	}
+}
+
+// checkPlain returns an error if plain scalar s starts with an indicator of
+// what this package doesn't support (anchors, aliases, tags, directives and
+// reserved indicators) instead of reading it as a string.
+func checkPlain(s string) error {
+	if s != "" && strings.ContainsRune("&*!%@`", rune(s[0])) {
+		return fmt.Errorf("unsupported %q (anchors, aliases, tags and directives can't be used)", s)
+	}
+	return nil
+}
+
+// resolve returns the value of plain scalar s.
+func resolve(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if intPattern.MatchString(s) {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err == nil {
+			return n
+		}
+	}
+	if floatPattern.MatchString(s) {
+		n, err := strconv.ParseFloat(s, 64)
+		if err == nil {
+			return n
+		}
+	}
+	return s
+}
+
+// scalarString returns scalar v as a string (for keys).
+func scalarString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	}
+	return fmt.Sprint(v)
+}
+
+// Marshal encodes v (a Map, []interface{} or scalar) as a YAML document.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	switch x := v.(type) {
+	case Map:
+		if len(x) == 0 {
+			buf.WriteString("{}\n")
+			break
+		}
+		err := writeMap(&buf, x, 0)
+		if err != nil {
+			return nil, err
+		}
+	case []interface{}:
+		if len(x) == 0 {
+			buf.WriteString("[]\n")
+			break
+		}
+		err := writeSeq(&buf, x, 0)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		s, err := scalar(v)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(s + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMap writes the entries of m indented by indent.
+func writeMap(w *bytes.Buffer, m Map, indent int) error {
+	pad := strings.Repeat(" ", indent)
+	for i, it := range m {
+		if i > 0 || w.Len() == 0 || w.Bytes()[w.Len()-1] == '\n' {
+			w.WriteString(pad)
+		}
+		w.WriteString(quoteIfNeeded(it.Key) + ":")
+		err := writeChild(w, it.Value, indent+2)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSeq writes the items of seq indented by indent.
+func writeSeq(w *bytes.Buffer, seq []interface{}, indent int) error {
+	pad := strings.Repeat(" ", indent)
+	for _, v := range seq {
+		w.WriteString(pad + "-")
+		if m, ok := v.(Map); ok && len(m) > 0 {
+			// first entry goes on the same line as the dash
+			w.WriteString(" ")
+			err := writeMap(w, m, indent+2)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err := writeChild(w, v, indent+2)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeChild writes value v after a key or dash, nesting collections at
+// indent.
+func writeChild(w *bytes.Buffer, v interface{}, indent int) error {
+	switch x := v.(type) {
+	case Map:
+		if len(x) == 0 {
+			w.WriteString(" {}\n")
+			return nil
+		}
+		w.WriteString("\n")
+		return writeMap(w, x, indent)
+	case []interface{}:
+		if len(x) == 0 {
+			w.WriteString(" []\n")
+			return nil
+		}
+		w.WriteString("\n")
+		return writeSeq(w, x, indent)
+	}
+	s, err := scalar(v)
+	if err != nil {
+		return err
+	}
+	w.WriteString(" " + s + "\n")
+	return nil
+}
+
+// scalar encodes a scalar value.
+func scalar(v interface{}) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return "null", nil
+	case bool:
+		return strconv.FormatBool(x), nil
+	case int:
+		return strconv.Itoa(x), nil
+	case int64:
+		return strconv.FormatInt(x, 10), nil
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64), nil
+	case json.Number:
+		return x.String(), nil
+	case string:
+		return quoteIfNeeded(x), nil
+	}
+	return "", fmt.Errorf("yaml: can't encode %T", v)
+}
+
+// quoteIfNeeded returns s as a plain scalar if it would be read back as the
+// same string, otherwise double quoted.
+func quoteIfNeeded(s string) string {
+	if s == "" || s != strings.TrimSpace(s) || strings.ContainsAny(s, "\n\r\t\"\\") {
+		return strconv.Quote(s)
+	}
+	if strings.ContainsRune("-?:,[]{}#&*!|>'%@`", rune(s[0])) {
+		return strconv.Quote(s)
+	}
+	if strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") {
+		return strconv.Quote(s)
+	}
+	if _, ok := resolve(s).(string); !ok {
+		return strconv.Quote(s)
+	}
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// FromJSON decodes JSON data into the values used by Marshal (keeping the
+// order of object keys).
+func FromJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	_, err = dec.Token()
+	if err != io.EOF {
+		return nil, fmt.Errorf("yaml: unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+// decodeJSON decodes the next JSON value from dec.
+func decodeJSON(dec *json.Decoder) (interface{}, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch x := t.(type) {
+	case json.Delim:
+		switch x {
+		case '{':
+			m := make(Map, 0)
+			for dec.More() {
+				k, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := decodeJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				m = append(m, Item{k.(string), v})
+			}
+			_, err = dec.Token()
+			return m, err
+		case '[':
+			seq := make([]interface{}, 0)
+			for dec.More() {
+				v, err := decodeJSON(dec)
+				if err != nil {
+					return nil, err
+				}
+				seq = append(seq, v)
+			}
+			_, err = dec.Token()
+			return seq, err
+		}
+		return nil, fmt.Errorf("yaml: unexpected %s in JSON", x)
+	}
+	return t, nil
+}
+
+// ToJSON encodes v (as returned by Unmarshal or FromJSON) as JSON.
+func ToJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeJSON(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeJSON writes v as JSON to w.
+func writeJSON(w *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case Map:
+		w.WriteByte('{')
+		for i, it := range x {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			k, _ := json.Marshal(it.Key)
+			w.Write(k)
+			w.WriteByte(':')
+			err := writeJSON(w, it.Value)
+			if err != nil {
+				return err
+			}
+		}
+		w.WriteByte('}')
+		return nil
+	case []interface{}:
+		w.WriteByte('[')
+		for i, item := range x {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			err := writeJSON(w, item)
+			if err != nil {
+				return err
+			}
+		}
+		w.WriteByte(']')
+		return nil
+	case map[string]interface{}:
+		// plain maps are written with sorted keys
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		m := make(Map, 0, len(x))
+		for _, k := range keys {
+			m = append(m, Item{k, x[k]})
+		}
+		return writeJSON(w, m)
+	}
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Write(enc)
+	return nil
+}
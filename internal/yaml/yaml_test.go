@@ -0,0 +1,172 @@
+package yaml
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	tests := []struct {
+		doc  string
+		json string
+	}{
+		{"", "null"},
+		{"# only a comment\n", "null"},
+		{"---\na: 1\n...\n", `{"a":1}`},
+		{"a: 1\nb: -2\nc: 1.5\nd: 1e3\ne: +7", `{"a":1,"b":-2,"c":1.5,"d":1000,"e":7}`},
+		{"a: true\nb: False\nc: null\nd: ~\ne:", `{"a":true,"b":false,"c":null,"d":null,"e":null}`},
+		{"a: yes\nb: 0x10\nc: 1.2.3", `{"a":"yes","b":"0x10","c":"1.2.3"}`},
+		{"a: hello world # comment\nb: a#b", `{"a":"hello world","b":"a#b"}`},
+		{"a: b&c\nb: 50%\nc: x*y", `{"a":"b\u0026c","b":"50%","c":"x*y"}`},
+		{`a: "x: y # z"` + "\nb: 'it''s'\nc: \"tab\\there\"", `{"a":"x: y # z","b":"it's","c":"tab\there"}`},
+		{`"quoted key": 1` + "\n'other': 2", `{"quoted key":1,"other":2}`},
+		{"z: 1\na: 2\nm: 3", `{"z":1,"a":2,"m":3}`},
+		{"a:\n  b:\n    c: d", `{"a":{"b":{"c":"d"}}}`},
+		{"- a\n- 1\n-\n  - b", `["a",1,["b"]]`},
+		{"a:\n- x\n- y\nb: z", `{"a":["x","y"],"b":"z"}`},
+		{"a:\n  - name: x\n    cmd: y\n  - name: z", `{"a":[{"cmd":"y","name":"x"},{"name":"z"}]}`},
+		{"a: [1, two, \"three\", [4]]\nb: {c: d, e: [f]}\nc: []\nd: {}", `{"a":[1,"two","three",[4]],"b":{"c":"d","e":["f"]},"c":[],"d":{}}`},
+		{"a: |\n  line 1\n    indented\n\n  line 3\nb: x", `{"a":"line 1\n  indented\n\nline 3\n","b":"x"}`},
+		{"a: |-\n  no newline\n", `{"a":"no newline"}`},
+		{"a: |+\n  keep\n\n\nb: x", `{"a":"keep\n\n\n","b":"x"}`},
+		{"a: >\n  folded\n  text\n\n  para\n", `{"a":"folded text\npara\n"}`},
+		{"a: |\n  # not a comment\n", `{"a":"# not a comment\n"}`},
+		{"a: 1\r\nb: 2\r\n", `{"a":1,"b":2}`},
+	}
+	for _, test := range tests {
+		v, err := Unmarshal([]byte(test.doc))
+		if err != nil {
+			t.Errorf("Unmarshal(%q): %s", test.doc, err)
+			continue
+		}
+		got, err := ToJSON(v)
+		if err != nil {
+			t.Errorf("ToJSON of %q: %s", test.doc, err)
+			continue
+		}
+		if !jsonEqual(t, string(got), test.json) {
+			t.Errorf("Unmarshal(%q) = %s, expected %s", test.doc, got, test.json)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		doc string
+		err string
+	}{
+		{"a: 1\na: 2", "duplicate key"},
+		{"a: 1\n  b: 2", "unexpected indentation"},
+		{"- a\n  - b", "unexpected indentation"},
+		{"a:\n\tb: 1", "tabs"},
+		{"a: [1, 2", ""},
+		{"a: {b: c", ""},
+		{"a: \"unterminated", ""},
+		{"a: \"bad \\q escape\"", "invalid quoted string"},
+		{"a: |x\n  y", "unsupported block scalar header"},
+		{"a: 1\nb", "expected \"key: value\""},
+		{"a: [1] x", "unexpected"},
+		// unsupported features aren't read as strings
+		{"a: &x 1\nb: *x", "unsupported"},
+		{"a: *x", "unsupported"},
+		{"a: !!str 1", "unsupported"},
+		{"a: !tag x", "unsupported"},
+		{"%YAML 1.2\n---\na: 1", "unsupported"},
+		{"a: @daily", "unsupported"},
+		{"a: `x`", "unsupported"},
+		{"&k a: 1", "unsupported"},
+		{"a: [*x]", "unsupported"},
+		{"a: {b: &c d}", "unsupported"},
+		{"- *x", "unsupported"},
+	}
+	for _, test := range tests {
+		_, err := Unmarshal([]byte(test.doc))
+		if err == nil {
+			t.Errorf("Unmarshal(%q) succeeded, expected an error", test.doc)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Unmarshal(%q): error %q doesn't mention %q", test.doc, err, test.err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, doc := range []string{
+		`{"name":"web","cmd":"./server -p 8080","replicas":2,"enabled":true,"ratio":0.5,"nothing":null}`,
+		`{"env":{"vars":["A=1","B=two words"]},"labels":{"app":"web","tier":"front"}}`,
+		`[1,"1","true",true,"null",null,"1.5","1e3","",[],{}]`,
+		`["-","- x","? x","x:","a: b","a #b","#x","@daily","*x","&x","!x","%x","|x",">x","'x","x'y","[x]","{x}",",x"]`,
+		`[" leading","trailing ","tab\tinside","new\nline","cr\rx","quote\"s","back\\slash","\u0001","ünïcödé","✓"]`,
+		`{"":"empty key","a: b":"colon key","#":"hash key","nested":{"deep":[{"x":[1,[2,{"y":null}]]}]}}`,
+		`{"z":1,"a":2,"m":3}`,
+	} {
+		v, err := FromJSON([]byte(doc))
+		if err != nil {
+			t.Errorf("FromJSON(%s): %s", doc, err)
+			continue
+		}
+		y, err := Marshal(v)
+		if err != nil {
+			t.Errorf("Marshal(%s): %s", doc, err)
+			continue
+		}
+		back, err := Unmarshal(y)
+		if err != nil {
+			t.Errorf("Unmarshal of %s:\n%s\n%s", doc, y, err)
+			continue
+		}
+		got, err := ToJSON(back)
+		if err != nil {
+			t.Errorf("ToJSON of %s: %s", doc, err)
+			continue
+		}
+		if string(got) != doc && !jsonEqual(t, string(got), doc) {
+			t.Errorf("round trip of %s gave %s via\n%s", doc, got, y)
+		}
+	}
+}
+
+// jsonEqual returns true if JSON documents a and b are the same (ignoring
+// key order and formatting).
+func jsonEqual(t *testing.T, a, b string) bool {
+	va, err := FromJSON([]byte(a))
+	if err != nil {
+		t.Fatalf("FromJSON(%s): %s", a, err)
+	}
+	vb, err := FromJSON([]byte(b))
+	if err != nil {
+		t.Fatalf("FromJSON(%s): %s", b, err)
+	}
+	return canonical(va) == canonical(vb)
+}
+
+// canonical returns v as a string with sorted map keys.
+func canonical(v interface{}) string {
+	switch x := v.(type) {
+	case Map:
+		items := make([]string, 0, len(x))
+		for _, it := range x {
+			items = append(items, it.Key+"="+canonical(it.Value))
+		}
+		sortStrings(items)
+		return "{" + strings.Join(items, ",") + "}"
+	case []interface{}:
+		items := make([]string, 0, len(x))
+		for _, it := range x {
+			items = append(items, canonical(it))
+		}
+		return "[" + strings.Join(items, ",") + "]"
+	}
+	j, _ := ToJSON(v)
+	return string(j)
+}
+
+// sortStrings sorts s in place.
+func sortStrings(s []string) {
+	for i := 1; i < len(s); i++ {
+		for j := i; j > 0 && s[j] < s[j-1]; j-- {
+			s[j], s[j-1] = s[j-1], s[j]
+		}
+	}
+}
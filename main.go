@@ -2,123 +2,113 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
-	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
-	"syscall"
+	"os"
+	"strings"
 
-	"github.com/boltdb/bolt"
 	"github.com/wybiral/hades/internal/app"
-	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/crypto/ssh/terminal"
+	"github.com/wybiral/hades/pkg/hades"
 )
 
 func main() {
+	// handle running as a daemon launcher (for resource limits)
+	hades.Init()
+	// handle subcommands (talking to a running server)
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{
+			"apply":  applyCommand,
+			"export": exportCommand,
+			"import": importCommand,
+			"ctl":    ctlCommand,
+			"user":   userCommand,
+		}
+		cmd, ok := commands[os.Args[1]]
+		if ok {
+			err := cmd(os.Args[2:])
+			if e, ok := err.(*exitError); ok {
+				if e.err != nil {
+					fmt.Fprintln(os.Stderr, "error:", err)
+				}
+				os.Exit(e.code)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 	// setup flags
 	host := "127.0.0.1"
 	flag.StringVar(&host, "h", host, "server host")
 	port := 0
 	flag.IntVar(&port, "p", port, "server port")
-	setPassword := false
-	flag.BoolVar(&setPassword, "s", setPassword, "set password")
-	genPassword := false
-	flag.BoolVar(&genPassword, "g", genPassword, "generate password")
+	opts := hades.DefaultOptions()
+	flag.StringVar(&opts.LogDir, "logs", opts.LogDir, "daemon log directory")
+	logSize := opts.LogMaxSize / (1024 * 1024)
+	flag.Int64Var(&logSize, "log-size", logSize, "max log size (MB) before rotation")
+	flag.DurationVar(&opts.LogMaxAge, "log-age", opts.LogMaxAge, "max log age before rotation")
+	flag.IntVar(&opts.LogMaxBackups, "log-backups", opts.LogMaxBackups, "rotated logs to keep (0 for all)")
+	flag.BoolVar(&opts.LogCompress, "log-compress", opts.LogCompress, "compress rotated logs")
+	flag.StringVar(&opts.CgroupDir, "cgroup", opts.CgroupDir, "cgroup v2 directory for daemons (empty to disable)")
+	flag.DurationVar(&opts.EventMaxAge, "event-age", opts.EventMaxAge, "max age of daemon events (0 to keep forever)")
+	flag.IntVar(&opts.EventMaxCount, "event-max", opts.EventMaxCount, "max number of daemon events kept (0 for all)")
+	metricsAddr := ""
+	flag.StringVar(&metricsAddr, "metrics", metricsAddr, "address serving /metrics without login (like 127.0.0.1:9100)")
+	controlPath := defaultControlPath
+	flag.StringVar(&controlPath, "control", controlPath, "control socket for hades commands like ctl and apply (empty to disable)")
+	useTLS := false
+	flag.BoolVar(&useTLS, "tls", useTLS, "serve HTTPS (with a self-signed certificate unless -cert and -key are set)")
+	certFile := ""
+	flag.StringVar(&certFile, "cert", certFile, "TLS certificate file (reloaded when changed)")
+	keyFile := ""
+	flag.StringVar(&keyFile, "key", keyFile, "TLS key file (reloaded when changed)")
+	redirectAddr := ""
+	flag.StringVar(&redirectAddr, "redirect", redirectAddr, "address redirecting HTTP to HTTPS (like :80)")
+	trustedProxies := ""
+	flag.StringVar(&trustedProxies, "trusted-proxy", trustedProxies, "comma-separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is used for client addresses")
 	flag.Parse()
-	a, err := app.NewApp(host, port)
-	if err != nil {
-		log.Fatal(err)
-	}
-	// handle password options
-	if setPassword {
-		err = askForPassword(a)
-	} else if genPassword {
-		err = generatePassword(a)
-	} else {
-		err = setupPassword(a)
-	}
+	opts.LogMaxSize = logSize * 1024 * 1024
+	a, err := app.NewApp(&app.Config{
+		Host:           host,
+		Port:           port,
+		Hades:          opts,
+		MetricsAddr:    metricsAddr,
+		ControlPath:    controlPath,
+		TLS:            useTLS,
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		RedirectAddr:   redirectAddr,
+		TrustedProxies: strings.Split(trustedProxies, ","),
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	addr := fmt.Sprintf("%s:%d", a.Host, a.Port)
-	log.Printf("Local server: http://%s", addr)
-	err = a.Run()
+	// create the first admin (or turn the old password into it)
+	name, password, err := a.SetupUsers()
 	if err != nil {
 		log.Fatal(err)
 	}
-}
-
-// ensures that password hash exists in db or generates one
-func setupPassword(a *app.App) error {
-	found := false
-	err := a.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("settings"))
-		h := b.Get([]byte("password-hash"))
-		if h != nil {
-			found = true
-		}
-		return nil
-	})
-	if err != nil {
-		return err
+	if password != "" {
+		fmt.Println("New user: " + name)
+		fmt.Println("New password: " + password)
 	}
-	if found {
-		return nil
-	}
-	// generate password if not found
-	return generatePassword(a)
-}
-
-// generate random password and save hash in database
-func generatePassword(a *app.App) error {
-	r := make([]byte, 16)
-	_, err := rand.Read(r)
-	if err != nil {
-		return err
-	}
-	s := base64.RawStdEncoding.EncodeToString(r)
-	hash, err := bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)
-	if err != nil {
-		return err
-	}
-	err = a.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("settings"))
-		return b.Put([]byte("password-hash"), hash)
-	})
-	if err != nil {
-		return err
-	}
-	fmt.Println("New password: " + s)
-	return nil
-}
-
-// ask user for random password and save hash in database
-func askForPassword(a *app.App) error {
-	stdin := int(syscall.Stdin)
-	fmt.Print("New password: ")
-	p1, err := terminal.ReadPassword(stdin)
-	if err != nil {
-		return err
+	addr := fmt.Sprintf("%s:%d", a.Host, a.Port)
+	if a.TLSConfig != nil {
+		log.Printf("Local server: https://%s", addr)
+	} else {
+		log.Printf("Local server: http://%s", addr)
 	}
-	fmt.Print("\n")
-	fmt.Print("New password (again): ")
-	p2, err := terminal.ReadPassword(stdin)
-	if err != nil {
-		return err
+	if a.RedirectListener != nil {
+		log.Printf("Redirecting to HTTPS: http://%s", a.RedirectListener.Addr())
 	}
-	fmt.Print("\n")
-	if !bytes.Equal(p1, p2) {
-		log.Fatal("passwords must match")
+	if a.MetricsListener != nil {
+		log.Printf("Metrics: http://%s/metrics", a.MetricsListener.Addr())
 	}
-	hash, err := bcrypt.GenerateFromPassword(p1, bcrypt.DefaultCost)
+	err = a.Run()
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-	err = a.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("settings"))
-		return b.Put([]byte("password-hash"), hash)
-	})
-	return err
 }
@@ -0,0 +1,78 @@
+package hades
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// period used for cpu.max when limiting by number of CPUs.
+const cgroupCPUPeriod = 100000
+
+// CgroupLimits represents cgroup v2 limits for a daemon. Empty values leave
+// the resource unlimited.
+type CgroupLimits struct {
+	// MemoryMax is the memory limit in bytes (like "512M", "2G").
+	MemoryMax string `json:"memory_max,omitempty"`
+	// CPUMax is the number of CPUs the daemon can use (like "0.5", "2").
+	CPUMax string `json:"cpu_max,omitempty"`
+	// PidsMax is the maximum number of processes and threads.
+	PidsMax string `json:"pids_max,omitempty"`
+}
+
+// CgroupUsage represents resource usage read from a daemon's cgroup.
+type CgroupUsage struct {
+	MemoryCurrent uint64        `json:"memory_current"`
+	MemoryPeak    uint64        `json:"memory_peak,omitempty"`
+	CPUUsage      time.Duration `json:"cpu_usage"`
+	PidsCurrent   uint64        `json:"pids_current"`
+	OOMKills      uint64        `json:"oom_kills"`
+}
+
+// empty returns true if no cgroup limits are set.
+func (c *CgroupLimits) empty() bool {
+	return *c == CgroupLimits{}
+}
+
+// validate returns an error if any cgroup limit is invalid.
+func (c *CgroupLimits) validate() error {
+	_, err := c.files()
+	return err
+}
+
+// files returns the values to write into cgroup control files by name.
+func (c *CgroupLimits) files() (map[string]string, error) {
+	files := map[string]string{
+		"memory.max": "max",
+		"cpu.max":    "max",
+		"pids.max":   "max",
+	}
+	if c.MemoryMax != "" && c.MemoryMax != "max" {
+		n, err := parseRlimitValue(c.MemoryMax)
+		if err != nil || n == rlimitInfinity {
+			return nil, fmt.Errorf("hades: invalid memory limit %q", c.MemoryMax)
+		}
+		files["memory.max"] = strconv.FormatUint(n, 10)
+	}
+	if c.CPUMax != "" && c.CPUMax != "max" {
+		cpus, err := strconv.ParseFloat(strings.TrimSpace(c.CPUMax), 64)
+		if err != nil || cpus <= 0 {
+			return nil, fmt.Errorf("hades: invalid cpu limit %q", c.CPUMax)
+		}
+		quota := int64(cpus * cgroupCPUPeriod)
+		if quota < 1000 {
+			// kernel minimum quota is 1ms
+			quota = 1000
+		}
+		files["cpu.max"] = fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)
+	}
+	if c.PidsMax != "" && c.PidsMax != "max" {
+		n, err := strconv.ParseUint(strings.TrimSpace(c.PidsMax), 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("hades: invalid pids limit %q", c.PidsMax)
+		}
+		files["pids.max"] = strconv.FormatUint(n, 10)
+	}
+	return files, nil
+}
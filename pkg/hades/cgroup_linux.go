@@ -0,0 +1,241 @@
+package hades
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// controllers hades enables for daemon cgroups.
+var cgroupControllers = []string{"memory", "cpu", "pids"}
+
+// cgroup represents the cgroup v2 group of a single daemon.
+type cgroup struct {
+	path string
+}
+
+// defaultCgroupDir returns the default hades cgroup directory, or an empty
+// string if cgroup v2 isn't mounted.
+func defaultCgroupDir() string {
+	// unified hierarchy, or hybrid mode with v2 mounted on the side
+	for _, mount := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		if fileExists(filepath.Join(mount, "cgroup.controllers")) {
+			return filepath.Join(mount, "hades.slice")
+		}
+	}
+	return ""
+}
+
+// setupCgroupDir creates the hades cgroup at dir and delegates controllers
+// to it so daemon cgroups beneath it can set limits.
+func setupCgroupDir(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	// enable controllers on the way down, parent first
+	parent := filepath.Dir(dir)
+	for _, p := range []string{parent, dir} {
+		available, err := ioutil.ReadFile(filepath.Join(p, "cgroup.controllers"))
+		if err != nil {
+			return err
+		}
+		enable := make([]string, 0)
+		for _, c := range cgroupControllers {
+			if containsField(string(available), c) {
+				enable = append(enable, "+"+c)
+			}
+		}
+		if len(enable) == 0 {
+			continue
+		}
+		path := filepath.Join(p, "cgroup.subtree_control")
+		err = writeFile(path, strings.Join(enable, " "))
+		if err != nil {
+			return fmt.Errorf("enabling controllers in %s: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// newCgroup creates (or reuses) the cgroup for an instance of daemon id
+// inside dir.
+func newCgroup(dir string, id uint64, instance int) (*cgroup, error) {
+	name := fmt.Sprintf("daemon-%d", id)
+	if instance > 0 {
+		name += fmt.Sprintf(".%d", instance)
+	}
+	path := filepath.Join(dir, name)
+	err := os.Mkdir(path, 0755)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	return &cgroup{path: path}, nil
+}
+
+// apply writes limits to the cgroup control files.
+func (cg *cgroup) apply(limits *CgroupLimits) error {
+	files, err := limits.files()
+	if err != nil {
+		return err
+	}
+	for name, value := range files {
+		path := filepath.Join(cg.path, name)
+		if !fileExists(path) {
+			if value == "max" {
+				// controller unavailable but nothing to limit anyway
+				continue
+			}
+			controller := strings.Split(name, ".")[0]
+			return fmt.Errorf("hades: cgroup %s controller unavailable", controller)
+		}
+		err = writeFile(path, value)
+		if err != nil {
+			return fmt.Errorf("hades: writing %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// procsFile returns the path processes are added to the cgroup with.
+func (cg *cgroup) procsFile() string {
+	return filepath.Join(cg.path, "cgroup.procs")
+}
+
+// procs returns the pids of all processes in the cgroup.
+func (cg *cgroup) procs() []int {
+	b, err := ioutil.ReadFile(cg.procsFile())
+	if err != nil {
+		return nil
+	}
+	pids := make([]int, 0)
+	for _, f := range strings.Fields(string(b)) {
+		pid, err := strconv.Atoi(f)
+		if err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// populated returns true if any process remains in the cgroup.
+func (cg *cgroup) populated() bool {
+	events := readKeyValues(filepath.Join(cg.path, "cgroup.events"))
+	v, ok := events["populated"]
+	if !ok {
+		return len(cg.procs()) > 0
+	}
+	return v != 0
+}
+
+// signal sends sig to every process in the cgroup.
+func (cg *cgroup) signal(sig syscall.Signal) {
+	for _, pid := range cg.procs() {
+		syscall.Kill(pid, sig)
+	}
+}
+
+// kill kills every process in the cgroup (including descendants that left
+// the daemon's process group).
+func (cg *cgroup) kill() {
+	// cgroup.kill (linux 5.14+) kills atomically, even processes forking
+	err := writeFile(filepath.Join(cg.path, "cgroup.kill"), "1")
+	if err != nil {
+		cg.signal(syscall.SIGKILL)
+	}
+}
+
+// oomKills returns the number of processes killed by the OOM killer.
+func (cg *cgroup) oomKills() uint64 {
+	events := readKeyValues(filepath.Join(cg.path, "memory.events"))
+	return events["oom_kill"]
+}
+
+// usage reads current resource usage of the cgroup.
+func (cg *cgroup) usage() *CgroupUsage {
+	u := &CgroupUsage{
+		MemoryCurrent: readUint(filepath.Join(cg.path, "memory.current")),
+		MemoryPeak:    readUint(filepath.Join(cg.path, "memory.peak")),
+		PidsCurrent:   readUint(filepath.Join(cg.path, "pids.current")),
+		OOMKills:      cg.oomKills(),
+	}
+	stat := readKeyValues(filepath.Join(cg.path, "cpu.stat"))
+	u.CPUUsage = time.Duration(stat["usage_usec"]) * time.Microsecond
+	if u.PidsCurrent == 0 {
+		// pids controller unavailable
+		u.PidsCurrent = uint64(len(cg.procs()))
+	}
+	return u
+}
+
+// remove deletes the cgroup (only possible once it's empty).
+func (cg *cgroup) remove() error {
+	err := os.Remove(cg.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFile writes a value into a cgroup (or proc) control file.
+func writeFile(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// readUint reads a single number from a control file (0 if unavailable).
+func readUint(path string) uint64 {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(string(bytes.TrimSpace(b)), 10, 64)
+	return n
+}
+
+// readKeyValues reads a flat keyed file like memory.events or cpu.stat.
+func readKeyValues(path string) map[string]uint64 {
+	values := make(map[string]uint64)
+	f, err := os.Open(path)
+	if err != nil {
+		return values
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err == nil {
+			values[fields[0]] = n
+		}
+	}
+	return values
+}
+
+// containsField returns true if whitespace separated s contains field.
+func containsField(s, field string) bool {
+	for _, f := range strings.Fields(s) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
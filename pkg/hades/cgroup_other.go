@@ -0,0 +1,40 @@
+//go:build !linux
+// +build !linux
+
+package hades
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errCgroupUnsupported returned when using cgroups on other platforms.
+var errCgroupUnsupported = errors.New("hades: cgroups are only supported on linux")
+
+// cgroup is unused on this platform.
+type cgroup struct{}
+
+// defaultCgroupDir returns an empty string (cgroups are disabled).
+func defaultCgroupDir() string {
+	return ""
+}
+
+// setupCgroupDir always fails on this platform.
+func setupCgroupDir(dir string) error {
+	return errCgroupUnsupported
+}
+
+// newCgroup always fails on this platform.
+func newCgroup(dir string, id uint64, instance int) (*cgroup, error) {
+	return nil, errCgroupUnsupported
+}
+
+func (cg *cgroup) apply(limits *CgroupLimits) error { return errCgroupUnsupported }
+func (cg *cgroup) procsFile() string                { return "" }
+func (cg *cgroup) procs() []int                     { return nil }
+func (cg *cgroup) populated() bool                  { return false }
+func (cg *cgroup) signal(sig syscall.Signal)        {}
+func (cg *cgroup) kill()                            {}
+func (cg *cgroup) oomKills() uint64                 { return 0 }
+func (cg *cgroup) usage() *CgroupUsage              { return &CgroupUsage{} }
+func (cg *cgroup) remove() error                    { return nil }
@@ -0,0 +1,372 @@
+package hades
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Plan actions.
+const (
+	// PlanAdd adds a daemon that isn't in the DB.
+	PlanAdd = "add"
+	// PlanChange updates the definition of a daemon.
+	PlanChange = "change"
+	// PlanRemove removes a daemon that isn't in the config.
+	PlanRemove = "remove"
+)
+
+// Spec represents a daemon definition from a config file, with its
+// dependencies referenced by name (or decimal id) instead of id.
+type Spec struct {
+	// ID identifies an existing daemon (only used for daemons without a
+	// name, which are otherwise matched by name).
+	ID uint64
+	// Daemon is the definition (its ID, Requires and After are ignored).
+	Daemon   *Daemon
+	Requires []string
+	After    []string
+}
+
+// PlanStep represents a single change made by applying a Plan.
+type PlanStep struct {
+	Action string `json:"action"`
+	// ID is the daemon changed or removed (0 for adds).
+	ID   uint64 `json:"id,omitempty"`
+	Name string `json:"name"`
+	// Changes lists the changed definition fields.
+	Changes []string `json:"changes,omitempty"`
+	// Running is true if the daemon is running (and will be restarted by a
+	// change to more than its name, description or labels or stopped by
+	// removal).
+	Running bool `json:"running,omitempty"`
+	spec    *Spec
+	// dependencies of spec
+	requires []*Spec
+	after    []*Spec
+}
+
+// Plan represents the changes needed to make the daemons match a config:
+// adds (dependencies first), then changes, then removals (dependents
+// first).
+type Plan struct {
+	Steps []*PlanStep `json:"steps"`
+	// ids of existing daemons matched by specs
+	ids map[*Spec]uint64
+}
+
+// Count returns the number of steps with action.
+func (p *Plan) Count(action string) int {
+	n := 0
+	for _, s := range p.Steps {
+		if s.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// String formats the plan for humans.
+func (p *Plan) String() string {
+	if len(p.Steps) == 0 {
+		return "No changes.\n"
+	}
+	var b strings.Builder
+	for _, s := range p.Steps {
+		switch s.Action {
+		case PlanAdd:
+			fmt.Fprintf(&b, "+ %s\n", s.Name)
+		case PlanChange:
+			fmt.Fprintf(&b, "~ %s (%s)", s.Name, strings.Join(s.Changes, ", "))
+			if s.Running && needsRestart(s.Changes) {
+				b.WriteString(" restarts")
+			}
+			b.WriteString("\n")
+		case PlanRemove:
+			fmt.Fprintf(&b, "- %s", s.Name)
+			if s.Running {
+				b.WriteString(" stops")
+			}
+			b.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&b, "Plan: %d to add, %d to change, %d to remove.\n",
+		p.Count(PlanAdd), p.Count(PlanChange), p.Count(PlanRemove))
+	return b.String()
+}
+
+// displayName returns the name of d or "#id" if it doesn't have one.
+func displayName(d *Daemon) string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return "#" + strconv.FormatUint(d.ID, 10)
+}
+
+// Export returns the definitions of all daemons as specs (in id order).
+func (h *Hades) Export() ([]*Spec, error) {
+	daemons, err := h.Daemons()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[uint64]string)
+	for _, d := range daemons {
+		refs[d.ID] = d.Name
+		if d.Name == "" {
+			refs[d.ID] = strconv.FormatUint(d.ID, 10)
+		}
+	}
+	names := func(ids []uint64) []string {
+		out := make([]string, len(ids))
+		for i, id := range ids {
+			out[i] = refs[id]
+		}
+		return out
+	}
+	specs := make([]*Spec, 0, len(daemons))
+	for _, d := range daemons {
+		s := &Spec{Daemon: d.definition(), Requires: names(d.Requires), After: names(d.After)}
+		if d.Name == "" {
+			s.ID = d.ID
+		}
+		s.Daemon.ID = 0
+		s.Daemon.Requires = nil
+		s.Daemon.After = nil
+		specs = append(specs, s)
+	}
+	return specs, nil
+}
+
+// Plan compares specs to the current daemons and returns the steps needed
+// to make them match. Daemons missing from specs are removed.
+func (h *Hades) Plan(specs []*Spec) (*Plan, error) {
+	daemons, err := h.Daemons()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint64]*Daemon)
+	byName := make(map[string]*Daemon)
+	for _, d := range daemons {
+		byID[d.ID] = d
+		if d.Name != "" {
+			byName[d.Name] = d
+		}
+	}
+	// match specs to existing daemons
+	matched := make(map[*Spec]*Daemon)
+	claimed := make(map[uint64]bool)
+	specNames := make(map[string]*Spec)
+	specIDs := make(map[uint64]*Spec)
+	for i, s := range specs {
+		name := s.Daemon.Name
+		if name == "" && s.ID == 0 {
+			return nil, fmt.Errorf("hades: daemon %d in config needs a name", i+1)
+		}
+		if name != "" {
+			if specNames[name] != nil {
+				return nil, fmt.Errorf("hades: daemon %q is defined twice", name)
+			}
+			specNames[name] = s
+		}
+		d, ok := byName[name]
+		if !ok && name == "" {
+			d, ok = byID[s.ID]
+			if !ok {
+				return nil, fmt.Errorf("hades: unknown daemon id %d", s.ID)
+			}
+		}
+		if ok {
+			if claimed[d.ID] {
+				return nil, fmt.Errorf("hades: daemon %s is defined twice", displayName(d))
+			}
+			claimed[d.ID] = true
+			matched[s] = d
+			specIDs[d.ID] = s
+		}
+	}
+	// dependencies can only refer to daemons in the config
+	resolve := func(s *Spec, refs []string) ([]*Spec, error) {
+		deps := make([]*Spec, len(refs))
+		for i, ref := range refs {
+			dep, ok := specNames[ref]
+			if !ok {
+				id, err := strconv.ParseUint(ref, 10, 64)
+				if err == nil {
+					dep, ok = specIDs[id]
+				}
+			}
+			if !ok {
+				return nil, fmt.Errorf("hades: %s depends on %q which isn't in the config", specName(s), ref)
+			}
+			deps[i] = dep
+		}
+		return deps, nil
+	}
+	requires := make(map[*Spec][]*Spec)
+	after := make(map[*Spec][]*Spec)
+	for _, s := range specs {
+		requires[s], err = resolve(s, s.Requires)
+		if err != nil {
+			return nil, err
+		}
+		after[s], err = resolve(s, s.After)
+		if err != nil {
+			return nil, err
+		}
+		def := s.Daemon.definition()
+		def.Requires = nil
+		def.After = nil
+		err = def.validate()
+		if err != nil {
+			return nil, stepError(specName(s), err)
+		}
+	}
+	p := &Plan{ids: make(map[*Spec]uint64)}
+	for s, d := range matched {
+		p.ids[s] = d.ID
+	}
+	// adds with dependencies first (cycles are caught by Add)
+	visited := make(map[*Spec]bool)
+	var visit func(s *Spec)
+	visit = func(s *Spec) {
+		if visited[s] {
+			return
+		}
+		visited[s] = true
+		for _, dep := range append(requires[s], after[s]...) {
+			visit(dep)
+		}
+		if _, ok := matched[s]; !ok {
+			p.Steps = append(p.Steps, &PlanStep{
+				Action:   PlanAdd,
+				Name:     s.Daemon.Name,
+				spec:     s,
+				requires: requires[s],
+				after:    after[s],
+			})
+		}
+	}
+	for _, s := range specs {
+		visit(s)
+	}
+	for _, s := range specs {
+		d, ok := matched[s]
+		if !ok {
+			continue
+		}
+		// added dependencies don't have ids yet (0 always differs)
+		ids := func(deps []*Spec) []uint64 {
+			out := make([]uint64, len(deps))
+			for i, dep := range deps {
+				if m, ok := matched[dep]; ok {
+					out[i] = m.ID
+				}
+			}
+			return out
+		}
+		def := s.Daemon.definition()
+		def.ID = d.ID
+		def.Requires = ids(requires[s])
+		def.After = ids(after[s])
+		changes := changedFields(d, def)
+		if len(changes) == 0 {
+			continue
+		}
+		_, err := h.getInstances(d.ID)
+		p.Steps = append(p.Steps, &PlanStep{
+			Action:   PlanChange,
+			ID:       d.ID,
+			Name:     displayName(d),
+			Changes:  changes,
+			Running:  err == nil,
+			spec:     s,
+			requires: requires[s],
+			after:    after[s],
+		})
+	}
+	removed := make([]uint64, 0)
+	all := make(map[uint64]*Daemon)
+	for _, d := range daemons {
+		all[d.ID] = d
+		if !claimed[d.ID] {
+			removed = append(removed, d.ID)
+		}
+	}
+	order := startOrder(removed, all)
+	for i := len(order) - 1; i >= 0; i-- {
+		d := all[order[i]]
+		_, err := h.getInstances(d.ID)
+		p.Steps = append(p.Steps, &PlanStep{
+			Action:  PlanRemove,
+			ID:      d.ID,
+			Name:    displayName(d),
+			Running: err == nil,
+		})
+	}
+	return p, nil
+}
+
+// specName returns the name used for s in errors.
+func specName(s *Spec) string {
+	if s.Daemon.Name != "" {
+		return s.Daemon.Name
+	}
+	return "#" + strconv.FormatUint(s.ID, 10)
+}
+
+// stepError returns err with the name of the daemon it's about.
+func stepError(name string, err error) error {
+	return fmt.Errorf("hades: %s: %s", name, strings.TrimPrefix(err.Error(), "hades: "))
+}
+
+// ApplyPlan makes the changes in plan p (from Plan): adding daemons,
+// updating changed ones (restarting them if they're running) and stopping
+// and removing the rest. user is who applied it (for the history).
+func (h *Hades) ApplyPlan(p *Plan, user string) error {
+	ids := make(map[*Spec]uint64)
+	for s, id := range p.ids {
+		ids[s] = id
+	}
+	definition := func(step *PlanStep) *Daemon {
+		def := step.spec.Daemon.definition()
+		def.Requires = make([]uint64, 0, len(step.requires))
+		for _, dep := range step.requires {
+			def.Requires = append(def.Requires, ids[dep])
+		}
+		def.After = make([]uint64, 0, len(step.after))
+		for _, dep := range step.after {
+			def.After = append(def.After, ids[dep])
+		}
+		return def
+	}
+	for _, step := range p.Steps {
+		switch step.Action {
+		case PlanAdd:
+			d, err := h.Add(definition(step), user)
+			if err != nil {
+				return stepError(step.Name, err)
+			}
+			ids[step.spec] = d.ID
+		case PlanChange:
+			err := h.apply(step.ID, definition(step), user, "config applied", true)
+			if err != nil {
+				return stepError(step.Name, err)
+			}
+		case PlanRemove:
+			instances, err := h.getInstances(step.ID)
+			if err == nil {
+				for _, ad := range instances {
+					ad.stop(user, "removed by config")
+				}
+				for _, ad := range instances {
+					<-ad.done
+				}
+			}
+			err = h.Remove(step.ID, user)
+			if err != nil {
+				return stepError(step.Name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package hades
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule returns the next activation time after t.
+type schedule interface {
+	next(t time.Time) time.Time
+}
+
+// cronSchedule is a parsed cron expression. Each field is a bit set of the
+// values it matches.
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	// a "*" day field doesn't restrict the other one
+	domStar, dowStar bool
+}
+
+// everySchedule activates at a fixed interval.
+type everySchedule struct {
+	every time.Duration
+}
+
+// cronField describes the allowed range and names of a cron field.
+type cronField struct {
+	name     string
+	min, max uint
+	names    map[string]uint
+}
+
+var (
+	secondField = cronField{"second", 0, 59, nil}
+	minuteField = cronField{"minute", 0, 59, nil}
+	hourField   = cronField{"hour", 0, 23, nil}
+	domField    = cronField{"day of month", 1, 31, nil}
+	monthField  = cronField{"month", 1, 12, map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = cronField{"day of week", 0, 7, map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// cron expressions for descriptors.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// parseSchedule parses a cron expression with 5 fields (minute precision)
+// or 6 fields (leading seconds), a descriptor like "@daily" or an interval
+// like "@every 90s".
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("hades: invalid interval in %q", spec)
+		}
+		return &everySchedule{every: every}, nil
+	}
+	if strings.HasPrefix(spec, "@") {
+		expr, ok := cronDescriptors[strings.ToLower(spec)]
+		if !ok {
+			return nil, fmt.Errorf("hades: unknown schedule %q", spec)
+		}
+		spec = expr
+	}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("hades: cron expression needs 5 or 6 fields: %q", spec)
+	}
+	s := &cronSchedule{}
+	var err error
+	targets := []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&s.second, secondField},
+		{&s.minute, minuteField},
+		{&s.hour, hourField},
+		{&s.dom, domField},
+		{&s.month, monthField},
+		{&s.dow, dowField},
+	}
+	for i, t := range targets {
+		*t.bits, err = parseCronField(fields[i], t.field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 7 is another name for sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[3] == "*" || fields[3] == "?"
+	s.dowStar = fields[5] == "*" || fields[5] == "?"
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps
+// (like "1,5-10,*/15") into a bit set.
+func parseCronField(expr string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		step := uint(1)
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.ParseUint(part[i+1:], 10, 8)
+			if err != nil || n == 0 {
+				return 0, fmt.Errorf("hades: invalid %s step %q", f.name, part)
+			}
+			step = uint(n)
+			part = part[:i]
+		}
+		lo, hi := f.min, f.max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			lo, err = f.value(bounds[0])
+			if err != nil {
+				return 0, err
+			}
+			hi, err = f.value(bounds[1])
+			if err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("hades: invalid %s range %q", f.name, part)
+			}
+		default:
+			v, err := f.value(part)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if step == 1 {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single number or name in the field.
+func (f *cronField) value(s string) (uint, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || uint(n) < f.min || uint(n) > f.max {
+		return 0, fmt.Errorf("hades: invalid %s %q", f.name, s)
+	}
+	return uint(n), nil
+}
+
+// next returns the first time after t matching the expression (zero if
+// there's none within five years). Times are matched in t's location.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Add(time.Second - time.Duration(t.Nanosecond())).Truncate(0)
+	limit := t.Year() + 5
+	for t.Year() <= limit {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			n := time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			t = advance(t, n, 24*time.Hour)
+			continue
+		}
+		if !s.dayMatches(t) {
+			n := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			t = advance(t, n, 24*time.Hour)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			n := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			t = advance(t, n, time.Hour)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if s.second&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// advance returns n if it's after t, otherwise t plus step. Times that
+// don't exist because of daylight saving changes can normalize to before t.
+func advance(t, n time.Time, step time.Duration) time.Time {
+	if n.After(t) {
+		return n
+	}
+	return t.Add(step)
+}
+
+// dayMatches returns true if the day of t matches. Like cron, when both day
+// fields are restricted either one matching is enough.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns t plus the interval (rounded down to the second).
+func (s *everySchedule) next(t time.Time) time.Time {
+	return t.Add(s.every - time.Duration(t.Nanosecond()))
+}
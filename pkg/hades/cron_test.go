@@ -0,0 +1,119 @@
+package hades
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"0 0 1 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"* * * foo *",
+		"@fortnightly",
+		"@every 500ms",
+		"@every soon",
+	} {
+		_, err := parseSchedule(spec)
+		if err == nil {
+			t.Errorf("parseSchedule(%q) succeeded, expected an error", spec)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		// 2024-01-01 is a monday
+		{"* * * * *", "2024-01-01T00:00:30Z", "2024-01-01T00:01:00Z"},
+		{"* * * * *", "2024-01-01T00:01:00Z", "2024-01-01T00:02:00Z"},
+		{"*/15 * * * *", "2024-01-01T00:01:00Z", "2024-01-01T00:15:00Z"},
+		{"5,10-12 * * * *", "2024-01-01T00:10:00Z", "2024-01-01T00:11:00Z"},
+		{"5,10-12 * * * *", "2024-01-01T00:12:00Z", "2024-01-01T01:05:00Z"},
+		{"10-50/20 * * * *", "2024-01-01T00:31:00Z", "2024-01-01T00:50:00Z"},
+		{"30 * * * * *", "2024-01-01T00:00:00Z", "2024-01-01T00:00:30Z"},
+		{"*/20 * * * * *", "2024-01-01T00:00:45Z", "2024-01-01T00:01:00Z"},
+		{"0 9 * * mon-fri", "2024-01-05T10:00:00Z", "2024-01-08T09:00:00Z"},
+		{"0 0 * * 7", "2024-01-01T00:00:00Z", "2024-01-07T00:00:00Z"},
+		{"0 0 * * SUN", "2024-01-01T00:00:00Z", "2024-01-07T00:00:00Z"},
+		{"0 12 * JAN,jul *", "2024-02-01T00:00:00Z", "2024-07-01T12:00:00Z"},
+		// both day fields restricted: either one matches
+		{"0 0 1 * 0", "2024-01-01T00:00:00Z", "2024-01-07T00:00:00Z"},
+		{"0 0 1 * 0", "2024-01-28T00:00:00Z", "2024-02-01T00:00:00Z"},
+		// one day field restricted: only it counts
+		{"0 0 13 * *", "2024-01-01T00:00:00Z", "2024-01-13T00:00:00Z"},
+		{"0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"@hourly", "2024-01-01T00:59:59Z", "2024-01-01T01:00:00Z"},
+		{"@daily", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z"},
+		{"@weekly", "2024-01-01T00:00:00Z", "2024-01-07T00:00:00Z"},
+		{"@monthly", "2024-01-31T23:00:00Z", "2024-02-01T00:00:00Z"},
+		{"@yearly", "2024-06-01T00:00:00Z", "2025-01-01T00:00:00Z"},
+		{"@every 90s", "2024-01-01T00:00:00Z", "2024-01-01T00:01:30Z"},
+		{"@every 1h", "2024-01-01T00:10:00.5Z", "2024-01-01T01:10:00Z"},
+		// never matches
+		{"0 0 31 2 *", "2024-01-01T00:00:00Z", ""},
+	}
+	for _, test := range tests {
+		s, err := parseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %s", test.spec, err)
+			continue
+		}
+		from, err := time.Parse(time.RFC3339Nano, test.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want time.Time
+		if test.want != "" {
+			want, err = time.Parse(time.RFC3339, test.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := s.next(from)
+		if !got.Equal(want) {
+			t.Errorf("%q after %s: got %s, expected %s", test.spec, test.from, got, want)
+		}
+	}
+}
+
+func TestScheduleNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		// clocks jump from 2:00 to 3:00 on 2024-03-10
+		{"0 * * * *", time.Date(2024, 3, 10, 1, 30, 0, 0, loc), time.Date(2024, 3, 10, 3, 0, 0, 0, loc)},
+		{"0 9 * * *", time.Date(2024, 3, 9, 10, 0, 0, 0, loc), time.Date(2024, 3, 10, 9, 0, 0, 0, loc)},
+		// and back from 2:00 to 1:00 on 2024-11-03
+		{"0 9 * * *", time.Date(2024, 11, 2, 10, 0, 0, 0, loc), time.Date(2024, 11, 3, 9, 0, 0, 0, loc)},
+	}
+	for _, test := range tests {
+		s, err := parseSchedule(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := s.next(test.from)
+		if !got.Equal(test.want) {
+			t.Errorf("%q after %s: got %s, expected %s", test.spec, test.from, got, test.want)
+		}
+	}
+}
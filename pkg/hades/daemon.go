@@ -1,107 +1,280 @@
 package hades
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
-	"os"
 	"os/exec"
-	"os/user"
 	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/google/shlex"
 )
 
-// time to wait between restarts of failed daemon.
-const timeout = time.Second * 10
-
-// Daemon represents a single daemon process.
+// Daemon represents a daemon process (run as one or more instances).
 type Daemon struct {
-	ID       uint64 `json:"id"`
-	Cmd      string `json:"cmd"`
-	Dir      string `json:"dir,omitempty"`
-	Status   string `json:"status"`
-	Disabled bool   `json:"disabled"`
+	ID               uint64            `json:"id"`
+	Cmd              string            `json:"cmd"`
+	Dir              string            `json:"dir,omitempty"`
+	Name             string            `json:"name,omitempty"`
+	Description      string            `json:"description,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Restart          RestartPolicy     `json:"restart"`
+	StopSignal       string            `json:"stop_signal,omitempty"`
+	StopTimeout      Duration          `json:"stop_timeout,omitempty"`
+	Env              Environment       `json:"env"`
+	User             string            `json:"user,omitempty"`
+	Group            string            `json:"group,omitempty"`
+	Groups           []string          `json:"groups,omitempty"`
+	Limits           Limits            `json:"limits"`
+	Cgroup           CgroupLimits      `json:"cgroup"`
+	Health           HealthCheck       `json:"health"`
+	Kind             string            `json:"kind,omitempty"`
+	Schedule         Schedule          `json:"schedule"`
+	Requires         []uint64          `json:"requires,omitempty"`
+	After            []uint64          `json:"after,omitempty"`
+	OnDependencyDown string            `json:"on_dependency_down,omitempty"`
+	Replicas         int               `json:"replicas,omitempty"`
+	Port             int               `json:"port,omitempty"`
+	// Instance is the state of the whole daemon (summarized from Instances).
+	Instance
+	Instances []Instance `json:"instances,omitempty"`
+	Disabled  bool       `json:"disabled"`
+}
+
+// copySettings copies settings (everything except identity, name, command,
+// directory and runtime state) from src.
+func (d *Daemon) copySettings(src *Daemon) {
+	d.Description = src.Description
+	d.Labels = src.Labels
+	d.Restart = src.Restart
+	d.StopSignal = src.StopSignal
+	d.StopTimeout = src.StopTimeout
+	d.Env = src.Env
+	d.User = src.User
+	d.Group = src.Group
+	d.Groups = src.Groups
+	d.Limits = src.Limits
+	d.Cgroup = src.Cgroup
+	d.Health = src.Health
+	d.Kind = src.Kind
+	d.Schedule = src.Schedule
+	d.Requires = src.Requires
+	d.After = src.After
+	d.OnDependencyDown = src.OnDependencyDown
+	d.Replicas = src.Replicas
+	d.Port = src.Port
+}
+
+// stopSettings returns the signal and grace period used to stop d.
+func (d *Daemon) stopSettings() (syscall.Signal, time.Duration) {
+	sig, err := parseSignal(d.StopSignal)
+	if err != nil {
+		sig = defaultStopSignal
+	}
+	timeout := time.Duration(d.StopTimeout)
+	if timeout <= 0 {
+		timeout = defaultStopTimeout
+	}
+	return sig, timeout
 }
 
-// activeDaemon represents a running daemon.
+// validate returns an error if the daemon definition is invalid.
+func (d *Daemon) validate() error {
+	parts, err := shlex.Split(d.Cmd)
+	if err != nil {
+		return fmt.Errorf("hades: invalid command: %s", err)
+	}
+	if len(parts) == 0 {
+		return errors.New("hades: missing command")
+	}
+	err = validateName(d.Name)
+	if err != nil {
+		return err
+	}
+	err = validateLabels(d.Labels)
+	if err != nil {
+		return err
+	}
+	err = validateStop(d.StopSignal, d.StopTimeout)
+	if err != nil {
+		return err
+	}
+	err = d.Env.validate()
+	if err != nil {
+		return err
+	}
+	err = d.Limits.validate()
+	if err != nil {
+		return err
+	}
+	err = d.Cgroup.validate()
+	if err != nil {
+		return err
+	}
+	err = d.Health.validate()
+	if err != nil {
+		return err
+	}
+	err = d.validateDependencies()
+	if err != nil {
+		return err
+	}
+	err = d.validateKind()
+	if err != nil {
+		return err
+	}
+	err = d.validateReplicas()
+	if err != nil {
+		return err
+	}
+	return d.Restart.validate()
+}
+
+// activeDaemon represents a running instance of a daemon.
 type activeDaemon struct {
 	h         *Hades
 	id        uint64
+	instance  int
 	pidMutex  *sync.Mutex
 	pid       int
 	exitMutex *sync.Mutex
 	exit      bool
+	quit      chan struct{}
+	stopped   chan struct{}
+	// done is closed once the daemon is no longer active
+	done chan struct{}
+	// trigger runs a job now (receiving who asked for it)
+	trigger    chan string
+	killReason string
+	// restartReason is set when the process was stopped to be restarted
+	restartReason string
+	cg            *cgroup
+	sampler       statsSampler
 }
 
-// newActiveDaemon returns new activeDaemon, starting the process.
-func newActiveDaemon(h *Hades, id uint64) *activeDaemon {
+// newActiveDaemon returns new activeDaemon for an instance, starting the
+// process.
+func newActiveDaemon(h *Hades, id uint64, instance int) *activeDaemon {
 	ad := &activeDaemon{
 		h:         h,
 		id:        id,
+		instance:  instance,
 		pidMutex:  &sync.Mutex{},
 		pid:       0,
 		exitMutex: &sync.Mutex{},
 		exit:      false,
+		quit:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		done:      make(chan struct{}),
+		trigger:   make(chan string, 1),
 	}
-	ad.setStatus("running")
 	go ad.start()
 	return ad
 }
 
-// setStatus updates daemon status in DB.
+// updateInstance applies fn to the instance state in DB (updating the
+// daemon summary).
+func (ad *activeDaemon) updateInstance(fn func(d *Daemon, in *Instance)) {
+	ad.h.update(ad.id, func(d *Daemon) error {
+		fn(d, d.instance(ad.instance))
+		d.summarize()
+		return nil
+	})
+}
+
+// setStatus updates instance status in DB.
 func (ad *activeDaemon) setStatus(status string) {
-	ad.h.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(daemonBucket)
-		v := b.Get(itob(ad.id))
-		d := &Daemon{}
-		err := json.Unmarshal(v, d)
-		if err != nil {
-			return err
-		}
-		d.Status = status
-		enc, err := json.Marshal(d)
-		if err != nil {
-			return err
-		}
-		return b.Put(itob(ad.id), enc)
+	ad.updateInstance(func(d *Daemon, in *Instance) {
+		in.Status = status
 	})
 }
 
-// cleanup called after daemon is stopped to update DB and remove from active.
-func (ad *activeDaemon) cleanup() {
+// log returns the output log of the instance.
+func (ad *activeDaemon) log() *daemonLog {
+	return ad.h.getLog(ad.id, ad.instance)
+}
+
+// addEvent records e for the instance (noting the instance number if the
+// daemon has more than one).
+func (ad *activeDaemon) addEvent(e *Event) {
+	e.Daemon = ad.id
+	d, err := ad.h.Get(ad.id)
+	if ad.instance > 0 || (err == nil && (d.replicas() > 1 || len(d.Instances) > 1)) {
+		i := ad.instance
+		e.Instance = &i
+	}
+	ad.h.addEvent(e)
+}
+
+// cleanup called after daemon is stopped to update DB and remove from
+// active. The daemon is disabled when its last instance is gone (unless
+// the instance was removed by scaling down).
+func (ad *activeDaemon) cleanup(status string) {
 	h := ad.h
 	h.activeMutex.Lock()
 	defer h.activeMutex.Unlock()
-	delete(h.active, ad.id)
-	h.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(daemonBucket)
-		v := b.Get(itob(ad.id))
-		d := &Daemon{}
-		err := json.Unmarshal(v, d)
-		if err != nil {
-			return err
+	last := false
+	instances := h.active[ad.id]
+	if instances[ad.instance] == ad {
+		delete(instances, ad.instance)
+		if len(instances) == 0 {
+			delete(h.active, ad.id)
+			last = true
 		}
-		d.Disabled = true
-		d.Status = "stopped"
-		enc, err := json.Marshal(d)
-		if err != nil {
-			return err
+	}
+	stopping := h.stopping[ad.id]
+	if stopping[ad.instance] == ad {
+		delete(stopping, ad.instance)
+		if len(stopping) == 0 {
+			delete(h.stopping, ad.id)
+		}
+	}
+	ad.updateInstance(func(d *Daemon, in *Instance) {
+		if ad.instance >= d.replicas() {
+			// scaled down
+			status = "stopped"
+		}
+		in.Status = status
+		if last {
+			d.Disabled = true
 		}
-		return b.Put(itob(ad.id), enc)
 	})
+	ad.addEvent(&Event{Type: EventStatus, Status: status})
 }
 
-// start starts a daemon process and schedules cleanup when it's stopped.
+// start starts a daemon process, restarting it according to the restart
+// policy, and schedules cleanup when it's stopped.
 func (ad *activeDaemon) start() {
-	defer ad.cleanup()
+	status := "stopped"
+	defer func() {
+		if ad.exiting() {
+			// stay "stopping" until the whole process group is gone
+			<-ad.stopped
+			ad.exitMutex.Lock()
+			reason := ad.killReason
+			ad.exitMutex.Unlock()
+			if reason != "" {
+				// explains the exit already recorded as killed by SIGKILL
+				ad.updateInstance(func(d *Daemon, in *Instance) {
+					in.ExitCode, in.ExitReason = -1, reason
+					d.ExitCode, d.ExitReason = -1, reason
+				})
+			}
+		}
+		cg := ad.getCgroup()
+		if cg != nil {
+			cg.remove()
+		}
+		ad.cleanup(status)
+		close(ad.done)
+	}()
 	h := ad.h
 	id := ad.id
+	dl := ad.log()
 	d, err := h.Get(id)
 	if err != nil {
 		return
@@ -113,82 +286,535 @@ func (ad *activeDaemon) start() {
 	if len(parts) == 0 {
 		return
 	}
+	ident, err := d.resolveIdentity()
+	if err != nil {
+		dl.writeLine("hades", err.Error())
+		ad.setExit(-1, "failed to start: "+err.Error())
+		return
+	}
 	dir := d.Dir
 	if strings.HasPrefix(dir, "~") {
-		// expand relative home paths
-		usr, err := user.Current()
-		if err != nil {
-			return
-		}
-		dir = filepath.Join(usr.HomeDir, dir[1:])
+		// expand relative home paths (for the user it runs as)
+		dir = filepath.Join(ident.home, dir[1:])
 	}
 	// make paths absolute
 	dir, err = filepath.Abs(dir)
 	if err != nil {
 		return
 	}
+	cg, err := ad.setupCgroup(d)
+	if err != nil {
+		dl.writeLine("hades", err.Error())
+		ad.setExit(-1, "failed to start: "+err.Error())
+		return
+	}
+	l := &launcher{d: d, parts: parts, dir: dir, ident: ident, cg: cg}
+	if d.Kind == KindJob {
+		ad.schedule(l)
+		return
+	}
+	rt := newRestartTracker(&d.Restart)
 	for {
-		ad.exitMutex.Lock()
-		exit := ad.exit
-		ad.exitMutex.Unlock()
-		if exit {
+		if ad.exiting() {
 			return
 		}
-		c := exec.Command(parts[0], parts[1:]...)
-		c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-		c.Dir = dir
-		c.Env = os.Environ()
-		err := c.Start()
+		if !ad.waitDependencies(d) {
+			return
+		}
+		started := time.Now()
+		failed := false
+		// launch errors already set the "failed" status
+		launchFailed := false
+		forced := false
+		// why a forced restart happened
+		why := ""
+		c, env, err := ad.launch(l)
 		if err != nil {
+			failed = true
+			launchFailed = true
 			ad.setStatus("failed")
 			log.Printf("%d: %s\n", ad.id, err)
-			time.Sleep(timeout)
-			continue
+			dl.writeLine("hades", err.Error())
+			ad.setExit(-1, "failed to start: "+err.Error())
+		} else {
+			pid := c.Process.Pid
+			if !ad.setStartedPid(pid) {
+				c.Wait()
+				return
+			}
+			ad.setStarted(started)
+			var ooms uint64
+			done := make(chan struct{})
+			if cg != nil {
+				ooms = cg.oomKills()
+				go ad.watchOOM(cg, ooms, done)
+			}
+			healthDone := make(chan struct{})
+			if d.Health.enabled() {
+				go ad.watchHealth(&d.Health, pid, dir, ident, env, done, healthDone)
+			} else {
+				close(healthDone)
+			}
+			err = c.Wait()
+			close(done)
+			// a health restart may still be killing the process group
+			<-healthDone
+			ad.setPid(0)
+			failed = err != nil
+			if c.ProcessState != nil {
+				code, reason := exitStatus(c, cg, ooms)
+				if r := ad.takeRestartReason(); r != "" {
+					forced = true
+					why = r
+					reason += " (" + r + ")"
+				}
+				dl.writeLine("hades", reason)
+				ad.setExit(code, reason)
+			}
+			h.dependencyDown(id)
 		}
-		ad.pidMutex.Lock()
-		ad.pid = c.Process.Pid
-		ad.pidMutex.Unlock()
-		err = c.Wait()
+		if ad.exiting() {
+			return
+		}
+		// restarts asked for by health checks or dependencies ignore the policy
+		if !d.Restart.shouldRestart(failed) && !forced {
+			return
+		}
+		delay, ok := rt.record(time.Since(started))
+		if !ok {
+			status = "crashloop"
+			dl.writeLine("hades", "restart limit reached, giving up")
+			return
+		}
+		if !launchFailed {
+			ad.setStatus("restarting")
+		}
+		if why == "" && d.Restart.Policy == RestartOnFailure {
+			why = "exited unsuccessfully"
+		} else if why == "" {
+			why = "exited"
+		}
+		cause := fmt.Sprintf("%s, in %s", why, delay.Round(time.Millisecond))
+		ad.addEvent(&Event{Type: EventRestart, Cause: cause})
+		dl.writeLine("hades", fmt.Sprintf("restarting in %s", delay))
+		if !ad.sleep(delay) {
+			return
+		}
+		ad.updateInstance(func(d *Daemon, in *Instance) {
+			in.Status = "running"
+			in.Restarts++
+		})
+	}
+}
+
+// launcher holds what's needed to start processes for a daemon.
+type launcher struct {
+	d     *Daemon
+	parts []string
+	dir   string
+	ident *identity
+	// cg is nil when not using a cgroup
+	cg *cgroup
+}
+
+// launch starts a new process for the daemon, returning the command and
+// the environment it was started with.
+func (ad *activeDaemon) launch(l *launcher) (*exec.Cmd, []string, error) {
+	// env file is read on every start so changes apply on restart
+	env, err := l.d.Env.environ(l.dir, l.ident)
+	if err != nil {
+		return nil, nil, err
+	}
+	env = instanceEnv(l.d, ad.instance, env)
+	if l.cg != nil {
+		// limits are rewritten on every start so changes apply on restart
+		err = l.cg.apply(&l.d.Cgroup)
 		if err != nil {
+			return nil, nil, err
+		}
+	}
+	c, err := newCommand(l.d, l.parts, l.ident, env, l.cg)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.Dir = l.dir
+	err = ad.startProcess(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, env, nil
+}
+
+// exitStatus returns the exit code and reason of finished command c which
+// ran in cgroup cg (nil for none) that had seen ooms OOM kills before.
+func exitStatus(c *exec.Cmd, cg *cgroup, ooms uint64) (int, string) {
+	ws := c.ProcessState.Sys().(syscall.WaitStatus)
+	code, reason := exitReason(ws)
+	if cg != nil && ws.Signaled() && cg.oomKills() > ooms {
+		reason = "killed by OOM killer (memory limit reached)"
+	}
+	return code, reason
+}
+
+// watchHealth probes daemon health until done is closed, updating the
+// status and restarting process group pgid if it becomes unhealthy (and the
+// check asks for that). finished is closed on return.
+func (ad *activeDaemon) watchHealth(hc *HealthCheck, pgid int, dir string, ident *identity, env []string, done, finished chan struct{}) {
+	defer close(finished)
+	interval, _, threshold := hc.settings()
+	dl := ad.log()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	failures := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		d, err := ad.h.Get(ad.id)
+		if err != nil {
+			return
+		}
+		in := d.instance(ad.instance)
+		if in.Status == "paused" {
+			// paused processes can't answer
+			failures = 0
+			continue
+		}
+		err = hc.probe(dir, ident, env)
+		if err == nil {
+			if in.Status == "unhealthy" {
+				dl.writeLine("hades", "health check passed, healthy again")
+			}
+			ad.setHealth("healthy")
+			failures = 0
+			continue
+		}
+		failures++
+		if failures > threshold {
+			// already reported
+			continue
+		}
+		msg := fmt.Sprintf("health check failed (%d/%d): %s", failures, threshold, err)
+		dl.writeLine("hades", msg)
+		if failures < threshold {
 			continue
 		}
-		ad.setStatus("running")
+		ad.setHealth("unhealthy")
+		if hc.Restart && !ad.exiting() {
+			dl.writeLine("hades", "unhealthy, restarting")
+			ad.restartProcess(pgid, "unhealthy")
+			return
+		}
+	}
+}
+
+// setHealth updates the status to "healthy" or "unhealthy" unless the
+// daemon has been paused or is stopping in the meantime.
+func (ad *activeDaemon) setHealth(status string) {
+	changed := false
+	ad.updateInstance(func(d *Daemon, in *Instance) {
+		switch in.Status {
+		case "running", "healthy", "unhealthy":
+			changed = in.Status != status
+			in.Status = status
+		}
+	})
+	if changed {
+		ad.addEvent(&Event{Type: EventStatus, Status: status})
 	}
 }
 
-// sigkill sends KILL signal to activeDaemon and updates status.
-func (ad *activeDaemon) sigkill() error {
+// restartProcess stops the daemon processes (process group pgid) so the
+// supervisor loop restarts them regardless of the restart policy. reason is
+// added to the exit reason.
+func (ad *activeDaemon) restartProcess(pgid int, reason string) {
+	ad.exitMutex.Lock()
+	ad.restartReason = reason
+	ad.exitMutex.Unlock()
+	d, err := ad.h.Get(ad.id)
+	if err != nil {
+		d = &Daemon{}
+	}
+	sig, timeout := d.stopSettings()
+	err = ad.signal(pgid, sig)
+	if err != nil {
+		return
+	}
+	ad.signal(pgid, syscall.SIGCONT)
+	ad.waitOrKill(pgid, timeout)
+}
+
+// takeRestartReason returns (once) why the process was stopped to be
+// restarted, or an empty string if it exited on its own.
+func (ad *activeDaemon) takeRestartReason() string {
 	ad.exitMutex.Lock()
 	defer ad.exitMutex.Unlock()
+	reason := ad.restartReason
+	ad.restartReason = ""
+	return reason
+}
+
+// setupCgroup creates the cgroup for d (nil if cgroups are disabled).
+func (ad *activeDaemon) setupCgroup(d *Daemon) (*cgroup, error) {
+	if ad.h.cgroupDir == "" {
+		if !d.Cgroup.empty() {
+			return nil, errors.New("hades: cgroup limits set but cgroups are unavailable")
+		}
+		return nil, nil
+	}
+	cg, err := newCgroup(ad.h.cgroupDir, ad.id, ad.instance)
+	if err != nil {
+		if !d.Cgroup.empty() {
+			return nil, err
+		}
+		// limits weren't asked for so run without a cgroup
+		log.Printf("%d: %s\n", ad.id, err)
+		return nil, nil
+	}
+	ad.pidMutex.Lock()
+	ad.cg = cg
+	ad.pidMutex.Unlock()
+	return cg, nil
+}
+
+// getCgroup returns the daemon cgroup (nil if not using one).
+func (ad *activeDaemon) getCgroup() *cgroup {
+	ad.pidMutex.Lock()
+	defer ad.pidMutex.Unlock()
+	return ad.cg
+}
+
+// watchOOM logs OOM kills in cg (starting from count ooms) until done is
+// closed. Children can be OOM killed without the main process exiting.
+func (ad *activeDaemon) watchOOM(cg *cgroup, ooms uint64, done chan struct{}) {
+	t := time.NewTicker(oomPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			n := cg.oomKills()
+			if n > ooms {
+				msg := fmt.Sprintf("OOM killer killed %d process(es) in cgroup", n-ooms)
+				ad.log().writeLine("hades", msg)
+				ooms = n
+			}
+		}
+	}
+}
+
+// setStarted records when the current process was started.
+func (ad *activeDaemon) setStarted(t time.Time) {
+	ad.updateInstance(func(d *Daemon, in *Instance) {
+		in.Started = t
+	})
+}
+
+// setExit records the exit code and reason of the last process.
+func (ad *activeDaemon) setExit(code int, reason string) {
+	ad.updateInstance(func(d *Daemon, in *Instance) {
+		in.ExitCode, in.ExitReason = code, reason
+		d.ExitCode, d.ExitReason = code, reason
+	})
+	ad.addEvent(&Event{Type: EventExit, Cause: reason, ExitCode: code})
+}
+
+// exiting returns true if the daemon has been asked to stop.
+func (ad *activeDaemon) exiting() bool {
+	ad.exitMutex.Lock()
+	defer ad.exitMutex.Unlock()
+	return ad.exit
+}
+
+// sleep waits for duration d and returns false if interrupted by a stop.
+func (ad *activeDaemon) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ad.quit:
+		return false
+	}
+}
+
+// getPid returns the pid of the running process (0 if not running).
+func (ad *activeDaemon) getPid() int {
+	ad.pidMutex.Lock()
+	defer ad.pidMutex.Unlock()
+	return ad.pid
+}
+
+// setPid sets the pid of the running process (0 when it exits).
+func (ad *activeDaemon) setPid(pid int) {
+	ad.pidMutex.Lock()
+	defer ad.pidMutex.Unlock()
+	ad.pid = pid
+}
+
+// setStartedPid sets the pid of a process that was just started, killing it
+// instead (returning false) if the daemon was stopped while it was starting
+// (stop found no process to signal then).
+func (ad *activeDaemon) setStartedPid(pid int) bool {
+	ad.exitMutex.Lock()
+	defer ad.exitMutex.Unlock()
+	if ad.exit {
+		ad.signal(pid, syscall.SIGKILL)
+		return false
+	}
+	ad.setPid(pid)
+	return true
+}
+
+// startProcess starts c with its output streams attached to the daemon log.
+func (ad *activeDaemon) startProcess(c *exec.Cmd) error {
+	dl := ad.log()
+	stdout, err := dl.pipe("stdout")
+	if err != nil {
+		return err
+	}
+	// parent copies of the write ends aren't needed once child has them
+	defer stdout.Close()
+	stderr, err := dl.pipe("stderr")
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+	c.Stdout = stdout
+	c.Stderr = stderr
+	return c.Start()
+}
+
+// stop asks the daemon to stop. The stop signal is sent to the process
+// group and, if it hasn't exited within the grace period, SIGKILL is sent.
+// user and cause are recorded in the stop event.
+func (ad *activeDaemon) stop(user, cause string) error {
+	ad.exitMutex.Lock()
+	defer ad.exitMutex.Unlock()
+	if ad.exit {
+		// already stopping
+		return nil
+	}
+	ad.addEvent(&Event{Type: EventStop, User: user, Cause: cause})
 	ad.setStatus("stopping")
 	ad.exit = true
-	if ad.pid == 0 {
-		// This happens when the process fails
-		return errors.New("daemon: bad pid")
+	close(ad.quit)
+	pid := ad.getPid()
+	if !ad.alive(pid) {
+		// This happens when the process fails or is waiting to restart
+		close(ad.stopped)
+		return nil
+	}
+	d, err := ad.h.Get(ad.id)
+	if err != nil {
+		d = &Daemon{}
 	}
-	err := syscall.Kill(-ad.pid, syscall.SIGKILL)
+	sig, timeout := d.stopSettings()
+	err = ad.signal(pid, sig)
 	if err != nil {
+		close(ad.stopped)
 		return err
 	}
+	// paused processes can't handle the signal until continued
+	ad.signal(pid, syscall.SIGCONT)
+	go ad.terminate(pid, timeout)
 	return nil
 }
 
+// signal sends sig to every process of the daemon: the whole cgroup when
+// using one (reaching descendants that left the process group), otherwise
+// process group pgid.
+func (ad *activeDaemon) signal(pgid int, sig syscall.Signal) error {
+	cg := ad.getCgroup()
+	if cg != nil {
+		cg.signal(sig)
+		return nil
+	}
+	if pgid == 0 {
+		// signaling pid 0 would hit our own process group
+		return errors.New("daemon: bad pid")
+	}
+	return syscall.Kill(-pgid, sig)
+}
+
+// alive returns true if any process of the daemon remains.
+func (ad *activeDaemon) alive(pgid int) bool {
+	cg := ad.getCgroup()
+	if cg != nil {
+		return cg.populated()
+	}
+	return pgid != 0 && groupAlive(pgid)
+}
+
+// terminate waits up to timeout for the daemon processes (process group
+// pgid) to exit before killing them, then marks the daemon as stopped.
+func (ad *activeDaemon) terminate(pgid int, timeout time.Duration) {
+	defer close(ad.stopped)
+	if !ad.waitOrKill(pgid, timeout) {
+		return
+	}
+	ad.exitMutex.Lock()
+	ad.killReason = fmt.Sprintf("killed by SIGKILL after %s stop timeout", timeout)
+	ad.exitMutex.Unlock()
+}
+
+// waitOrKill waits up to timeout for the daemon processes (process group
+// pgid) to exit, then kills them. Returns true if they had to be killed.
+func (ad *activeDaemon) waitOrKill(pgid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !ad.alive(pgid) {
+			return false
+		}
+		time.Sleep(stopPollInterval)
+	}
+	msg := fmt.Sprintf("still running after %s, sending SIGKILL", timeout)
+	ad.log().writeLine("hades", msg)
+	cg := ad.getCgroup()
+	if cg != nil {
+		cg.kill()
+	} else {
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+	// orphaned zombies can linger in the group so don't wait forever
+	deadline = time.Now().Add(killTimeout)
+	for ad.alive(pgid) && time.Now().Before(deadline) {
+		time.Sleep(stopPollInterval)
+	}
+	return true
+}
+
 // sigstop sends STOP signal to activeDaemon and updates status.
-func (ad *activeDaemon) sigstop() error {
-	err := syscall.Kill(-ad.pid, syscall.SIGSTOP)
+func (ad *activeDaemon) sigstop(user string) error {
+	pid := ad.getPid()
+	if pid == 0 {
+		// signaling pid 0 would hit our own process group
+		return errors.New("daemon: bad pid")
+	}
+	err := syscall.Kill(-pid, syscall.SIGSTOP)
 	if err != nil {
 		return err
 	}
 	ad.setStatus("paused")
+	ad.addEvent(&Event{Type: EventPause, User: user})
 	return nil
 }
 
 // sigcont sends CONT signal to activeDaemon and updates status.
-func (ad *activeDaemon) sigcont() error {
-	err := syscall.Kill(-ad.pid, syscall.SIGCONT)
+func (ad *activeDaemon) sigcont(user string) error {
+	pid := ad.getPid()
+	if pid == 0 {
+		// signaling pid 0 would hit our own process group
+		return errors.New("daemon: bad pid")
+	}
+	err := syscall.Kill(-pid, syscall.SIGCONT)
 	if err != nil {
 		return err
 	}
 	ad.setStatus("running")
+	ad.addEvent(&Event{Type: EventResume, User: user})
 	return nil
 }
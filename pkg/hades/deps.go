@@ -0,0 +1,291 @@
+package hades
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// What happens to dependents when a required daemon goes down.
+const (
+	// DependencyStop stops dependents when a required daemon exits.
+	DependencyStop = "stop"
+	// DependencyRestart restarts dependents (once the required daemon is
+	// ready again) when it exits.
+	DependencyRestart = "restart"
+)
+
+// interval between checks while waiting for dependencies to be ready.
+const dependencyPollInterval = 250 * time.Millisecond
+
+// validateDependencies returns an error if the dependency settings of d are
+// invalid (without checking the daemons they refer to).
+func (d *Daemon) validateDependencies() error {
+	switch d.OnDependencyDown {
+	case "", DependencyStop, DependencyRestart:
+	default:
+		return fmt.Errorf("hades: invalid dependency action %q", d.OnDependencyDown)
+	}
+	return nil
+}
+
+// dependencies returns the ids of all daemons d depends on (required or
+// ordered after).
+func (d *Daemon) dependencies() []uint64 {
+	ids := make([]uint64, 0, len(d.Requires)+len(d.After))
+	ids = append(ids, d.Requires...)
+	return append(ids, d.After...)
+}
+
+// requires returns true if d requires daemon id.
+func (d *Daemon) requires(id uint64) bool {
+	for _, dep := range d.Requires {
+		if dep == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ready returns true if d is up and can be depended on: healthy if it has
+// a health check, otherwise running.
+func (d *Daemon) ready() bool {
+	if d.Health.enabled() {
+		return d.Status == "healthy"
+	}
+	switch d.Status {
+	case "running", "healthy", "unhealthy":
+		return true
+	}
+	return false
+}
+
+// loadDaemons reads all daemons from bucket b by id.
+func loadDaemons(b *bolt.Bucket) (map[uint64]*Daemon, error) {
+	daemons := make(map[uint64]*Daemon)
+	err := b.ForEach(func(k, v []byte) error {
+		d := &Daemon{}
+		err := json.Unmarshal(v, d)
+		if err != nil {
+			return err
+		}
+		daemons[d.ID] = d
+		return nil
+	})
+	return daemons, err
+}
+
+// checkDependencies returns an error if d depends on unknown daemons or if
+// its dependencies would form a cycle. daemons holds every daemon by id
+// (d replaces its stored version).
+func checkDependencies(d *Daemon, daemons map[uint64]*Daemon) error {
+	for _, id := range d.dependencies() {
+		if id == d.ID {
+			return fmt.Errorf("hades: daemon can't depend on itself")
+		}
+		_, ok := daemons[id]
+		if !ok {
+			return fmt.Errorf("hades: unknown dependency %d", id)
+		}
+	}
+	// every other daemon was checked when saved so any cycle goes through d
+	visited := make(map[uint64]bool)
+	var visit func(id uint64) bool
+	visit = func(id uint64) bool {
+		if id == d.ID {
+			return true
+		}
+		if visited[id] {
+			return false
+		}
+		visited[id] = true
+		dep, ok := daemons[id]
+		if !ok {
+			return false
+		}
+		for _, next := range dep.dependencies() {
+			if visit(next) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, id := range d.dependencies() {
+		if visit(id) {
+			return fmt.Errorf("hades: dependency on %d creates a cycle", id)
+		}
+	}
+	return nil
+}
+
+// startOrder sorts ids so that dependencies come before the daemons
+// depending on them (otherwise keeping id order).
+func startOrder(ids []uint64, daemons map[uint64]*Daemon) []uint64 {
+	sorted := make([]uint64, len(ids))
+	copy(sorted, ids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	order := make([]uint64, 0, len(ids))
+	visited := make(map[uint64]bool)
+	include := make(map[uint64]bool)
+	for _, id := range ids {
+		include[id] = true
+	}
+	var visit func(id uint64)
+	visit = func(id uint64) {
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+		d, ok := daemons[id]
+		if ok {
+			for _, dep := range d.dependencies() {
+				visit(dep)
+			}
+		}
+		if include[id] {
+			order = append(order, id)
+		}
+	}
+	for _, id := range sorted {
+		visit(id)
+	}
+	return order
+}
+
+// requiredBy returns the ids of daemons required by daemon id (directly or
+// indirectly) in start order, followed by id itself.
+func (h *Hades) requiredBy(id uint64) ([]uint64, error) {
+	daemons := make(map[uint64]*Daemon)
+	err := h.db.View(func(tx *bolt.Tx) error {
+		var err error
+		daemons, err = loadDaemons(tx.Bucket(daemonBucket))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := daemons[id]; !ok {
+		return nil, ErrNotFound
+	}
+	ids := make([]uint64, 0)
+	seen := make(map[uint64]bool)
+	var visit func(id uint64)
+	visit = func(id uint64) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		ids = append(ids, id)
+		d, ok := daemons[id]
+		if !ok {
+			return
+		}
+		for _, dep := range d.Requires {
+			visit(dep)
+		}
+	}
+	visit(id)
+	order := startOrder(ids, daemons)
+	// id goes last even if it only orders itself after a requirement
+	for i, x := range order {
+		if x == id {
+			order = append(order[:i], order[i+1:]...)
+			break
+		}
+	}
+	return append(order, id), nil
+}
+
+// pendingDependency returns the id of a dependency of d that isn't ready
+// yet (0 if all are). Daemons ordered after are only waited for if they're
+// started too.
+func (h *Hades) pendingDependency(d *Daemon) uint64 {
+	for _, id := range d.Requires {
+		dep, err := h.Get(id)
+		if err != nil {
+			continue
+		}
+		if !dep.ready() {
+			return id
+		}
+	}
+	for _, id := range d.After {
+		_, err := h.getInstances(id)
+		if err != nil {
+			continue
+		}
+		dep, err := h.Get(id)
+		if err != nil {
+			continue
+		}
+		if !dep.ready() {
+			return id
+		}
+	}
+	return 0
+}
+
+// dependencyDown stops or restarts active daemons requiring daemon id
+// (according to their settings) after its process exited.
+func (h *Hades) dependencyDown(id uint64) {
+	daemons, err := h.Daemons()
+	if err != nil {
+		return
+	}
+	for _, d := range daemons {
+		if !d.requires(id) {
+			continue
+		}
+		instances, err := h.getInstances(d.ID)
+		if err != nil {
+			continue
+		}
+		for _, ad := range instances {
+			switch d.OnDependencyDown {
+			case DependencyStop:
+				msg := fmt.Sprintf("required daemon %d went down, stopping", id)
+				ad.log().writeLine("hades", msg)
+				ad.stop("", fmt.Sprintf("required daemon %d went down", id))
+			case DependencyRestart:
+				pid := ad.getPid()
+				if !ad.alive(pid) {
+					// not started yet (or already restarting)
+					continue
+				}
+				msg := fmt.Sprintf("required daemon %d went down, restarting", id)
+				ad.log().writeLine("hades", msg)
+				reason := fmt.Sprintf("required daemon %d went down", id)
+				go ad.restartProcess(pid, reason)
+			}
+		}
+	}
+}
+
+// waitDependencies blocks until the dependencies of d are ready, returning
+// false if the daemon is stopped while waiting.
+func (ad *activeDaemon) waitDependencies(d *Daemon) bool {
+	waiting := uint64(0)
+	for {
+		id := ad.h.pendingDependency(d)
+		if id == 0 {
+			if len(d.dependencies()) > 0 {
+				// started as "waiting"
+				ad.setStatus("running")
+			}
+			return true
+		}
+		if id != waiting {
+			msg := fmt.Sprintf("waiting for daemon %d", id)
+			ad.log().writeLine("hades", msg)
+			ad.setStatus("waiting")
+			ad.addEvent(&Event{Type: EventStatus, Status: "waiting", Cause: msg})
+			waiting = id
+		}
+		if !ad.sleep(dependencyPollInterval) {
+			return false
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package hades
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// Environment modes.
+const (
+	// EnvInherit passes the hades server environment to the daemon.
+	EnvInherit = "inherit"
+	// EnvClean starts the daemon with an empty environment.
+	EnvClean = "clean"
+	// EnvAllowlist passes only allowed server variables to the daemon.
+	EnvAllowlist = "allowlist"
+)
+
+// Environment represents the environment variables a daemon is started
+// with. Variables from File override the base environment and Vars
+// override both.
+type Environment struct {
+	// Mode is one of EnvInherit (default), EnvClean or EnvAllowlist.
+	Mode string `json:"mode,omitempty"`
+	// Allow lists the server variable names passed in EnvAllowlist mode.
+	Allow []string `json:"allow,omitempty"`
+	// File is an env file to load (relative to the daemon directory).
+	File string `json:"file,omitempty"`
+	// Vars are variables as "KEY=VALUE" strings.
+	Vars []string `json:"vars,omitempty"`
+}
+
+// validate returns an error if the environment settings are invalid.
+func (e *Environment) validate() error {
+	switch e.Mode {
+	case "", EnvInherit, EnvClean, EnvAllowlist:
+	default:
+		return fmt.Errorf("hades: invalid env mode %q", e.Mode)
+	}
+	for _, v := range e.Vars {
+		i := strings.Index(v, "=")
+		if i < 1 {
+			return fmt.Errorf("hades: invalid env variable %q", v)
+		}
+	}
+	for _, name := range e.Allow {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("hades: invalid env allowlist name %q", name)
+		}
+	}
+	return nil
+}
+
+// environ returns the environment for a daemon running in dir as ident.
+func (e *Environment) environ(dir string, ident *identity) ([]string, error) {
+	vars := newEnvMap()
+	switch e.Mode {
+	case EnvClean:
+	case EnvAllowlist:
+		for _, name := range e.Allow {
+			v, ok := os.LookupEnv(name)
+			if ok {
+				vars.set(name, v)
+			}
+		}
+	default:
+		vars.setAll(os.Environ())
+	}
+	if ident.cred != nil {
+		// the server's user variables would point at the wrong user
+		vars.set("HOME", ident.home)
+		vars.set("USER", ident.name)
+		vars.set("LOGNAME", ident.name)
+	}
+	if e.File != "" {
+		path := e.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		f, err := openEnvFile(path, ident)
+		if err != nil {
+			return nil, fmt.Errorf("hades: reading env file: %s", err)
+		}
+		m, err := godotenv.Parse(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("hades: reading env file: %s", err)
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			vars.set(k, m[k])
+		}
+	}
+	vars.setAll(e.Vars)
+	return vars.list(), nil
+}
+
+// envMap is an ordered set of environment variables.
+type envMap struct {
+	keys   []string
+	values map[string]string
+}
+
+// newEnvMap returns an empty envMap.
+func newEnvMap() *envMap {
+	return &envMap{
+		keys:   make([]string, 0),
+		values: make(map[string]string),
+	}
+}
+
+// set sets variable k to v, keeping its original position if it exists.
+func (m *envMap) set(k, v string) {
+	_, exists := m.values[k]
+	if !exists {
+		m.keys = append(m.keys, k)
+	}
+	m.values[k] = v
+}
+
+// setAll sets each "KEY=VALUE" string in vars.
+func (m *envMap) setAll(vars []string) {
+	for _, kv := range vars {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		m.set(kv[:i], kv[i+1:])
+	}
+}
+
+// list returns the variables as "KEY=VALUE" strings.
+func (m *envMap) list() []string {
+	out := make([]string, 0, len(m.keys))
+	for _, k := range m.keys {
+		out = append(out, k+"="+m.values[k])
+	}
+	return out
+}
@@ -0,0 +1,128 @@
+package hades
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// most symlinks followed in env file paths (like the kernel's limit).
+const maxEnvFileLinks = 40
+
+// openEnvFile opens env file path for a daemon running as ident. The file
+// is read by hades (usually root) so for other users the path is opened one
+// component at a time, only following symlinks owned by root in root's
+// directories. The file has to be owned by them or root and root's files
+// can't be hard links (so daemon users can't have files they aren't allowed
+// to read loaded into their environment).
+func openEnvFile(path string, ident *identity) (*os.File, error) {
+	if ident.cred == nil {
+		return os.Open(path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := openEnvPath(abs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	f := os.NewFile(uintptr(fd), path)
+	var st unix.Stat_t
+	err = unix.Fstat(fd, &st)
+	switch {
+	case err != nil:
+	case st.Mode&unix.S_IFMT != unix.S_IFREG:
+		err = fmt.Errorf("%s isn't a regular file", path)
+	case st.Uid != ident.cred.Uid && st.Uid != 0:
+		err = fmt.Errorf("%s has to be owned by %s or root", path, ident.name)
+	case st.Uid != ident.cred.Uid && st.Nlink > 1:
+		err = fmt.Errorf("%s is owned by root and has more than one link", path)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openEnvPath opens absolute path one component at a time without following
+// symlinks other than root's in directories owned by root (returning the
+// file descriptor).
+func openEnvPath(path string) (int, error) {
+	dirfd, err := unix.Open("/", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	names := strings.Split(path, "/")
+	links := 0
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		var st unix.Stat_t
+		err = unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			unix.Close(dirfd)
+			return -1, fmt.Errorf("%s: %s", name, err)
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			target, err := followEnvLink(dirfd, name, &st)
+			if err == nil {
+				links++
+				if links > maxEnvFileLinks {
+					err = fmt.Errorf("too many symlinks")
+				}
+			}
+			if err != nil {
+				unix.Close(dirfd)
+				return -1, err
+			}
+			if strings.HasPrefix(target, "/") {
+				unix.Close(dirfd)
+				dirfd, err = unix.Open("/", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+				if err != nil {
+					return -1, err
+				}
+			}
+			names = append(strings.Split(target, "/"), names...)
+			continue
+		}
+		flags := unix.O_RDONLY | unix.O_NOFOLLOW | unix.O_NONBLOCK | unix.O_CLOEXEC
+		if len(names) > 0 {
+			flags |= unix.O_DIRECTORY
+		}
+		// fails if name was replaced with a symlink since
+		fd, err := unix.Openat(dirfd, name, flags, 0)
+		unix.Close(dirfd)
+		if err != nil {
+			return -1, fmt.Errorf("%s: %s", name, err)
+		}
+		dirfd = fd
+	}
+	return dirfd, nil
+}
+
+// followEnvLink returns the target of symlink name (with stat st) in
+// directory dirfd if it and the directory are owned by root.
+func followEnvLink(dirfd int, name string, st *unix.Stat_t) (string, error) {
+	var dst unix.Stat_t
+	err := unix.Fstat(dirfd, &dst)
+	if err != nil {
+		return "", err
+	}
+	if st.Uid != 0 || dst.Uid != 0 {
+		return "", fmt.Errorf("%s is a symlink not owned by root (or in a directory not owned by root)", name)
+	}
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(dirfd, name, buf)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", name, err)
+	}
+	return string(buf[:n]), nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package hades
+
+import (
+	"errors"
+	"os"
+)
+
+// errEnvFileUser returned for env files of daemons running as other users
+// (which can't be opened safely without openat).
+var errEnvFileUser = errors.New("env files for daemons running as other users are only supported on linux")
+
+// openEnvFile opens env file path for a daemon running as ident (only
+// supported for daemons running as the hades user).
+func openEnvFile(path string, ident *identity) (*os.File, error) {
+	if ident.cred != nil {
+		return nil, errEnvFileUser
+	}
+	return os.Open(path)
+}
@@ -0,0 +1,216 @@
+package hades
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Event types.
+const (
+	// EventAdd is recorded when a daemon is added.
+	EventAdd = "add"
+	// EventUpdate is recorded when the definition of a daemon changes
+	// (including rollbacks).
+	EventUpdate = "update"
+	// EventScale is recorded when the number of instances of a daemon
+	// changes.
+	EventScale = "scale"
+	// EventRemove is recorded when a daemon is removed.
+	EventRemove = "remove"
+	// EventStart is recorded when a daemon is started.
+	EventStart = "start"
+	// EventStop is recorded when a daemon is asked to stop.
+	EventStop = "stop"
+	// EventPause is recorded when a daemon is paused.
+	EventPause = "pause"
+	// EventResume is recorded when a paused daemon is resumed.
+	EventResume = "resume"
+	// EventRun is recorded when a job run starts.
+	EventRun = "run"
+	// EventExit is recorded when a process exits (or fails to start).
+	EventExit = "exit"
+	// EventRestart is recorded when an exited process will be restarted.
+	EventRestart = "restart"
+	// EventStatus is recorded for other status changes (like becoming
+	// unhealthy or waiting for dependencies).
+	EventStatus = "status"
+	// EventLoginFailed is recorded for failed logins (not about a daemon).
+	EventLoginFailed = "login-failed"
+	// EventLockout is recorded when logins are locked out after too many
+	// failed ones (not about a daemon).
+	EventLockout = "lockout"
+)
+
+// number of events added between retention checks.
+const eventPruneInterval = 100
+
+// bolt.DB bucket for events (keyed by sequence number)
+var eventBucket = []byte("events")
+
+// Event represents a recorded state transition of a daemon (or a login
+// event, with Daemon 0).
+type Event struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Daemon uint64    `json:"daemon"`
+	// Instance is the instance it happened to (nil for the whole daemon or
+	// daemons with a single instance).
+	Instance *int   `json:"instance,omitempty"`
+	Type     string `json:"type"`
+	// Status is the new status (for EventStatus).
+	Status string `json:"status,omitempty"`
+	// Cause describes why it happened.
+	Cause string `json:"cause,omitempty"`
+	// User is who asked for it (empty when hades did it on its own).
+	User     string `json:"user,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+}
+
+// EventQuery selects recorded events.
+type EventQuery struct {
+	// Daemon only selects events of this daemon (0 for all).
+	Daemon uint64
+	// Types only selects events of these types (empty for all).
+	Types []string
+	// Exclude skips events of these types.
+	Exclude []string
+	// Since and Until select events in a time range (zero for no limit).
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of events returned (0 for no limit).
+	Limit int
+}
+
+// matches returns true if e is selected by q.
+func (q *EventQuery) matches(e *Event) bool {
+	if q.Daemon != 0 && e.Daemon != q.Daemon {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	for _, t := range q.Exclude {
+		if t == e.Type {
+			return false
+		}
+	}
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, t := range q.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Events returns recorded events selected by q (all if nil), newest first.
+func (h *Hades) Events(q *EventQuery) ([]*Event, error) {
+	if q == nil {
+		q = &EventQuery{}
+	}
+	events := make([]*Event, 0)
+	err := h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(eventBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if q.Limit > 0 && len(events) >= q.Limit {
+				break
+			}
+			e := &Event{}
+			err := json.Unmarshal(v, e)
+			if err != nil {
+				return err
+			}
+			if !q.Since.IsZero() && e.Time.Before(q.Since) {
+				break
+			}
+			if q.matches(e) {
+				events = append(events, e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// RecordEvent records event e that isn't about a daemon (like a failed
+// login).
+func (h *Hades) RecordEvent(e *Event) error {
+	e.Daemon = 0
+	return h.addEvent(e)
+}
+
+// addEvent records event e (setting its sequence number and time).
+func (h *Hades) addEvent(e *Event) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.Seq = seq
+		if e.Time.IsZero() {
+			e.Time = time.Now()
+		}
+		enc, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		err = b.Put(itob(seq), enc)
+		if err != nil {
+			return err
+		}
+		if seq%eventPruneInterval != 0 {
+			return nil
+		}
+		return h.pruneEvents(b)
+	})
+}
+
+// pruneEvents deletes events from b older than the maximum age and the
+// oldest ones beyond the maximum count.
+func (h *Hades) pruneEvents(b *bolt.Bucket) error {
+	excess := 0
+	if h.opts.EventMaxCount > 0 {
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			excess++
+		}
+		excess -= h.opts.EventMaxCount
+	}
+	var cutoff time.Time
+	if h.opts.EventMaxAge > 0 {
+		cutoff = time.Now().Add(-h.opts.EventMaxAge)
+	}
+	keys := make([][]byte, 0)
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if len(keys) >= excess {
+			if cutoff.IsZero() {
+				break
+			}
+			e := &Event{}
+			err := json.Unmarshal(v, e)
+			if err != nil {
+				return err
+			}
+			if !e.Time.Before(cutoff) {
+				break
+			}
+		}
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		err := b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
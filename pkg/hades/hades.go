@@ -4,7 +4,10 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -18,22 +21,89 @@ var (
 	ErrAlreadyStarted = errors.New("hades: already started")
 	// ErrNotStarted returned when stopping daemon not started.
 	ErrNotStarted = errors.New("hades: not started")
+	// ErrStopping returned when starting instances whose numbers are still
+	// used by instances stopping after scaling down.
+	ErrStopping = errors.New("hades: scaled down instances are still stopping")
 )
 
 // bolt.DB bucket for daemons
 var daemonBucket = []byte("daemons")
 
+// Options represents settings used by Hades.
+type Options struct {
+	// LogDir is the directory daemon output logs are written to.
+	LogDir string
+	// LogMaxSize is the size (in bytes) a log can reach before rotation.
+	LogMaxSize int64
+	// LogMaxAge is the age a log can reach before rotation.
+	LogMaxAge time.Duration
+	// LogMaxBackups is the number of rotated logs to keep (0 keeps all).
+	LogMaxBackups int
+	// LogCompress enables gzip compression of rotated logs.
+	LogCompress bool
+	// CgroupDir is the cgroup v2 directory daemon cgroups are created in
+	// (empty to disable cgroups).
+	CgroupDir string
+	// EventMaxAge is the age events are kept for (0 keeps them forever).
+	EventMaxAge time.Duration
+	// EventMaxCount is the number of events kept (0 keeps all).
+	EventMaxCount int
+}
+
+// DefaultOptions returns the default Hades options.
+func DefaultOptions() *Options {
+	return &Options{
+		LogDir:        "logs",
+		LogMaxSize:    10 * 1024 * 1024,
+		LogMaxAge:     24 * time.Hour,
+		LogMaxBackups: 10,
+		LogCompress:   true,
+		CgroupDir:     defaultCgroupDir(),
+		EventMaxAge:   30 * 24 * time.Hour,
+		EventMaxCount: 10000,
+	}
+}
+
 // Hades represents main daemon manager.
 type Hades struct {
 	db          *bolt.DB
+	opts        *Options
+	cgroupDir   string
 	activeMutex sync.RWMutex
-	active      map[uint64]*activeDaemon
+	// active instances by daemon id and instance number
+	active map[uint64]map[int]*activeDaemon
+	// instances removed by scaling down that are still stopping (their
+	// numbers can't be used again until they're gone)
+	stopping  map[uint64]map[int]*activeDaemon
+	logsMutex sync.Mutex
+	logs      map[logKey]*daemonLog
 }
 
-// NewHades returns new Hades instance from dbPath.
-func NewHades(db *bolt.DB) (*Hades, error) {
+// logKey identifies the output log of a daemon instance.
+type logKey struct {
+	id       uint64
+	instance int
+}
+
+// NewHades returns new Hades instance from db and opts (nil for defaults).
+func NewHades(db *bolt.DB, opts *Options) (*Hades, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
 	err := db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(daemonBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(runBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(eventBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(revisionBucket)
 		return err
 	})
 	if err != nil {
@@ -41,45 +111,60 @@ func NewHades(db *bolt.DB) (*Hades, error) {
 	}
 	h := &Hades{
 		db:          db,
+		opts:        opts,
 		activeMutex: sync.RWMutex{},
-		active:      make(map[uint64]*activeDaemon),
+		active:      make(map[uint64]map[int]*activeDaemon),
+		stopping:    make(map[uint64]map[int]*activeDaemon),
+		logsMutex:   sync.Mutex{},
+		logs:        make(map[logKey]*daemonLog),
 	}
-	// Start all active daemons
+	if opts.CgroupDir != "" {
+		err = setupCgroupDir(opts.CgroupDir)
+		if err != nil {
+			log.Printf("cgroups disabled: %s\n", err)
+		} else {
+			h.cgroupDir = opts.CgroupDir
+		}
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return h.pruneEvents(tx.Bucket(eventBucket))
+	})
+	if err != nil {
+		return nil, err
+	}
+	go h.sampleStats()
+	// Start all active daemons (dependencies first)
 	active, err := h.getActive()
 	if err != nil {
 		return nil, err
 	}
 	for _, id := range active {
-		err := h.Start(id)
-		if err != nil {
+		err := h.startRequired(id, "", "hades started")
+		if err != nil && err != ErrAlreadyStarted {
 			return nil, err
 		}
 	}
 	return h, nil
 }
 
-// Return array of ids for running daemons
+// Return array of ids for running daemons in start order
 func (h *Hades) getActive() ([]uint64, error) {
 	ids := make([]uint64, 0)
+	var daemons map[uint64]*Daemon
 	err := h.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(daemonBucket)
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			d := &Daemon{}
-			err := json.Unmarshal(v, d)
-			if err != nil {
-				return err
-			}
-			if !d.Disabled {
-				ids = append(ids, d.ID)
-			}
-		}
-		return nil
+		var err error
+		daemons, err = loadDaemons(tx.Bucket(daemonBucket))
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
-	return ids, nil
+	for id, d := range daemons {
+		if !d.Disabled {
+			ids = append(ids, id)
+		}
+	}
+	return startOrder(ids, daemons), nil
 }
 
 // Daemons returns array of all daemons.
@@ -110,6 +195,9 @@ func (h *Hades) Get(id uint64) (*Daemon, error) {
 	err := h.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(daemonBucket)
 		v := b.Get(itob(id))
+		if v == nil {
+			return ErrNotFound
+		}
 		err := json.Unmarshal(v, d)
 		if err != nil {
 			return err
@@ -122,16 +210,35 @@ func (h *Hades) Get(id uint64) (*Daemon, error) {
 	return d, nil
 }
 
-// Add adds a new daemon to Hades from cmd, dir.
-func (h *Hades) Add(cmd, dir string) (*Daemon, error) {
+// Add adds a new daemon to Hades from the definition in def (ID and status
+// fields are ignored). user is who added it (for the event history).
+func (h *Hades) Add(def *Daemon, user string) (*Daemon, error) {
 	d := &Daemon{
-		Cmd:      cmd,
-		Dir:      dir,
-		Status:   "stopped",
+		Name:     def.Name,
+		Cmd:      def.Cmd,
+		Dir:      def.Dir,
+		Instance: Instance{Status: "stopped"},
 		Disabled: true,
 	}
-	err := h.db.Update(func(tx *bolt.Tx) error {
+	d.copySettings(def)
+	err := d.validate()
+	if err != nil {
+		return nil, err
+	}
+	err = h.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(daemonBucket)
+		daemons, err := loadDaemons(b)
+		if err != nil {
+			return err
+		}
+		err = checkName(d, daemons)
+		if err != nil {
+			return err
+		}
+		err = checkDependencies(d, daemons)
+		if err != nil {
+			return err
+		}
 		id, err := b.NextSequence()
 		if err != nil {
 			return err
@@ -141,16 +248,22 @@ func (h *Hades) Add(cmd, dir string) (*Daemon, error) {
 		if err != nil {
 			return err
 		}
-		return b.Put(itob(id), enc)
+		err = b.Put(itob(id), enc)
+		if err != nil {
+			return err
+		}
+		_, err = saveRevision(tx, d, nil, user, "")
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
+	h.addEvent(&Event{Daemon: d.ID, Type: EventAdd, User: user, Cause: d.Cmd})
 	return d, nil
 }
 
-// Remove removes a daemon from Hades.
-func (h *Hades) Remove(id uint64) error {
+// Remove removes a daemon from Hades (its events are kept).
+func (h *Hades) Remove(id uint64, user string) error {
 	h.activeMutex.Lock()
 	defer h.activeMutex.Unlock()
 	_, exists := h.active[id]
@@ -159,82 +272,242 @@ func (h *Hades) Remove(id uint64) error {
 	}
 	err := h.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(daemonBucket)
+		daemons, err := loadDaemons(b)
+		if err != nil {
+			return err
+		}
+		for _, d := range daemons {
+			for _, dep := range d.dependencies() {
+				if dep == id {
+					return fmt.Errorf("hades: daemon %d depends on it", d.ID)
+				}
+			}
+		}
+		err = removeRuns(tx, id)
+		if err != nil {
+			return err
+		}
+		err = removeRevisions(tx, id)
+		if err != nil {
+			return err
+		}
 		return b.Delete(itob(id))
 	})
 	if err != nil {
 		return err
 	}
+	h.closeLog(id)
+	h.addEvent(&Event{Daemon: id, Type: EventRemove, User: user})
 	return nil
 }
 
-// Start starts a daemon.
-func (h *Hades) Start(id uint64) error {
+// Logs returns up to n of the most recent output lines for an instance of
+// a daemon (all buffered lines if n <= 0).
+func (h *Hades) Logs(id uint64, instance int, n int) ([]*LogLine, error) {
+	err := h.checkInstance(id, instance)
+	if err != nil {
+		return nil, err
+	}
+	return h.getLog(id, instance).tail(n), nil
+}
+
+// LogsSince returns buffered output lines for an instance of a daemon with
+// a sequence number greater than seq.
+func (h *Hades) LogsSince(id uint64, instance int, seq uint64) ([]*LogLine, error) {
+	err := h.checkInstance(id, instance)
+	if err != nil {
+		return nil, err
+	}
+	return h.getLog(id, instance).since(seq), nil
+}
+
+// SubscribeLogs returns a channel receiving new output lines for an
+// instance of a daemon and a function to cancel the subscription. The
+// channel is closed when the subscription ends (including when the
+// subscriber falls too far behind).
+func (h *Hades) SubscribeLogs(id uint64, instance int) (<-chan *LogLine, func(), error) {
+	err := h.checkInstance(id, instance)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, cancel := h.getLog(id, instance).subscribe()
+	return ch, cancel, nil
+}
+
+// getLog returns the output log for an instance of daemon id, creating it
+// if needed.
+func (h *Hades) getLog(id uint64, instance int) *daemonLog {
+	h.logsMutex.Lock()
+	defer h.logsMutex.Unlock()
+	k := logKey{id, instance}
+	dl, exists := h.logs[k]
+	if !exists {
+		dl = newDaemonLog(h.opts, id, instance)
+		h.logs[k] = dl
+	}
+	return dl
+}
+
+// closeLog closes and forgets the output logs for daemon id.
+func (h *Hades) closeLog(id uint64) {
+	h.logsMutex.Lock()
+	defer h.logsMutex.Unlock()
+	for k, dl := range h.logs {
+		if k.id == id {
+			dl.close()
+			delete(h.logs, k)
+		}
+	}
+}
+
+// Start starts a daemon along with the daemons it requires. user is who
+// started it (for the event history).
+func (h *Hades) Start(id uint64, user string) error {
+	return h.startRequired(id, user, "")
+}
+
+// startRequired starts a daemon along with the daemons it requires,
+// recording cause in their start events.
+func (h *Hades) startRequired(id uint64, user, cause string) error {
+	order, err := h.requiredBy(id)
+	if err != nil {
+		return err
+	}
+	for _, dep := range order[:len(order)-1] {
+		depCause := fmt.Sprintf("required by daemon %d", id)
+		err = h.start(dep, user, depCause)
+		if err != nil && err != ErrAlreadyStarted {
+			return err
+		}
+	}
+	return h.start(id, user, cause)
+}
+
+// start starts every instance of a single daemon (which waits for its
+// dependencies).
+func (h *Hades) start(id uint64, user, cause string) error {
 	h.activeMutex.Lock()
 	defer h.activeMutex.Unlock()
 	_, exists := h.active[id]
 	if exists {
 		return ErrAlreadyStarted
 	}
-	err := h.db.Update(func(tx *bolt.Tx) error {
+	replicas := 0
+	err := h.update(id, func(d *Daemon) error {
+		replicas = d.replicas()
+		if h.stillStopping(id, replicas) {
+			return ErrStopping
+		}
+		d.Disabled = false
+		for i := 0; i < replicas; i++ {
+			in := d.instance(i)
+			in.Restarts = 0
+			in.Status = d.initialStatus()
+		}
+		d.Instances = d.Instances[:replicas]
+		d.summarize()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	h.addEvent(&Event{Daemon: id, Type: EventStart, User: user, Cause: cause})
+	instances := make(map[int]*activeDaemon, replicas)
+	for i := 0; i < replicas; i++ {
+		instances[i] = newActiveDaemon(h, id, i)
+	}
+	h.active[id] = instances
+	return nil
+}
+
+// update loads daemon id, applies fn and saves it in a single transaction.
+func (h *Hades) update(id uint64, fn func(d *Daemon) error) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(daemonBucket)
 		v := b.Get(itob(id))
+		if v == nil {
+			return ErrNotFound
+		}
 		d := &Daemon{}
 		err := json.Unmarshal(v, d)
 		if err != nil {
 			return err
 		}
-		d.Disabled = false
+		err = fn(d)
+		if err != nil {
+			return err
+		}
 		enc, err := json.Marshal(d)
 		if err != nil {
 			return err
 		}
 		return b.Put(itob(id), enc)
 	})
-	if err != nil {
-		return err
-	}
-	h.active[id] = newActiveDaemon(h, id)
-	return nil
 }
 
-// getActiveDaemon returns an active daemon (if exists).
-func (h *Hades) getActiveDaemon(id uint64) (*activeDaemon, error) {
-	h.activeMutex.RLock()
-	defer h.activeMutex.RUnlock()
-	ad, exists := h.active[id]
-	if !exists {
-		return nil, ErrNotStarted
+// CgroupUsage returns resource usage of a running daemon read from the
+// cgroups of its instances (nil if the daemon isn't in a cgroup).
+func (h *Hades) CgroupUsage(id uint64) (*CgroupUsage, error) {
+	instances, err := h.getInstances(id)
+	if err != nil {
+		return nil, err
+	}
+	var total *CgroupUsage
+	for _, ad := range instances {
+		cg := ad.getCgroup()
+		if cg == nil {
+			continue
+		}
+		u := cg.usage()
+		if total == nil {
+			total = &CgroupUsage{}
+		}
+		total.MemoryCurrent += u.MemoryCurrent
+		total.MemoryPeak += u.MemoryPeak
+		total.CPUUsage += u.CPUUsage
+		total.PidsCurrent += u.PidsCurrent
+		total.OOMKills += u.OOMKills
 	}
-	return ad, nil
+	return total, nil
 }
 
-// Stop sends "KILL" signal to running daemon.
-func (h *Hades) Stop(id uint64) error {
-	ad, err := h.getActiveDaemon(id)
+// Stop sends the stop signal (SIGTERM by default) to every instance of a
+// running daemon, escalating to "KILL" if it doesn't exit within its stop
+// timeout. user is who stopped it (for the event history).
+func (h *Hades) Stop(id uint64, user string) error {
+	instances, err := h.getInstances(id)
 	if err != nil {
 		return err
 	}
-	ad.sigkill()
+	for _, ad := range instances {
+		ad.stop(user, "")
+	}
 	return nil
 }
 
-// Pause sends a "STOP" signal to running daemon to pause it.
-func (h *Hades) Pause(id uint64) error {
-	ad, err := h.getActiveDaemon(id)
+// Pause sends a "STOP" signal to the instances of a running daemon to
+// pause it.
+func (h *Hades) Pause(id uint64, user string) error {
+	instances, err := h.getInstances(id)
 	if err != nil {
 		return err
 	}
-	ad.sigstop()
+	for _, ad := range instances {
+		ad.sigstop(user)
+	}
 	return nil
 }
 
-// Resume sends a "CONT" signal to a paused daemon to resume it.
-func (h *Hades) Resume(id uint64) error {
-	ad, err := h.getActiveDaemon(id)
+// Resume sends a "CONT" signal to the instances of a paused daemon to
+// resume it.
+func (h *Hades) Resume(id uint64, user string) error {
+	instances, err := h.getInstances(id)
 	if err != nil {
 		return err
 	}
-	ad.sigcont()
+	for _, ad := range instances {
+		ad.sigcont(user)
+	}
 	return nil
 }
 
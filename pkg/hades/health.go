@@ -0,0 +1,203 @@
+package hades
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/shlex"
+)
+
+// Health check types.
+const (
+	// HealthHTTP checks that an HTTP GET returns the expected status code.
+	HealthHTTP = "http"
+	// HealthTCP checks that a TCP connection can be made.
+	HealthTCP = "tcp"
+	// HealthExec checks that a command exits with code 0.
+	HealthExec = "exec"
+)
+
+// default health check settings.
+const (
+	defaultHealthInterval  = 10 * time.Second
+	defaultHealthTimeout   = 5 * time.Second
+	defaultHealthThreshold = 3
+	defaultHealthStatus    = http.StatusOK
+)
+
+// how long exec probes wait for their output after exiting or being killed
+// (processes they left behind could keep it open).
+const probeWaitDelay = time.Second
+
+// HealthCheck represents a probe run periodically against a running daemon.
+type HealthCheck struct {
+	// Type is one of HealthHTTP, HealthTCP or HealthExec (empty to disable).
+	Type string `json:"type,omitempty"`
+	// Target is the URL, host:port address or command to check ($PORT and
+	// $HADES_INSTANCE are replaced by the values of the checked instance).
+	Target string `json:"target,omitempty"`
+	// Status is the expected HTTP status code (default 200).
+	Status int `json:"status,omitempty"`
+	// Interval is the time between checks (default 10s).
+	Interval Duration `json:"interval,omitempty"`
+	// Timeout is how long a single check can take (default 5s).
+	Timeout Duration `json:"timeout,omitempty"`
+	// Threshold is the number of consecutive failures before the daemon is
+	// considered unhealthy (default 3).
+	Threshold int `json:"threshold,omitempty"`
+	// Restart restarts the daemon when it becomes unhealthy.
+	Restart bool `json:"restart,omitempty"`
+}
+
+// enabled returns true if a health check is configured.
+func (hc *HealthCheck) enabled() bool {
+	return hc.Type != ""
+}
+
+// validate returns an error if the health check settings are invalid.
+func (hc *HealthCheck) validate() error {
+	switch hc.Type {
+	case "":
+		return nil
+	case HealthHTTP:
+		if !strings.HasPrefix(hc.Target, "http://") && !strings.HasPrefix(hc.Target, "https://") {
+			return fmt.Errorf("hades: invalid health check url %q", hc.Target)
+		}
+	case HealthTCP:
+		_, _, err := net.SplitHostPort(hc.Target)
+		if err != nil {
+			return fmt.Errorf("hades: invalid health check address %q", hc.Target)
+		}
+	case HealthExec:
+		parts, err := shlex.Split(hc.Target)
+		if err != nil || len(parts) == 0 {
+			return fmt.Errorf("hades: invalid health check command %q", hc.Target)
+		}
+	default:
+		return fmt.Errorf("hades: invalid health check type %q", hc.Type)
+	}
+	if hc.Status != 0 && (hc.Status < 100 || hc.Status > 599) {
+		return fmt.Errorf("hades: invalid health check status %d", hc.Status)
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return errors.New("hades: health check durations can't be negative")
+	}
+	if hc.Threshold < 0 {
+		return fmt.Errorf("hades: invalid health check threshold %d", hc.Threshold)
+	}
+	return nil
+}
+
+// settings returns interval, timeout and failure threshold with defaults
+// applied.
+func (hc *HealthCheck) settings() (time.Duration, time.Duration, int) {
+	interval := time.Duration(hc.Interval)
+	if interval == 0 {
+		interval = defaultHealthInterval
+	}
+	timeout := time.Duration(hc.Timeout)
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	threshold := hc.Threshold
+	if threshold == 0 {
+		threshold = defaultHealthThreshold
+	}
+	return interval, timeout, threshold
+}
+
+// probe runs the check once for a daemon in dir running as ident with
+// environment env, returning an error describing any failure. $PORT and
+// $HADES_INSTANCE in the target are replaced by the instance values.
+func (hc *HealthCheck) probe(dir string, ident *identity, env []string) error {
+	_, timeout, _ := hc.settings()
+	target := expandTarget(hc.Target, env)
+	switch hc.Type {
+	case HealthHTTP:
+		return hc.probeHTTP(target, timeout)
+	case HealthTCP:
+		conn, err := net.DialTimeout("tcp", target, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case HealthExec:
+		return hc.probeExec(target, timeout, dir, ident, env)
+	}
+	return nil
+}
+
+// probeHTTP requests the target URL and compares the response status.
+func (hc *HealthCheck) probeHTTP(target string, timeout time.Duration) error {
+	client := &http.Client{
+		Timeout: timeout,
+		// redirects are reported as their own status code
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	status := hc.Status
+	if status == 0 {
+		status = defaultHealthStatus
+	}
+	if resp.StatusCode != status {
+		return fmt.Errorf("got status %d, expected %d", resp.StatusCode, status)
+	}
+	return nil
+}
+
+// probeExec runs the target command (as the daemon user) and checks that it
+// exits successfully.
+func (hc *HealthCheck) probeExec(target string, timeout time.Duration, dir string, ident *identity, env []string) error {
+	parts, err := shlex.Split(target)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, parts[0], parts[1:]...)
+	c.Dir = dir
+	c.Env = env
+	// in its own process group so everything it started is killed on
+	// timeout
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: ident.cred}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	c.WaitDelay = probeWaitDelay
+	out, err := c.CombinedOutput()
+	if c.Process != nil {
+		// anything it left running
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err == exec.ErrWaitDelay {
+		// exited successfully, only left something running with its output
+		err = nil
+	}
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if i := strings.Index(msg, "\n"); i >= 0 {
+			msg = msg[:i]
+		}
+		if msg != "" {
+			return fmt.Errorf("%s: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,387 @@
+package hades
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Daemon kinds.
+const (
+	// KindDaemon is a long-running process (the default).
+	KindDaemon = "daemon"
+	// KindJob is a process run on a schedule.
+	KindJob = "job"
+)
+
+// Overlap policies for job runs that are due while the previous one is
+// still running.
+const (
+	// OverlapSkip skips the new run.
+	OverlapSkip = "skip"
+	// OverlapQueue starts the new run when the previous one finishes.
+	OverlapQueue = "queue"
+	// OverlapKill kills the previous run and starts the new one.
+	OverlapKill = "kill"
+)
+
+// maximum number of queued job runs.
+const maxQueuedRuns = 10
+
+// number of job runs kept per job.
+const maxJobRuns = 100
+
+// bolt.DB bucket for job runs (with a nested bucket per job)
+var runBucket = []byte("runs")
+
+// ErrNotJob returned when running a daemon that isn't a job.
+var ErrNotJob = errors.New("hades: not a job")
+
+// Schedule represents when a job runs.
+type Schedule struct {
+	// Cron is a cron expression with optional leading seconds field (like
+	// "*/30 * * * * *"), a descriptor like "@daily" or "@every 5m".
+	Cron string `json:"cron,omitempty"`
+	// Timezone is the location cron times are in (default local).
+	Timezone string `json:"timezone,omitempty"`
+	// Overlap is one of OverlapSkip (default), OverlapQueue or OverlapKill.
+	Overlap string `json:"overlap,omitempty"`
+	// CatchUp runs the job once after hades starts if a run was missed.
+	CatchUp bool `json:"catch_up,omitempty"`
+}
+
+// JobRun represents a single run of a job.
+type JobRun struct {
+	Seq        uint64    `json:"seq"`
+	Scheduled  time.Time `json:"scheduled"`
+	Start      time.Time `json:"start"`
+	Duration   Duration  `json:"duration"`
+	ExitCode   int       `json:"exit_code"`
+	ExitReason string    `json:"exit_reason"`
+}
+
+// validate returns an error if the schedule is invalid.
+func (s *Schedule) validate() error {
+	_, _, err := s.parse()
+	if err != nil {
+		return err
+	}
+	switch s.Overlap {
+	case "", OverlapSkip, OverlapQueue, OverlapKill:
+	default:
+		return fmt.Errorf("hades: invalid overlap policy %q", s.Overlap)
+	}
+	return nil
+}
+
+// parse returns the parsed cron expression and location.
+func (s *Schedule) parse() (schedule, *time.Location, error) {
+	if s.Cron == "" {
+		return nil, nil, errors.New("hades: job needs a schedule")
+	}
+	sched, err := parseSchedule(s.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sched.next(time.Now()).IsZero() {
+		return nil, nil, fmt.Errorf("hades: schedule %q never runs", s.Cron)
+	}
+	loc := time.Local
+	if s.Timezone != "" {
+		loc, err = time.LoadLocation(s.Timezone)
+		if err != nil {
+			return nil, nil, fmt.Errorf("hades: unknown timezone %q", s.Timezone)
+		}
+	}
+	return sched, loc, nil
+}
+
+// Next returns the first scheduled time after t.
+func (s *Schedule) Next(t time.Time) (time.Time, error) {
+	sched, loc, err := s.parse()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sched.next(t.In(loc)), nil
+}
+
+// validateKind returns an error if the kind (and schedule for jobs) of d is
+// invalid.
+func (d *Daemon) validateKind() error {
+	switch d.Kind {
+	case "", KindDaemon:
+		return nil
+	case KindJob:
+		return d.Schedule.validate()
+	}
+	return fmt.Errorf("hades: invalid kind %q", d.Kind)
+}
+
+// Runs returns up to n of the most recent runs of a job, newest first (all
+// kept runs if n <= 0).
+func (h *Hades) Runs(id uint64, n int) ([]*JobRun, error) {
+	_, err := h.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]*JobRun, 0)
+	err = h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(runBucket).Bucket(itob(id))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if n > 0 && len(runs) >= n {
+				break
+			}
+			r := &JobRun{}
+			err := json.Unmarshal(v, r)
+			if err != nil {
+				return err
+			}
+			runs = append(runs, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// RunJob runs a scheduled job now (following its overlap policy). user is
+// who asked for the run (for the event history).
+func (h *Hades) RunJob(id uint64, user string) error {
+	d, err := h.Get(id)
+	if err != nil {
+		return err
+	}
+	if d.Kind != KindJob {
+		return ErrNotJob
+	}
+	instances, err := h.getInstances(id)
+	if err != nil {
+		return err
+	}
+	// jobs have a single instance
+	select {
+	case instances[0].trigger <- user:
+	default:
+		// already triggered
+	}
+	return nil
+}
+
+// addRun records a job run, dropping the oldest ones beyond maxJobRuns.
+func (h *Hades) addRun(id uint64, r *JobRun) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(runBucket).CreateBucketIfNotExists(itob(id))
+		if err != nil {
+			return err
+		}
+		r.Seq, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		enc, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		err = b.Put(itob(r.Seq), enc)
+		if err != nil {
+			return err
+		}
+		keys := make([][]byte, 0)
+		b.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte(nil), k...))
+			return nil
+		})
+		for i := 0; i < len(keys)-maxJobRuns; i++ {
+			err = b.Delete(keys[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// removeRuns deletes all recorded runs of a job.
+func removeRuns(tx *bolt.Tx, id uint64) error {
+	err := tx.Bucket(runBucket).DeleteBucket(itob(id))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
+
+// queuedRun is a job run waiting to start.
+type queuedRun struct {
+	scheduled time.Time
+	// user and cause are recorded in the run event
+	user  string
+	cause string
+}
+
+// jobRun is a job run in progress.
+type jobRun struct {
+	run  *JobRun
+	pid  int
+	ooms uint64
+	// done receives the run when the process exits
+	done chan *JobRun
+}
+
+// schedule runs the job described by l on its schedule until it's stopped.
+func (ad *activeDaemon) schedule(l *launcher) {
+	h := ad.h
+	dl := ad.log()
+	d := l.d
+	sched, loc, err := d.Schedule.parse()
+	if err != nil {
+		dl.writeLine("hades", err.Error())
+		return
+	}
+	now := time.Now().In(loc)
+	next := sched.next(now)
+	var current *jobRun
+	queued := make([]queuedRun, 0)
+	if d.Schedule.CatchUp {
+		runs, err := h.Runs(ad.id, 1)
+		if err == nil && len(runs) > 0 {
+			missed := sched.next(runs[0].Scheduled.In(loc))
+			if !missed.IsZero() && missed.Before(now) {
+				dl.writeLine("hades", fmt.Sprintf("catching up missed run at %s", missed.Format(time.RFC3339)))
+				queued = append(queued, queuedRun{scheduled: missed, cause: "catch up"})
+			}
+		}
+	}
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	start := func(q queuedRun) {
+		if id := h.pendingDependency(d); id != 0 {
+			dl.writeLine("hades", fmt.Sprintf("skipping run, daemon %d isn't ready", id))
+			return
+		}
+		current = ad.startRun(l, q)
+	}
+	for {
+		if current == nil && ad.exiting() {
+			return
+		}
+		if current == nil && len(queued) > 0 {
+			q := queued[0]
+			queued = queued[1:]
+			start(q)
+		}
+		var done chan *JobRun
+		if current != nil {
+			done = current.done
+		}
+		select {
+		case <-ad.quit:
+			if current != nil {
+				// stop() is killing the run
+				h.addRun(ad.id, <-current.done)
+			}
+			return
+		case user := <-ad.trigger:
+			q := queuedRun{scheduled: time.Now().In(loc), user: user, cause: "run now"}
+			queued = ad.overlap(d, current, queued, q)
+		case <-timer.C:
+			q := queuedRun{scheduled: next, cause: "scheduled"}
+			queued = ad.overlap(d, current, queued, q)
+			next = sched.next(time.Now().In(loc))
+			if next.IsZero() {
+				dl.writeLine("hades", "schedule has no more runs")
+				timer.Stop()
+			} else {
+				timer.Reset(time.Until(next))
+			}
+		case run := <-done:
+			h.addRun(ad.id, run)
+			current = nil
+			if !ad.exiting() {
+				ad.setStatus("scheduled")
+			}
+		}
+	}
+}
+
+// overlap applies the overlap policy of job d for run q while current (nil
+// if none) is running, returning the new queue.
+func (ad *activeDaemon) overlap(d *Daemon, current *jobRun, queued []queuedRun, q queuedRun) []queuedRun {
+	if current == nil {
+		return append(queued, q)
+	}
+	dl := ad.log()
+	switch d.Schedule.Overlap {
+	case OverlapQueue:
+		if len(queued) >= maxQueuedRuns {
+			dl.writeLine("hades", "too many queued runs, skipping")
+			return queued
+		}
+		dl.writeLine("hades", "previous run still running, queueing")
+		return append(queued, q)
+	case OverlapKill:
+		dl.writeLine("hades", "previous run still running, killing it")
+		// wait so the next run isn't mistaken for part of this one
+		ad.restartProcess(current.pid, "killed by next run")
+		// only the newest run replaces it
+		return []queuedRun{q}
+	}
+	dl.writeLine("hades", "previous run still running, skipping")
+	return queued
+}
+
+// startRun starts run q of the job described by l, returning it (nil if
+// the process couldn't be started).
+func (ad *activeDaemon) startRun(l *launcher, q queuedRun) *jobRun {
+	dl := ad.log()
+	r := &jobRun{
+		run: &JobRun{
+			Scheduled: q.scheduled,
+			Start:     time.Now(),
+		},
+		done: make(chan *JobRun, 1),
+	}
+	ad.setStatus("running")
+	ad.addEvent(&Event{Type: EventRun, User: q.user, Cause: q.cause})
+	dl.writeLine("hades", "starting run")
+	c, _, err := ad.launch(l)
+	if err != nil {
+		dl.writeLine("hades", err.Error())
+		r.run.ExitCode = -1
+		r.run.ExitReason = "failed to start: " + err.Error()
+		ad.setExit(-1, r.run.ExitReason)
+		ad.h.addRun(ad.id, r.run)
+		ad.setStatus("scheduled")
+		return nil
+	}
+	r.pid = c.Process.Pid
+	// a run killed by a stop while starting is still recorded
+	ad.setStartedPid(r.pid)
+	ad.setStarted(r.run.Start)
+	if l.cg != nil {
+		r.ooms = l.cg.oomKills()
+	}
+	go func() {
+		c.Wait()
+		ad.setPid(0)
+		r.run.Duration = Duration(time.Since(r.run.Start))
+		code, reason := exitStatus(c, l.cg, r.ooms)
+		if why := ad.takeRestartReason(); why != "" {
+			reason += " (" + why + ")"
+		}
+		dl.writeLine("hades", reason)
+		ad.setExit(code, reason)
+		r.run.ExitCode = code
+		r.run.ExitReason = reason
+		r.done <- r.run
+	}()
+	return r
+}
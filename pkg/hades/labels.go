@@ -0,0 +1,263 @@
+package hades
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Bulk actions.
+const (
+	// ActionStart starts matching daemons that aren't running.
+	ActionStart = "start"
+	// ActionStop stops matching daemons that are running.
+	ActionStop = "stop"
+	// ActionRestart restarts matching daemons that are running.
+	ActionRestart = "restart"
+)
+
+// maximum length of names, label keys and label values.
+const maxNameLength = 63
+
+var (
+	// names start with a letter or digit and can't be all digits (so they
+	// can't be mistaken for ids)
+	namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	// label keys can have a prefix like "example.com/role"
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+	labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+)
+
+// validateName returns an error if name isn't a valid daemon name (empty
+// names are allowed).
+func validateName(name string) error {
+	if name == "" {
+		return nil
+	}
+	_, err := strconv.ParseUint(name, 10, 64)
+	if err == nil {
+		return fmt.Errorf("hades: name %q can't be a number", name)
+	}
+	if len(name) > maxNameLength || !namePattern.MatchString(name) {
+		return fmt.Errorf("hades: invalid name %q", name)
+	}
+	return nil
+}
+
+// validateLabels returns an error if any label key or value is invalid.
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if len(k) > maxNameLength || !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("hades: invalid label key %q", k)
+		}
+		if len(v) > maxNameLength || !labelValuePattern.MatchString(v) {
+			return fmt.Errorf("hades: invalid value %q for label %q", v, k)
+		}
+	}
+	return nil
+}
+
+// checkName returns an error if another daemon already uses the name of d.
+func checkName(d *Daemon, daemons map[uint64]*Daemon) error {
+	if d.Name == "" {
+		return nil
+	}
+	for _, other := range daemons {
+		if other.ID != d.ID && other.Name == d.Name {
+			return fmt.Errorf("hades: name %q is used by daemon %d", d.Name, other.ID)
+		}
+	}
+	return nil
+}
+
+// Lookup returns a daemon by name or (decimal) id.
+func (h *Hades) Lookup(ref string) (*Daemon, error) {
+	id, err := strconv.ParseUint(ref, 10, 64)
+	if err == nil {
+		return h.Get(id)
+	}
+	daemons, err := h.Daemons()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range daemons {
+		if d.Name != "" && d.Name == ref {
+			return d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// selectorTerm is a single requirement of a Selector.
+type selectorTerm struct {
+	key string
+	// op is "=", "!=", "exists" or "!exists"
+	op    string
+	value string
+}
+
+// Selector selects daemons by their labels.
+type Selector struct {
+	terms []selectorTerm
+}
+
+// ParseSelector parses a comma separated list of label requirements which
+// all have to match: "key=value" (or "=="), "key!=value", "key" (has the
+// label) and "!key" (doesn't have it). An empty string matches everything.
+func ParseSelector(s string) (*Selector, error) {
+	sel := &Selector{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		t := selectorTerm{}
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			t = selectorTerm{kv[0], "!=", kv[1]}
+		case strings.Contains(part, "=="):
+			kv := strings.SplitN(part, "==", 2)
+			t = selectorTerm{kv[0], "=", kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			t = selectorTerm{kv[0], "=", kv[1]}
+		case strings.HasPrefix(part, "!"):
+			t = selectorTerm{part[1:], "!exists", ""}
+		default:
+			t = selectorTerm{part, "exists", ""}
+		}
+		t.key = strings.TrimSpace(t.key)
+		t.value = strings.TrimSpace(t.value)
+		if !labelKeyPattern.MatchString(t.key) {
+			return nil, fmt.Errorf("hades: invalid selector %q", part)
+		}
+		if !labelValuePattern.MatchString(t.value) {
+			return nil, fmt.Errorf("hades: invalid selector %q", part)
+		}
+		sel.terms = append(sel.terms, t)
+	}
+	return sel, nil
+}
+
+// Empty returns true if the selector matches everything.
+func (sel *Selector) Empty() bool {
+	return len(sel.terms) == 0
+}
+
+// Matches returns true if labels satisfy every requirement of sel.
+func (sel *Selector) Matches(labels map[string]string) bool {
+	for _, t := range sel.terms {
+		v, ok := labels[t.key]
+		switch t.op {
+		case "=":
+			if !ok || v != t.value {
+				return false
+			}
+		case "!=":
+			if ok && v == t.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String returns the selector in the format read by ParseSelector.
+func (sel *Selector) String() string {
+	parts := make([]string, 0, len(sel.terms))
+	for _, t := range sel.terms {
+		switch t.op {
+		case "exists":
+			parts = append(parts, t.key)
+		case "!exists":
+			parts = append(parts, "!"+t.key)
+		default:
+			parts = append(parts, t.key+t.op+t.value)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Select returns the daemons with labels matching sel.
+func (h *Hades) Select(sel *Selector) ([]*Daemon, error) {
+	daemons, err := h.Daemons()
+	if err != nil {
+		return nil, err
+	}
+	selected := make([]*Daemon, 0)
+	for _, d := range daemons {
+		if sel.Matches(d.Labels) {
+			selected = append(selected, d)
+		}
+	}
+	return selected, nil
+}
+
+// Restart stops a running daemon and starts it again (with its current
+// definition).
+func (h *Hades) Restart(id uint64, user string) error {
+	_, err := h.getInstances(id)
+	if err != nil {
+		return err
+	}
+	return h.restart(id, user, "restarted")
+}
+
+// BulkAction applies action (ActionStart, ActionStop or ActionRestart) to
+// every daemon matching sel, skipping those it doesn't apply to (like
+// starting a running daemon). It returns the ids of the daemons acted on
+// and the first error.
+func (h *Hades) BulkAction(sel *Selector, action, user string) ([]uint64, error) {
+	daemons, err := h.Select(sel)
+	if err != nil {
+		return nil, err
+	}
+	var fn func(id uint64) error
+	switch action {
+	case ActionStart:
+		fn = func(id uint64) error { return h.Start(id, user) }
+	case ActionStop:
+		fn = func(id uint64) error { return h.Stop(id, user) }
+	case ActionRestart:
+		fn = func(id uint64) error { return h.Restart(id, user) }
+	default:
+		return nil, fmt.Errorf("hades: unknown action %q", action)
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	ids := make([]uint64, 0, len(daemons))
+	for _, d := range daemons {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			err := fn(id)
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch err {
+			case nil:
+				ids = append(ids, id)
+			case ErrAlreadyStarted, ErrNotStarted:
+			default:
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}(d.ID)
+	}
+	wg.Wait()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, firstErr
+}
@@ -0,0 +1,193 @@
+package hades
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Limits represents resource limits and scheduling settings applied to a
+// daemon process before it's executed. Empty (or zero) values are left as
+// inherited from hades.
+type Limits struct {
+	// NoFile limits open file descriptors (RLIMIT_NOFILE).
+	NoFile string `json:"nofile,omitempty"`
+	// Core limits core dump size in bytes (RLIMIT_CORE).
+	Core string `json:"core,omitempty"`
+	// AddressSpace limits virtual memory size in bytes (RLIMIT_AS).
+	AddressSpace string `json:"as,omitempty"`
+	// NProc limits the number of processes for the user (RLIMIT_NPROC).
+	NProc string `json:"nproc,omitempty"`
+	// Nice is the scheduling priority (-20 to 19).
+	Nice int `json:"nice,omitempty"`
+	// IOPriority is an I/O class and level like "be:4", "rt:0" or "idle".
+	IOPriority string `json:"ioprio,omitempty"`
+	// OOMScoreAdj adjusts the OOM killer score (-1000 to 1000).
+	OOMScoreAdj int `json:"oom_score_adj,omitempty"`
+	// CPUAffinity is a CPU list like "0-3,6".
+	CPUAffinity string `json:"cpu_affinity,omitempty"`
+}
+
+// rlimit represents a soft and hard resource limit.
+type rlimit struct {
+	Cur uint64 `json:"cur"`
+	Max uint64 `json:"max"`
+}
+
+// rlimitInfinity represents an unlimited resource.
+const rlimitInfinity = math.MaxUint64
+
+// I/O scheduling classes.
+var ioClasses = map[string]int{
+	"rt":   1,
+	"be":   2,
+	"idle": 3,
+}
+
+// empty returns true if no limits are set.
+func (l *Limits) empty() bool {
+	return *l == Limits{}
+}
+
+// validate returns an error if any limit is invalid.
+func (l *Limits) validate() error {
+	_, err := l.rlimits()
+	if err != nil {
+		return err
+	}
+	if l.Nice < -20 || l.Nice > 19 {
+		return fmt.Errorf("hades: nice must be between -20 and 19")
+	}
+	if l.OOMScoreAdj < -1000 || l.OOMScoreAdj > 1000 {
+		return fmt.Errorf("hades: oom score adjustment must be between -1000 and 1000")
+	}
+	_, err = parseIOPriority(l.IOPriority)
+	if err != nil {
+		return err
+	}
+	_, err = parseCPUList(l.CPUAffinity)
+	return err
+}
+
+// rlimits returns the parsed resource limits by name.
+func (l *Limits) rlimits() (map[string]rlimit, error) {
+	limits := make(map[string]rlimit)
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"nofile", l.NoFile},
+		{"core", l.Core},
+		{"as", l.AddressSpace},
+		{"nproc", l.NProc},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		r, err := parseRlimit(f.value)
+		if err != nil {
+			return nil, fmt.Errorf("hades: invalid %s limit %q", f.name, f.value)
+		}
+		limits[f.name] = r
+	}
+	return limits, nil
+}
+
+// parseRlimit parses "N", "unlimited" or "soft:hard".
+func parseRlimit(s string) (rlimit, error) {
+	parts := strings.SplitN(s, ":", 2)
+	cur, err := parseRlimitValue(parts[0])
+	if err != nil {
+		return rlimit{}, err
+	}
+	max := cur
+	if len(parts) == 2 {
+		max, err = parseRlimitValue(parts[1])
+		if err != nil {
+			return rlimit{}, err
+		}
+	}
+	if cur > max {
+		return rlimit{}, fmt.Errorf("soft limit exceeds hard limit")
+	}
+	return rlimit{Cur: cur, Max: max}, nil
+}
+
+// parseRlimitValue parses a single limit value with optional K/M/G suffix.
+func parseRlimitValue(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "unlimited" || s == "infinity" {
+		return rlimitInfinity, nil
+	}
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// parseIOPriority parses an I/O priority into the ioprio_set value (0 for
+// none).
+func parseIOPriority(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	class, ok := ioClasses[parts[0]]
+	if !ok {
+		return 0, fmt.Errorf("hades: invalid io priority class %q", parts[0])
+	}
+	level := 4
+	if len(parts) == 2 {
+		var err error
+		level, err = strconv.Atoi(parts[1])
+		if err != nil || level < 0 || level > 7 {
+			return 0, fmt.Errorf("hades: invalid io priority level %q", parts[1])
+		}
+	}
+	if class == ioClasses["idle"] {
+		level = 0
+	}
+	return class<<13 | level, nil
+}
+
+// parseCPUList parses a CPU list like "0-3,6" into CPU numbers.
+func parseCPUList(s string) ([]int, error) {
+	cpus := make([]int, 0)
+	if s == "" {
+		return cpus, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil || lo < 0 {
+			return nil, fmt.Errorf("hades: invalid cpu list %q", s)
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			hi, err = strconv.Atoi(bounds[1])
+			if err != nil || hi < lo {
+				return nil, fmt.Errorf("hades: invalid cpu list %q", s)
+			}
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
@@ -0,0 +1,453 @@
+package hades
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// format used for timestamps at the start of each log line.
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// format used for timestamps in rotated log file names.
+const logRotateFormat = "20060102T150405.000000"
+
+// maximum length of a single log line before it's broken up.
+const maxLogLine = 64 * 1024
+
+// number of recent lines kept in memory per daemon for tailing.
+const logBufferSize = 1000
+
+// number of lines a log subscriber can fall behind before being dropped.
+const logSubscriberBuffer = 256
+
+// logFile is a size and age rotated log file for a single daemon.
+type logFile struct {
+	opts         *Options
+	path         string
+	mutex        sync.Mutex
+	file         *os.File
+	size         int64
+	opened       time.Time
+	cleanupMutex sync.Mutex
+}
+
+// newLogFile returns a logFile writing to path (opened on first write).
+func newLogFile(opts *Options, path string) *logFile {
+	return &logFile{
+		opts: opts,
+		path: path,
+	}
+}
+
+// Write appends p to the log file, rotating it first if needed.
+func (lf *logFile) Write(p []byte) (int, error) {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	if lf.file == nil {
+		err := lf.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if lf.shouldRotate(int64(len(p))) {
+		err := lf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.file.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// Close closes the underlying file.
+func (lf *logFile) Close() error {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	if lf.file == nil {
+		return nil
+	}
+	err := lf.file.Close()
+	lf.file = nil
+	return err
+}
+
+// shouldRotate returns true if writing n more bytes requires rotation.
+func (lf *logFile) shouldRotate(n int64) bool {
+	if lf.size == 0 {
+		return false
+	}
+	if lf.opts.LogMaxSize > 0 && lf.size+n > lf.opts.LogMaxSize {
+		return true
+	}
+	if lf.opts.LogMaxAge > 0 && time.Since(lf.opened) > lf.opts.LogMaxAge {
+		return true
+	}
+	return false
+}
+
+// open opens (or creates) the current log file for appending.
+func (lf *logFile) open() error {
+	err := os.MkdirAll(filepath.Dir(lf.path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(lf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.file = f
+	lf.size = info.Size()
+	lf.opened = time.Now()
+	if lf.size > 0 {
+		// creation time isn't portable so existing files age from last write
+		lf.opened = info.ModTime()
+	}
+	return nil
+}
+
+// rotate moves the current file aside and opens a fresh one.
+func (lf *logFile) rotate() error {
+	err := lf.file.Close()
+	lf.file = nil
+	if err != nil {
+		return err
+	}
+	ext := filepath.Ext(lf.path)
+	base := strings.TrimSuffix(lf.path, ext)
+	t := time.Now().UTC()
+	rotated := fmt.Sprintf("%s-%s%s", base, t.Format(logRotateFormat), ext)
+	for fileExists(rotated) || fileExists(rotated+".gz") {
+		// keep names unique (and ordered) for rapid rotations
+		t = t.Add(time.Microsecond)
+		rotated = fmt.Sprintf("%s-%s%s", base, t.Format(logRotateFormat), ext)
+	}
+	err = os.Rename(lf.path, rotated)
+	if err != nil {
+		return err
+	}
+	err = lf.open()
+	if err != nil {
+		return err
+	}
+	lf.opened = time.Now()
+	go lf.cleanup(rotated)
+	return nil
+}
+
+// cleanup compresses a newly rotated segment and enforces retention.
+func (lf *logFile) cleanup(rotated string) {
+	// serialize so retention never races a pending compression
+	lf.cleanupMutex.Lock()
+	defer lf.cleanupMutex.Unlock()
+	if lf.opts.LogCompress {
+		err := compressFile(rotated)
+		if err != nil {
+			log.Printf("logs: %s\n", err)
+		}
+	}
+	if lf.opts.LogMaxBackups <= 0 {
+		return
+	}
+	backups, err := lf.backups()
+	if err != nil {
+		log.Printf("logs: %s\n", err)
+		return
+	}
+	for len(backups) > lf.opts.LogMaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// backups returns finished rotated segments for this log, oldest first.
+func (lf *logFile) backups() ([]string, error) {
+	ext := filepath.Ext(lf.path)
+	base := strings.TrimSuffix(lf.path, ext)
+	if lf.opts.LogCompress {
+		// segments still waiting on compression aren't finished
+		ext += ".gz"
+	}
+	matches, err := filepath.Glob(base + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	// timestamps sort lexically so name order is age order
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// fileExists returns true if path exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// compressFile gzips path to path.gz and removes the original.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// LogLine represents a single line of daemon output.
+type LogLine struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+// daemonLog collects timestamped output lines from a daemon's streams and
+// keeps the most recent ones in memory for tailing.
+type daemonLog struct {
+	file  *logFile
+	mutex sync.Mutex
+	seq   uint64
+	lines []*LogLine
+	subs  map[chan *LogLine]struct{}
+}
+
+// newDaemonLog returns the daemonLog for an instance of daemon id inside
+// opts.LogDir ("<id>.log" for the first instance, "<id>.<n>.log" after).
+func newDaemonLog(opts *Options, id uint64, instance int) *daemonLog {
+	name := fmt.Sprintf("%d.log", id)
+	if instance > 0 {
+		name = fmt.Sprintf("%d.%d.log", id, instance)
+	}
+	path := filepath.Join(opts.LogDir, name)
+	dl := &daemonLog{
+		file:  newLogFile(opts, path),
+		lines: make([]*LogLine, 0, logBufferSize),
+		subs:  make(map[chan *LogLine]struct{}),
+	}
+	// seed buffer with the tail of existing output
+	for _, line := range readLogTail(path, logBufferSize) {
+		dl.seq++
+		line.Seq = dl.seq
+		dl.lines = append(dl.lines, line)
+	}
+	return dl
+}
+
+// writeLine writes a single line tagged with stream name and time.
+func (dl *daemonLog) writeLine(stream, text string) {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+	dl.seq++
+	line := &LogLine{
+		Seq:    dl.seq,
+		Time:   time.Now(),
+		Stream: stream,
+		Text:   text,
+	}
+	_, err := io.WriteString(dl.file, formatLogLine(line))
+	if err != nil {
+		log.Printf("logs: %s\n", err)
+	}
+	if len(dl.lines) == logBufferSize {
+		copy(dl.lines, dl.lines[1:])
+		dl.lines = dl.lines[:len(dl.lines)-1]
+	}
+	dl.lines = append(dl.lines, line)
+	for ch := range dl.subs {
+		select {
+		case ch <- line:
+		default:
+			// slow subscribers are dropped and can resume from buffer
+			delete(dl.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// tail returns up to n of the most recent lines (all if n <= 0).
+func (dl *daemonLog) tail(n int) []*LogLine {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+	lines := dl.lines
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	out := make([]*LogLine, len(lines))
+	copy(out, lines)
+	return out
+}
+
+// since returns buffered lines with a sequence number greater than seq.
+func (dl *daemonLog) since(seq uint64) []*LogLine {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+	i := sort.Search(len(dl.lines), func(i int) bool {
+		return dl.lines[i].Seq > seq
+	})
+	out := make([]*LogLine, len(dl.lines)-i)
+	copy(out, dl.lines[i:])
+	return out
+}
+
+// subscribe returns a channel receiving new lines and a function to cancel
+// the subscription. The channel is closed if the subscriber falls behind.
+func (dl *daemonLog) subscribe() (<-chan *LogLine, func()) {
+	ch := make(chan *LogLine, logSubscriberBuffer)
+	dl.mutex.Lock()
+	dl.subs[ch] = struct{}{}
+	dl.mutex.Unlock()
+	cancel := func() {
+		dl.mutex.Lock()
+		defer dl.mutex.Unlock()
+		_, exists := dl.subs[ch]
+		if exists {
+			delete(dl.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// pipe returns a writable file to hand to a child process for stream and
+// starts copying its lines into the log. The caller should close the
+// returned file after the process has started.
+func (dl *daemonLog) pipe(stream string) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go dl.copyLines(stream, r)
+	return w, nil
+}
+
+// copyLines reads lines from r until EOF and writes them to the log.
+func (dl *daemonLog) copyLines(stream string, r io.ReadCloser) {
+	defer r.Close()
+	br := bufio.NewReaderSize(r, maxLogLine)
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			text := strings.TrimRight(string(line), "\r\n")
+			dl.writeLine(stream, text)
+		}
+		if err == bufio.ErrBufferFull {
+			// overly long line, emit it in chunks
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close closes the underlying log file and ends all subscriptions.
+func (dl *daemonLog) close() error {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+	for ch := range dl.subs {
+		delete(dl.subs, ch)
+		close(ch)
+	}
+	return dl.file.Close()
+}
+
+// formatLogLine returns line as it's written to log files.
+func formatLogLine(line *LogLine) string {
+	t := line.Time.Format(logTimeFormat)
+	return fmt.Sprintf("%s %s %s\n", t, line.Stream, line.Text)
+}
+
+// parseLogLine parses a line written by formatLogLine.
+func parseLogLine(s string) (*LogLine, error) {
+	parts := strings.SplitN(s, " ", 3)
+	if len(parts) < 2 {
+		return nil, errors.New("logs: malformed line")
+	}
+	t, err := time.Parse(logTimeFormat, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	line := &LogLine{
+		Time:   t,
+		Stream: parts[1],
+	}
+	if len(parts) == 3 {
+		line.Text = parts[2]
+	}
+	return line, nil
+}
+
+// readLogTail returns up to n parsed lines from the end of the file at path.
+func readLogTail(path string, n int) []*LogLine {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	// only look at the end of the file, lines are usually short
+	offset := info.Size() - int64(n)*1024
+	if offset > 0 {
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			return nil
+		}
+	}
+	lines := make([]*LogLine, 0, n)
+	br := bufio.NewReaderSize(f, maxLogLine)
+	if offset > 0 {
+		// skip partial first line
+		br.ReadString('\n')
+	}
+	for {
+		s, err := br.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line, perr := parseLogLine(strings.TrimSuffix(s, "\n"))
+		if perr != nil {
+			continue
+		}
+		if len(lines) == n {
+			lines = lines[1:]
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
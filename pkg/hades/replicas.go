@@ -0,0 +1,314 @@
+package hades
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// maximum number of instances of a daemon.
+const maxReplicas = 100
+
+// Instance represents the runtime state of one process of a daemon.
+type Instance struct {
+	Status     string    `json:"status"`
+	Restarts   int       `json:"restarts"`
+	ExitCode   int       `json:"exit_code"`
+	ExitReason string    `json:"exit_reason,omitempty"`
+	Started    time.Time `json:"started,omitempty"`
+}
+
+// up returns true if status means an instance has a live process.
+func up(status string) bool {
+	switch status {
+	case "running", "healthy", "unhealthy", "paused":
+		return true
+	}
+	return false
+}
+
+// validateReplicas returns an error if the replica count or base port of
+// d is invalid.
+func (d *Daemon) validateReplicas() error {
+	if d.Replicas < 0 || d.Replicas > maxReplicas {
+		return fmt.Errorf("hades: replicas must be between 1 and %d", maxReplicas)
+	}
+	if d.Kind == KindJob && d.Replicas > 1 {
+		return errors.New("hades: jobs can't have replicas")
+	}
+	if d.Port < 0 || d.Port+d.replicas()-1 > 65535 {
+		return fmt.Errorf("hades: invalid port %d", d.Port)
+	}
+	return nil
+}
+
+// replicas returns the number of instances d runs (at least 1).
+func (d *Daemon) replicas() int {
+	if d.Replicas < 1 {
+		return 1
+	}
+	return d.Replicas
+}
+
+// instance returns the state of instance i, adding (stopped) instances as
+// needed.
+func (d *Daemon) instance(i int) *Instance {
+	for len(d.Instances) <= i {
+		d.Instances = append(d.Instances, Instance{Status: "stopped"})
+	}
+	return &d.Instances[i]
+}
+
+// order of status when summarizing instances that are all up (worst first).
+var upStatusOrder = []string{"unhealthy", "paused", "running", "healthy"}
+
+// order of status when summarizing instances that are all down.
+var downStatusOrder = []string{"failed", "restarting", "waiting", "crashloop"}
+
+// summarize drops stopped instances beyond the replica count and sets the
+// daemon status, restarts and start time from its instances. The status is
+// shared by all instances or "degraded" if only some are up.
+func (d *Daemon) summarize() {
+	n := len(d.Instances)
+	for n > d.replicas() && d.Instances[n-1].Status == "stopped" {
+		n--
+	}
+	d.Instances = d.Instances[:n]
+	if n == 0 {
+		return
+	}
+	count := make(map[string]int)
+	d.Restarts = 0
+	d.Started = time.Time{}
+	for _, in := range d.Instances {
+		count[in.Status]++
+		d.Restarts += in.Restarts
+		if up(in.Status) && (d.Started.IsZero() || in.Started.Before(d.Started)) {
+			d.Started = in.Started
+		}
+	}
+	live := 0
+	for status, c := range count {
+		if up(status) {
+			live += c
+		}
+	}
+	switch {
+	case len(count) == 1:
+		d.Status = d.Instances[0].Status
+	case count["stopping"] > 0:
+		d.Status = "stopping"
+	case live == n:
+		d.Status = firstStatus(count, upStatusOrder)
+	case live > 0:
+		d.Status = "degraded"
+	default:
+		d.Status = firstStatus(count, downStatusOrder)
+	}
+}
+
+// firstStatus returns the first status in order with a count (or
+// "stopped").
+func firstStatus(count map[string]int, order []string) string {
+	for _, status := range order {
+		if count[status] > 0 {
+			return status
+		}
+	}
+	return "stopped"
+}
+
+// instanceEnv adds the instance number and port of instance i of d to env
+// (overriding them if set).
+func instanceEnv(d *Daemon, i int, env []string) []string {
+	vars := []string{"HADES_INSTANCE=" + strconv.Itoa(i)}
+	if d.Port > 0 {
+		vars = append(vars, "PORT="+strconv.Itoa(d.Port+i))
+	}
+	out := make([]string, 0, len(env)+len(vars))
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "HADES_INSTANCE=") && !(d.Port > 0 && strings.HasPrefix(kv, "PORT=")) {
+			out = append(out, kv)
+		}
+	}
+	return append(out, vars...)
+}
+
+// expandTarget replaces $PORT and $HADES_INSTANCE (or ${PORT} and
+// ${HADES_INSTANCE}) in a health check target with their values in env.
+func expandTarget(target string, env []string) string {
+	if !strings.Contains(target, "$") {
+		return target
+	}
+	pairs := make([]string, 0)
+	for _, kv := range env {
+		for _, name := range []string{"PORT", "HADES_INSTANCE"} {
+			if strings.HasPrefix(kv, name+"=") {
+				v := kv[len(name)+1:]
+				pairs = append(pairs, "${"+name+"}", v, "$"+name, v)
+			}
+		}
+	}
+	return strings.NewReplacer(pairs...).Replace(target)
+}
+
+// Scale changes the number of instances of a daemon to replicas. If it's
+// running, new instances are started and removed ones are stopped (like
+// with Stop). user is who scaled it (for the history). ErrStopping is
+// returned while instances it would start are still stopping after an
+// earlier scale down.
+func (h *Hades) Scale(id uint64, replicas int, user string) error {
+	if replicas < 1 {
+		return fmt.Errorf("hades: replicas must be between 1 and %d", maxReplicas)
+	}
+	h.activeMutex.Lock()
+	defer h.activeMutex.Unlock()
+	if h.stillStopping(id, replicas) {
+		return ErrStopping
+	}
+	old := 0
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(daemonBucket)
+		v := b.Get(itob(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		d := &Daemon{}
+		err := json.Unmarshal(v, d)
+		if err != nil {
+			return err
+		}
+		old = d.replicas()
+		if replicas == old {
+			return nil
+		}
+		prev := d.definition()
+		d.Replicas = replicas
+		err = d.validateReplicas()
+		if err != nil {
+			return err
+		}
+		enc, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		err = b.Put(itob(id), enc)
+		if err != nil {
+			return err
+		}
+		_, err = saveRevision(tx, d, prev, user, "scaled")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if replicas == old {
+		return nil
+	}
+	cause := fmt.Sprintf("from %d to %d instances", old, replicas)
+	h.addEvent(&Event{Daemon: id, Type: EventScale, User: user, Cause: cause})
+	instances, exists := h.active[id]
+	if !exists {
+		return nil
+	}
+	for i, ad := range instances {
+		if i >= replicas {
+			// cleanup sees it's gone and doesn't disable the daemon, its
+			// number stays taken until it's stopped
+			delete(instances, i)
+			if h.stopping[id] == nil {
+				h.stopping[id] = make(map[int]*activeDaemon)
+			}
+			h.stopping[id][i] = ad
+			go ad.stop(user, "scaled down")
+		}
+	}
+	for i := 0; i < replicas; i++ {
+		if _, ok := instances[i]; ok {
+			continue
+		}
+		err = h.update(id, func(d *Daemon) error {
+			in := d.instance(i)
+			in.Restarts = 0
+			in.Status = d.initialStatus()
+			d.summarize()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		instances[i] = newActiveDaemon(h, id, i)
+	}
+	return nil
+}
+
+// stillStopping returns true if an instance of daemon id numbered below
+// replicas is still stopping after scaling down (h.activeMutex has to be
+// held).
+func (h *Hades) stillStopping(id uint64, replicas int) bool {
+	for i := range h.stopping[id] {
+		if i < replicas {
+			return true
+		}
+	}
+	return false
+}
+
+// stoppingInstances returns the instances of daemon id still stopping
+// after scaling down.
+func (h *Hades) stoppingInstances(id uint64) []*activeDaemon {
+	h.activeMutex.RLock()
+	defer h.activeMutex.RUnlock()
+	instances := make([]*activeDaemon, 0, len(h.stopping[id]))
+	for _, ad := range h.stopping[id] {
+		instances = append(instances, ad)
+	}
+	return instances
+}
+
+// initialStatus returns the status instances of d start in.
+func (d *Daemon) initialStatus() string {
+	if d.Kind == KindJob {
+		return "scheduled"
+	}
+	if len(d.dependencies()) > 0 {
+		// so dependents don't mistake it for ready
+		return "waiting"
+	}
+	return "running"
+}
+
+// getInstances returns the active instances of daemon id (ordered by
+// instance number).
+func (h *Hades) getInstances(id uint64) ([]*activeDaemon, error) {
+	h.activeMutex.RLock()
+	defer h.activeMutex.RUnlock()
+	instances, exists := h.active[id]
+	if !exists {
+		return nil, ErrNotStarted
+	}
+	list := make([]*activeDaemon, 0, len(instances))
+	for _, ad := range instances {
+		list = append(list, ad)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].instance < list[j].instance })
+	return list, nil
+}
+
+// checkInstance returns ErrNotFound unless daemon id has instance i.
+func (h *Hades) checkInstance(id uint64, i int) error {
+	d, err := h.Get(id)
+	if err != nil {
+		return err
+	}
+	if i < 0 || (i >= d.replicas() && i >= len(d.Instances)) {
+		return ErrNotFound
+	}
+	return nil
+}
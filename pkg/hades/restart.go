@@ -0,0 +1,142 @@
+package hades
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Restart policies.
+const (
+	// RestartAlways restarts a daemon whenever it exits.
+	RestartAlways = "always"
+	// RestartOnFailure restarts a daemon only when it exits unsuccessfully.
+	RestartOnFailure = "on-failure"
+	// RestartNever never restarts a daemon.
+	RestartNever = "never"
+)
+
+// default restart backoff range.
+const (
+	defaultBackoffMin = time.Second
+	defaultBackoffMax = time.Minute
+)
+
+// RestartPolicy represents how a daemon is restarted after exiting.
+type RestartPolicy struct {
+	// Policy is one of RestartAlways (default), RestartOnFailure or
+	// RestartNever.
+	Policy string `json:"policy,omitempty"`
+	// MaxRestarts is the number of restarts allowed within Window before
+	// the daemon is considered crash looping (0 for unlimited).
+	MaxRestarts int `json:"max_restarts,omitempty"`
+	// Window is the period MaxRestarts is counted over (0 for forever).
+	Window Duration `json:"window,omitempty"`
+	// BackoffMin is the delay before the first restart.
+	BackoffMin Duration `json:"backoff_min,omitempty"`
+	// BackoffMax caps the exponentially growing restart delay.
+	BackoffMax Duration `json:"backoff_max,omitempty"`
+}
+
+// validate returns an error if the policy settings are invalid.
+func (p *RestartPolicy) validate() error {
+	switch p.Policy {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return fmt.Errorf("hades: invalid restart policy %q", p.Policy)
+	}
+	if p.MaxRestarts < 0 {
+		return fmt.Errorf("hades: invalid max restarts %d", p.MaxRestarts)
+	}
+	if p.Window < 0 || p.BackoffMin < 0 || p.BackoffMax < 0 {
+		return fmt.Errorf("hades: restart durations can't be negative")
+	}
+	if p.BackoffMax > 0 && p.BackoffMin > p.BackoffMax {
+		return fmt.Errorf("hades: backoff min can't exceed backoff max")
+	}
+	return nil
+}
+
+// shouldRestart returns true if a daemon exiting (failed or not) should be
+// restarted.
+func (p *RestartPolicy) shouldRestart(failed bool) bool {
+	switch p.Policy {
+	case RestartNever:
+		return false
+	case RestartOnFailure:
+		return failed
+	}
+	return true
+}
+
+// backoffRange returns min and max restart delays with defaults applied.
+func (p *RestartPolicy) backoffRange() (time.Duration, time.Duration) {
+	min := time.Duration(p.BackoffMin)
+	if min == 0 {
+		min = defaultBackoffMin
+	}
+	max := time.Duration(p.BackoffMax)
+	if max == 0 {
+		max = defaultBackoffMax
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// restartTracker tracks restarts of a daemon to compute backoff delays and
+// detect crash loops.
+type restartTracker struct {
+	policy   *RestartPolicy
+	attempts int
+	times    []time.Time
+}
+
+// newRestartTracker returns a restartTracker for policy.
+func newRestartTracker(policy *RestartPolicy) *restartTracker {
+	return &restartTracker{
+		policy: policy,
+		times:  make([]time.Time, 0),
+	}
+}
+
+// record records a restart after a process ran for uptime. It returns the
+// delay to wait before restarting and false if the restart limit was hit.
+func (rt *restartTracker) record(uptime time.Duration) (time.Duration, bool) {
+	now := time.Now()
+	min, max := rt.policy.backoffRange()
+	if uptime >= max {
+		// process was healthy for a while, start backing off from scratch
+		rt.attempts = 0
+	}
+	if rt.policy.MaxRestarts > 0 {
+		// forget restarts outside of the window
+		window := time.Duration(rt.policy.Window)
+		if window > 0 {
+			i := 0
+			for i < len(rt.times) && now.Sub(rt.times[i]) > window {
+				i++
+			}
+			rt.times = rt.times[i:]
+		}
+		rt.times = append(rt.times, now)
+		if len(rt.times) > rt.policy.MaxRestarts {
+			return 0, false
+		}
+	}
+	delay := min
+	for i := 0; i < rt.attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	rt.attempts++
+	// "equal jitter" keeps at least half of the delay
+	half := delay / 2
+	if half > 0 {
+		delay = half + time.Duration(rand.Int63n(int64(half)))
+	}
+	return delay, true
+}
@@ -0,0 +1,313 @@
+package hades
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// number of revisions kept per daemon.
+const maxRevisions = 50
+
+// bolt.DB bucket for daemon revisions (with a nested bucket per daemon)
+var revisionBucket = []byte("revisions")
+
+// ErrRunning returned when changing a running daemon without restarting it.
+var ErrRunning = errors.New("hades: running, needs restart to apply")
+
+// Revision represents a saved definition of a daemon.
+type Revision struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// User is who saved it.
+	User string `json:"user,omitempty"`
+	// Cause describes how it was made (like a rollback).
+	Cause string `json:"cause,omitempty"`
+	// Changes lists the definition fields changed from the previous
+	// revision.
+	Changes []string `json:"changes,omitempty"`
+	// Daemon is the definition (without runtime state).
+	Daemon *Daemon `json:"daemon"`
+}
+
+// definition returns a copy of d with only its definition (identity, name,
+// command, directory and settings).
+func (d *Daemon) definition() *Daemon {
+	def := &Daemon{ID: d.ID, Name: d.Name, Cmd: d.Cmd, Dir: d.Dir}
+	def.copySettings(d)
+	return def
+}
+
+// changedFields returns the names of definition fields that differ between
+// old and d (sorted).
+func changedFields(old, d *Daemon) []string {
+	fields := func(x *Daemon) map[string]json.RawMessage {
+		m := make(map[string]json.RawMessage)
+		enc, err := json.Marshal(x.definition())
+		if err == nil {
+			json.Unmarshal(enc, &m)
+		}
+		return m
+	}
+	a := fields(old)
+	b := fields(d)
+	changes := make([]string, 0)
+	for k, v := range a {
+		if !bytes.Equal(v, b[k]) {
+			changes = append(changes, k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			changes = append(changes, k)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// fields that running daemons don't use (changing only these doesn't need
+// a restart).
+var metadataFields = map[string]bool{
+	"name":        true,
+	"description": true,
+	"labels":      true,
+}
+
+// needsRestart returns true if changes include fields used by running
+// daemons.
+func needsRestart(changes []string) bool {
+	for _, field := range changes {
+		if !metadataFields[field] {
+			return true
+		}
+	}
+	return false
+}
+
+// Update changes the definition of a daemon (name, command, directory and
+// settings) to def, keeping the old one as a revision. A running daemon is
+// only changed if restart is true, in which case it's restarted to apply
+// it (unless only its name, description or labels changed). user is who
+// changed it (for the history).
+func (h *Hades) Update(id uint64, def *Daemon, user string, restart bool) error {
+	return h.apply(id, def, user, "", restart)
+}
+
+// Rollback changes the definition of a daemon back to revision seq (see
+// Update).
+func (h *Hades) Rollback(id uint64, seq uint64, user string, restart bool) error {
+	var rev *Revision
+	err := h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(revisionBucket).Bucket(itob(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		v := b.Get(itob(seq))
+		if v == nil {
+			return ErrNotFound
+		}
+		rev = &Revision{}
+		return json.Unmarshal(v, rev)
+	})
+	if err != nil {
+		return err
+	}
+	cause := fmt.Sprintf("rollback to revision %d", seq)
+	return h.apply(id, rev.Daemon, user, cause, restart)
+}
+
+// apply saves def as the definition of daemon id and restarts it if it's
+// running (see Update).
+func (h *Hades) apply(id uint64, def *Daemon, user, cause string, restart bool) error {
+	_, err := h.getInstances(id)
+	running := err == nil
+	var rev *Revision
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(daemonBucket)
+		daemons, err := loadDaemons(b)
+		if err != nil {
+			return err
+		}
+		d, ok := daemons[id]
+		if !ok {
+			return ErrNotFound
+		}
+		old := d.definition()
+		d.Name = def.Name
+		d.Cmd = def.Cmd
+		d.Dir = def.Dir
+		d.copySettings(def)
+		err = d.validate()
+		if err != nil {
+			return err
+		}
+		err = checkName(d, daemons)
+		if err != nil {
+			return err
+		}
+		err = checkDependencies(d, daemons)
+		if err != nil {
+			return err
+		}
+		if running && !restart && needsRestart(changedFields(old, d)) {
+			return ErrRunning
+		}
+		enc, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		err = b.Put(itob(id), enc)
+		if err != nil {
+			return err
+		}
+		rev, err = saveRevision(tx, d, old, user, cause)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if rev != nil {
+		detail := "changed " + strings.Join(rev.Changes, ", ")
+		if cause != "" {
+			detail = cause + ", " + detail
+		}
+		h.addEvent(&Event{Daemon: id, Type: EventUpdate, User: user, Cause: detail})
+	}
+	if !running || rev == nil || !needsRestart(rev.Changes) {
+		return nil
+	}
+	if cause == "" {
+		cause = "definition updated"
+	}
+	return h.restart(id, user, cause)
+}
+
+// restart stops daemon id (if it's running) and starts it again.
+func (h *Hades) restart(id uint64, user, cause string) error {
+	instances, err := h.getInstances(id)
+	if err != nil {
+		return nil
+	}
+	for _, ad := range instances {
+		ad.stop(user, cause)
+	}
+	for _, ad := range instances {
+		<-ad.done
+	}
+	// so all instance numbers are free again
+	for _, ad := range h.stoppingInstances(id) {
+		<-ad.done
+	}
+	err = h.startRequired(id, user, cause)
+	if err == ErrAlreadyStarted {
+		// started again in the meantime
+		return nil
+	}
+	return err
+}
+
+// Revisions returns the saved revisions of a daemon, newest first.
+func (h *Hades) Revisions(id uint64) ([]*Revision, error) {
+	_, err := h.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	revs := make([]*Revision, 0)
+	err = h.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(revisionBucket).Bucket(itob(id))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			r := &Revision{}
+			err := json.Unmarshal(v, r)
+			if err != nil {
+				return err
+			}
+			revs = append(revs, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+// saveRevision records the definition of d as a new revision, returning it
+// (nil if nothing changed from old). old is the previous definition (nil
+// for a new daemon) and is recorded first if the daemon has no revisions
+// yet.
+func saveRevision(tx *bolt.Tx, d, old *Daemon, user, cause string) (*Revision, error) {
+	b, err := tx.Bucket(revisionBucket).CreateBucketIfNotExists(itob(d.ID))
+	if err != nil {
+		return nil, err
+	}
+	rev := &Revision{
+		Time:   time.Now(),
+		User:   user,
+		Cause:  cause,
+		Daemon: d.definition(),
+	}
+	if old != nil {
+		rev.Changes = changedFields(old, d)
+		if len(rev.Changes) == 0 {
+			return nil, nil
+		}
+		k, _ := b.Cursor().Last()
+		if k == nil {
+			// saved before revisions were kept
+			err = putRevision(b, &Revision{Time: rev.Time, Daemon: old})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = putRevision(b, rev)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0)
+	b.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte(nil), k...))
+		return nil
+	})
+	for i := 0; i < len(keys)-maxRevisions; i++ {
+		err = b.Delete(keys[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rev, nil
+}
+
+// putRevision stores rev in b with the next sequence number.
+func putRevision(b *bolt.Bucket, rev *Revision) error {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	rev.Seq = seq
+	enc, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	return b.Put(itob(seq), enc)
+}
+
+// removeRevisions deletes all revisions of a daemon.
+func removeRevisions(tx *bolt.Tx, id uint64) error {
+	err := tx.Bucket(revisionBucket).DeleteBucket(itob(id))
+	if err == bolt.ErrBucketNotFound {
+		return nil
+	}
+	return err
+}
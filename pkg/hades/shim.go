@@ -0,0 +1,68 @@
+package hades
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Daemons with resource limits (or a cgroup) are started through a shim:
+// hades executes itself under shimName, the shim joins the cgroup, applies
+// the limits (and drops privileges) and then replaces itself with the daemon
+// command. This way everything is in place before the daemon runs a single
+// instruction.
+
+// argv[0] used to recognize the shim.
+const shimName = "hades-exec"
+
+// environment variable used to pass shimSpec to the shim.
+const shimEnv = "HADES_SHIM_SPEC"
+
+// shimSpec is passed to the shim describing what to apply before exec.
+type shimSpec struct {
+	Limits Limits              `json:"limits"`
+	Cred   *syscall.Credential `json:"cred,omitempty"`
+	// Cgroup is the cgroup.procs file the shim moves itself into.
+	Cgroup string `json:"cgroup,omitempty"`
+}
+
+// newCommand returns the command used to start daemon d running parts as
+// ident with environment env, inside cgroup cg (nil for none).
+func newCommand(d *Daemon, parts []string, ident *identity, env []string, cg *cgroup) (*exec.Cmd, error) {
+	if d.Limits.empty() && cg == nil {
+		c := exec.Command(parts[0], parts[1:]...)
+		c.SysProcAttr = &syscall.SysProcAttr{
+			Setpgid:    true,
+			Credential: ident.cred,
+		}
+		c.Env = env
+		return c, nil
+	}
+	if !shimSupported {
+		return nil, errLimitsUnsupported
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	spec := &shimSpec{
+		Limits: d.Limits,
+		Cred:   ident.cred,
+	}
+	if cg != nil {
+		spec.Cgroup = cg.procsFile()
+	}
+	enc, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	c := &exec.Cmd{
+		Path: exe,
+		Args: append([]string{shimName}, parts...),
+		// shim drops privileges itself after applying limits
+		SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+		Env:         append(env, shimEnv+"="+string(enc)),
+	}
+	return c, nil
+}
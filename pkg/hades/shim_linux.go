@@ -0,0 +1,168 @@
+package hades
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// resource limits are applied by the shim on linux.
+const shimSupported = true
+
+// errLimitsUnsupported is never returned on linux.
+var errLimitsUnsupported error
+
+// rlimit resources by Limits field name.
+var rlimitResources = map[string]int{
+	"nofile": unix.RLIMIT_NOFILE,
+	"core":   unix.RLIMIT_CORE,
+	"as":     unix.RLIMIT_AS,
+	"nproc":  unix.RLIMIT_NPROC,
+}
+
+// Init must be called at the start of main by programs using Hades. When the
+// process was started by Hades as a shim it applies resource limits and
+// replaces itself with the daemon command, never returning. Otherwise it
+// returns immediately.
+func Init() {
+	if filepath.Base(os.Args[0]) != shimName {
+		return
+	}
+	raw, ok := os.LookupEnv(shimEnv)
+	if !ok {
+		return
+	}
+	err := runShim(raw)
+	// only reached if exec failed
+	fmt.Fprintf(os.Stderr, "hades: %s\n", err)
+	os.Exit(127)
+}
+
+// runShim applies the encoded shimSpec and executes the daemon command.
+func runShim(raw string) error {
+	// nice, io priority and affinity are per-thread on linux so everything
+	// has to happen on the thread that calls exec
+	runtime.LockOSThread()
+	os.Unsetenv(shimEnv)
+	spec := &shimSpec{}
+	err := json.Unmarshal([]byte(raw), spec)
+	if err != nil {
+		return err
+	}
+	if len(os.Args) < 2 {
+		return fmt.Errorf("missing command")
+	}
+	if spec.Cgroup != "" {
+		// "0" moves the writing process
+		err = writeFile(spec.Cgroup, "0")
+		if err != nil {
+			return fmt.Errorf("joining cgroup: %s", err)
+		}
+	}
+	err = applyLimits(&spec.Limits)
+	if err != nil {
+		return err
+	}
+	if spec.Cred != nil {
+		err = dropPrivileges(spec.Cred)
+		if err != nil {
+			return err
+		}
+	}
+	path := os.Args[1]
+	if !strings.Contains(path, "/") {
+		// resolve with the daemon's PATH
+		path, err = exec.LookPath(path)
+		if err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(path, os.Args[1:], os.Environ())
+}
+
+// applyLimits applies l to the current process.
+func applyLimits(l *Limits) error {
+	rlimits, err := l.rlimits()
+	if err != nil {
+		return err
+	}
+	for name, r := range rlimits {
+		err = unix.Setrlimit(rlimitResources[name], &unix.Rlimit{
+			Cur: r.Cur,
+			Max: r.Max,
+		})
+		if err != nil {
+			return fmt.Errorf("setting %s limit: %s", name, err)
+		}
+	}
+	if l.Nice != 0 {
+		err = unix.Setpriority(unix.PRIO_PROCESS, 0, l.Nice)
+		if err != nil {
+			return fmt.Errorf("setting nice: %s", err)
+		}
+	}
+	ioprio, err := parseIOPriority(l.IOPriority)
+	if err != nil {
+		return err
+	}
+	if ioprio != 0 {
+		// IOPRIO_WHO_PROCESS = 1
+		_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, 1, 0, uintptr(ioprio))
+		if errno != 0 {
+			return fmt.Errorf("setting io priority: %s", errno)
+		}
+	}
+	if l.OOMScoreAdj != 0 {
+		adj := []byte(strconv.Itoa(l.OOMScoreAdj))
+		err = writeFile("/proc/self/oom_score_adj", string(adj))
+		if err != nil {
+			return fmt.Errorf("setting oom score adjustment: %s", err)
+		}
+	}
+	cpus, err := parseCPUList(l.CPUAffinity)
+	if err != nil {
+		return err
+	}
+	if len(cpus) > 0 {
+		set := &unix.CPUSet{}
+		for _, cpu := range cpus {
+			set.Set(cpu)
+		}
+		err = unix.SchedSetaffinity(0, set)
+		if err != nil {
+			return fmt.Errorf("setting cpu affinity: %s", err)
+		}
+	}
+	return nil
+}
+
+// dropPrivileges switches to the user and groups in cred.
+func dropPrivileges(cred *syscall.Credential) error {
+	if !cred.NoSetGroups {
+		groups := make([]int, len(cred.Groups))
+		for i, g := range cred.Groups {
+			groups[i] = int(g)
+		}
+		err := syscall.Setgroups(groups)
+		if err != nil {
+			return fmt.Errorf("setting groups: %s", err)
+		}
+	}
+	err := syscall.Setgid(int(cred.Gid))
+	if err != nil {
+		return fmt.Errorf("setting gid: %s", err)
+	}
+	err = syscall.Setuid(int(cred.Uid))
+	if err != nil {
+		return fmt.Errorf("setting uid: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package hades
+
+import "errors"
+
+// resource limits are only supported on linux.
+const shimSupported = false
+
+// errLimitsUnsupported returned when starting a daemon with limits.
+var errLimitsUnsupported = errors.New("hades: resource limits are only supported on linux")
+
+// Init must be called at the start of main by programs using Hades. On this
+// platform it does nothing.
+func Init() {}
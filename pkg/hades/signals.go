@@ -0,0 +1,89 @@
+package hades
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// default stop signal and grace period before escalating to SIGKILL.
+const (
+	defaultStopSignal  = syscall.SIGTERM
+	defaultStopTimeout = 10 * time.Second
+)
+
+// interval between checks for a stopping process group to exit.
+const stopPollInterval = 100 * time.Millisecond
+
+// time to wait for a process group to disappear after SIGKILL.
+const killTimeout = 5 * time.Second
+
+// interval between checks for OOM kills in a daemon cgroup.
+const oomPollInterval = time.Second
+
+// signals maps supported signal names to signals.
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// parseSignal returns the signal named name ("TERM" or "SIGTERM"), or the
+// default stop signal if name is empty.
+func parseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return defaultStopSignal, nil
+	}
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signals[name]
+	if !ok {
+		return 0, fmt.Errorf("hades: unsupported signal %q", name)
+	}
+	return sig, nil
+}
+
+// validateStop returns an error if stop signal or timeout are invalid.
+func validateStop(signal string, timeout Duration) error {
+	_, err := parseSignal(signal)
+	if err != nil {
+		return err
+	}
+	if timeout < 0 {
+		return errors.New("hades: stop timeout can't be negative")
+	}
+	return nil
+}
+
+// signalName returns the conventional name of sig (like "SIGTERM").
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// exitReason describes how a process exited from its wait status.
+func exitReason(ws syscall.WaitStatus) (int, string) {
+	if ws.Signaled() {
+		return -1, "killed by " + signalName(ws.Signal())
+	}
+	code := ws.ExitStatus()
+	return code, fmt.Sprintf("exited with code %d", code)
+}
+
+// groupAlive returns true if any process remains in process group pgid.
+func groupAlive(pgid int) bool {
+	err := syscall.Kill(-pgid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,168 @@
+package hades
+
+import (
+	"sync"
+	"time"
+)
+
+// interval between process metric samples.
+const statsInterval = 2 * time.Second
+
+// Stats represents process metrics aggregated over every process of a
+// running daemon, sampled from /proc.
+type Stats struct {
+	// Time is when the sample was taken.
+	Time time.Time `json:"time"`
+	// Processes is the number of processes.
+	Processes int `json:"processes"`
+	// CPUPercent is CPU usage since the previous sample (100 per core).
+	CPUPercent float64 `json:"cpu_percent"`
+	// CPUTime is the user and system CPU time used by current processes.
+	CPUTime time.Duration `json:"cpu_time"`
+	// RSS is the resident memory in bytes.
+	RSS uint64 `json:"rss"`
+	// Threads is the number of threads.
+	Threads int `json:"threads"`
+	// FDs is the number of open file descriptors.
+	FDs int `json:"fds"`
+	// ReadBytes is the number of bytes read from storage.
+	ReadBytes uint64 `json:"read_bytes"`
+	// WriteBytes is the number of bytes written to storage.
+	WriteBytes uint64 `json:"write_bytes"`
+}
+
+// procStat represents metrics of a single process.
+type procStat struct {
+	pid  int
+	pgrp int
+	// ticks is user plus system CPU time in clock ticks
+	ticks      uint64
+	threads    int
+	rss        uint64
+	fds        int
+	readBytes  uint64
+	writeBytes uint64
+}
+
+// statsSampler keeps the latest stats of a daemon and the per process CPU
+// ticks needed to compute usage between samples.
+type statsSampler struct {
+	mutex sync.Mutex
+	stats *Stats
+	ticks map[int]uint64
+}
+
+// Stats returns the latest process metrics of a running daemon (summed
+// over its instances).
+func (h *Hades) Stats(id uint64) (*Stats, error) {
+	instances, err := h.getInstances(id)
+	if err != nil {
+		return nil, err
+	}
+	var procs map[int]*procStat
+	total := &Stats{}
+	for _, ad := range instances {
+		ad.sampler.mutex.Lock()
+		stats := ad.sampler.stats
+		ad.sampler.mutex.Unlock()
+		if stats == nil {
+			// not sampled yet
+			if procs == nil {
+				procs, err = readProcs()
+				if err != nil {
+					return nil, err
+				}
+			}
+			stats = ad.sample(procs)
+		}
+		if stats.Time.After(total.Time) {
+			total.Time = stats.Time
+		}
+		total.Processes += stats.Processes
+		total.CPUPercent += stats.CPUPercent
+		total.CPUTime += stats.CPUTime
+		total.RSS += stats.RSS
+		total.Threads += stats.Threads
+		total.FDs += stats.FDs
+		total.ReadBytes += stats.ReadBytes
+		total.WriteBytes += stats.WriteBytes
+	}
+	return total, nil
+}
+
+// sampleStats samples process metrics of all active daemons forever.
+func (h *Hades) sampleStats() {
+	t := time.NewTicker(statsInterval)
+	defer t.Stop()
+	for range t.C {
+		h.activeMutex.RLock()
+		active := make([]*activeDaemon, 0, len(h.active))
+		for _, instances := range h.active {
+			for _, ad := range instances {
+				active = append(active, ad)
+			}
+		}
+		h.activeMutex.RUnlock()
+		if len(active) == 0 {
+			continue
+		}
+		procs, err := readProcs()
+		if err != nil {
+			return
+		}
+		for _, ad := range active {
+			ad.sample(procs)
+		}
+	}
+}
+
+// sample aggregates the daemon's processes from procs (all processes by
+// pid) into new stats.
+func (ad *activeDaemon) sample(procs map[int]*procStat) *Stats {
+	now := time.Now()
+	members := make([]*procStat, 0)
+	cg := ad.getCgroup()
+	if cg != nil {
+		// includes descendants that left the process group
+		for _, pid := range cg.procs() {
+			if p, ok := procs[pid]; ok {
+				members = append(members, p)
+			}
+		}
+	} else if pgid := ad.getPid(); pgid != 0 {
+		for _, p := range procs {
+			if p.pgrp == pgid {
+				members = append(members, p)
+			}
+		}
+	}
+	s := &Stats{Time: now, Processes: len(members)}
+	ticks := make(map[int]uint64, len(members))
+	ad.sampler.mutex.Lock()
+	defer ad.sampler.mutex.Unlock()
+	var used uint64
+	for _, p := range members {
+		readProcDetails(p)
+		s.RSS += p.rss
+		s.Threads += p.threads
+		s.FDs += p.fds
+		s.ReadBytes += p.readBytes
+		s.WriteBytes += p.writeBytes
+		s.CPUTime += time.Duration(p.ticks) * time.Second / clockTicks
+		ticks[p.pid] = p.ticks
+		// new processes used all their ticks since the last sample
+		prev := ad.sampler.ticks[p.pid]
+		if p.ticks > prev {
+			used += p.ticks - prev
+		}
+	}
+	if last := ad.sampler.stats; last != nil {
+		elapsed := now.Sub(last.Time).Seconds()
+		if elapsed > 0 {
+			s.CPUPercent = float64(used) / clockTicks / elapsed * 100
+		}
+	}
+	ad.sampler.stats = s
+	ad.sampler.ticks = ticks
+	return s
+}
@@ -0,0 +1,91 @@
+package hades
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// clock ticks per second used by /proc (USER_HZ, 100 on every common
+// architecture).
+const clockTicks = 100
+
+// readProcs reads CPU, memory and thread counts of every process by pid.
+func readProcs() (map[int]*procStat, error) {
+	dir, err := os.Open("/proc")
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	pageSize := uint64(os.Getpagesize())
+	procs := make(map[int]*procStat)
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join("/proc", name, "stat"))
+		if err != nil {
+			// exited
+			continue
+		}
+		// the command name can contain spaces and parentheses
+		i := strings.LastIndexByte(string(b), ')')
+		if i < 0 {
+			continue
+		}
+		// fields after the name start at field 3 (state)
+		f := strings.Fields(string(b[i+1:]))
+		if len(f) < 22 {
+			continue
+		}
+		p := &procStat{pid: pid}
+		p.pgrp, _ = strconv.Atoi(f[2])
+		utime, _ := strconv.ParseUint(f[11], 10, 64)
+		stime, _ := strconv.ParseUint(f[12], 10, 64)
+		p.ticks = utime + stime
+		p.threads, _ = strconv.Atoi(f[17])
+		rss, _ := strconv.ParseUint(f[21], 10, 64)
+		p.rss = rss * pageSize
+		procs[pid] = p
+	}
+	return procs, nil
+}
+
+// readProcDetails reads open fd count and I/O bytes of process p (only
+// done for daemon processes since it's more expensive).
+func readProcDetails(p *procStat) {
+	dir := filepath.Join("/proc", strconv.Itoa(p.pid))
+	fds, err := os.Open(filepath.Join(dir, "fd"))
+	if err == nil {
+		names, _ := fds.Readdirnames(-1)
+		fds.Close()
+		p.fds = len(names)
+	}
+	f, err := os.Open(filepath.Join(dir, "io"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "read_bytes:":
+			p.readBytes = n
+		case "write_bytes:":
+			p.writeBytes = n
+		}
+	}
+}
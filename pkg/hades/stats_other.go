@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package hades
+
+import "errors"
+
+// errStatsUnsupported returned when sampling processes on other platforms.
+var errStatsUnsupported = errors.New("hades: process stats are only supported on linux")
+
+// clock ticks per second (unused on this platform).
+const clockTicks = 100
+
+// readProcs always fails on this platform.
+func readProcs() (map[int]*procStat, error) {
+	return nil, errStatsUnsupported
+}
+
+// readProcDetails does nothing on this platform.
+func readProcDetails(p *procStat) {}
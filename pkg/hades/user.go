@@ -0,0 +1,113 @@
+package hades
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// identity represents the resolved user and groups a daemon runs as.
+type identity struct {
+	// cred is nil when running as the hades user.
+	cred *syscall.Credential
+	name string
+	home string
+}
+
+// resolveIdentity looks up the user and groups daemon d runs as.
+func (d *Daemon) resolveIdentity() (*identity, error) {
+	if d.User == "" && d.Group == "" && len(d.Groups) == 0 {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		return &identity{name: usr.Username, home: usr.HomeDir}, nil
+	}
+	var usr *user.User
+	var err error
+	if d.User != "" {
+		usr, err = lookupUser(d.User)
+	} else {
+		usr, err = user.Current()
+	}
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(usr.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(usr.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	if d.Group != "" {
+		gid, err = lookupGroup(d.Group)
+		if err != nil {
+			return nil, err
+		}
+	}
+	groups := make([]uint32, 0)
+	if len(d.Groups) > 0 {
+		for _, name := range d.Groups {
+			g, err := lookupGroup(name)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, uint32(g))
+		}
+	} else if d.User != "" {
+		// default to the user's own supplementary groups (like login)
+		ids, err := usr.GroupIds()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			g, err := strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				continue
+			}
+			groups = append(groups, uint32(g))
+		}
+	}
+	cred := &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: groups,
+		// only changing primary group keeps current supplementary groups
+		NoSetGroups: d.User == "" && len(d.Groups) == 0,
+	}
+	return &identity{cred: cred, name: usr.Username, home: usr.HomeDir}, nil
+}
+
+// lookupUser finds a user by name or numeric uid.
+func lookupUser(name string) (*user.User, error) {
+	usr, err := user.Lookup(name)
+	if err == nil {
+		return usr, nil
+	}
+	_, nerr := strconv.ParseUint(name, 10, 32)
+	if nerr != nil {
+		return nil, fmt.Errorf("hades: unknown user %q", name)
+	}
+	usr, err = user.LookupId(name)
+	if err != nil {
+		return nil, fmt.Errorf("hades: unknown user %q", name)
+	}
+	return usr, nil
+}
+
+// lookupGroup finds a gid by group name or numeric gid.
+func lookupGroup(name string) (uint64, error) {
+	grp, err := user.LookupGroup(name)
+	if err == nil {
+		return strconv.ParseUint(grp.Gid, 10, 32)
+	}
+	gid, nerr := strconv.ParseUint(name, 10, 32)
+	if nerr != nil {
+		return 0, fmt.Errorf("hades: unknown group %q", name)
+	}
+	// numeric groups don't need to exist in the group database
+	return gid, nil
+}
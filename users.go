@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wybiral/hades/internal/app"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// userUsage describes the hades user commands.
+const userUsage = `usage: hades user <command> [flags] <name>
+
+commands:
+  list                     list users
+  add [-role r] [-g] <name>
+                           add a user (viewer, operator or admin, default viewer)
+  passwd [-g] <name>       change the password of a user
+  role <name> <role>       change the role of a user
+  reset-2fa <name>         turn off two-factor authentication of a user (who
+                           lost their authenticator and recovery codes)
+  rm <name>                remove a user
+
+Passwords are asked for (or read from stdin when it isn't a terminal), -g
+generates and prints one instead. Every command takes -control (the socket of
+the hades server, default hades.sock).
+`
+
+// userRequest is the body of control socket user requests.
+type userRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
+
+// user command: manages user accounts of a running server
+func userCommand(args []string) error {
+	commands := map[string]func([]string) error{
+		"list":      userList,
+		"add":       userAdd,
+		"passwd":    userPasswd,
+		"role":      userRole,
+		"reset-2fa": userResetTwoFactor,
+		"rm":        userRemove,
+	}
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, userUsage)
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		if args[0] != "-h" && args[0] != "help" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		}
+		fmt.Fprint(os.Stderr, userUsage)
+		os.Exit(2)
+	}
+	return cmd(args[1:])
+}
+
+// userFlags returns the flag set of a hades user command and its control
+// socket flag.
+func userFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("user "+name, flag.ExitOnError)
+	control := fs.String("control", defaultControlPath, "control socket of the hades server")
+	return fs, control
+}
+
+// parseUserFlags parses the arguments of a hades user command, exiting
+// with a usage error unless it gets n arguments.
+func parseUserFlags(fs *flag.FlagSet, args []string, n int) {
+	fs.Parse(args)
+	if fs.NArg() != n {
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// sendUser sends a user request to the control socket.
+func sendUser(control, method, target string, req *userRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return controlRequest(control, method, target, bytes.NewReader(body), os.Stdout)
+}
+
+// newPassword returns a generated password (printing it) or one read from
+// the terminal (twice) or stdin.
+func newPassword(generate bool) (string, error) {
+	if generate {
+		password, err := app.GeneratePassword()
+		if err != nil {
+			return "", err
+		}
+		fmt.Println("New password: " + password)
+		return password, nil
+	}
+	stdin := int(syscall.Stdin)
+	if !terminal.IsTerminal(stdin) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("no password on stdin")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Print("New password: ")
+	p1, err := terminal.ReadPassword(stdin)
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("\n")
+	fmt.Print("New password (again): ")
+	p2, err := terminal.ReadPassword(stdin)
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("\n")
+	if !bytes.Equal(p1, p2) {
+		return "", fmt.Errorf("passwords must match")
+	}
+	return string(p1), nil
+}
+
+// user list: prints users
+func userList(args []string) error {
+	fs, control := userFlags("list")
+	parseUserFlags(fs, args, 0)
+	var buf bytes.Buffer
+	err := controlRequest(*control, "GET", "/users", nil, &buf)
+	if err != nil {
+		return err
+	}
+	var users []struct {
+		Name      string    `json:"name"`
+		Role      string    `json:"role"`
+		Created   time.Time `json:"created"`
+		TwoFactor bool      `json:"two_factor"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &users)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tROLE\t2FA\tCREATED")
+	for _, u := range users {
+		twoFactor := "off"
+		if u.TwoFactor {
+			twoFactor = "on"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Name, u.Role, twoFactor, u.Created.Format("2006-01-02 15:04:05"))
+	}
+	return tw.Flush()
+}
+
+// user add: adds a user
+func userAdd(args []string) error {
+	fs, control := userFlags("add")
+	role := fs.String("role", "viewer", "role: viewer, operator or admin")
+	generate := fs.Bool("g", false, "generate a password")
+	parseUserFlags(fs, args, 1)
+	password, err := newPassword(*generate)
+	if err != nil {
+		return err
+	}
+	return sendUser(*control, "POST", "/users", &userRequest{
+		Name:     fs.Arg(0),
+		Password: password,
+		Role:     *role,
+	})
+}
+
+// user passwd: changes the password of a user
+func userPasswd(args []string) error {
+	fs, control := userFlags("passwd")
+	generate := fs.Bool("g", false, "generate a password")
+	parseUserFlags(fs, args, 1)
+	password, err := newPassword(*generate)
+	if err != nil {
+		return err
+	}
+	return sendUser(*control, "PUT", "/users/"+url.PathEscape(fs.Arg(0)), &userRequest{
+		Password: password,
+	})
+}
+
+// user role: changes the role of a user
+func userRole(args []string) error {
+	fs, control := userFlags("role")
+	parseUserFlags(fs, args, 2)
+	return sendUser(*control, "PUT", "/users/"+url.PathEscape(fs.Arg(0)), &userRequest{
+		Role: fs.Arg(1),
+	})
+}
+
+// user reset-2fa: turns off two-factor authentication of a user
+func userResetTwoFactor(args []string) error {
+	fs, control := userFlags("reset-2fa")
+	parseUserFlags(fs, args, 1)
+	return controlRequest(*control, "DELETE", "/users/"+url.PathEscape(fs.Arg(0))+"/2fa", nil, os.Stdout)
+}
+
+// user rm: removes a user
+func userRemove(args []string) error {
+	fs, control := userFlags("rm")
+	parseUserFlags(fs, args, 1)
+	return controlRequest(*control, "DELETE", "/users/"+url.PathEscape(fs.Arg(0)), nil, os.Stdout)
+}